@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS schedule.attempt (
+    id BIGSERIAL PRIMARY KEY
+    , job_id INT NOT NULL REFERENCES schedule.primary_queue (id) ON DELETE CASCADE
+    , started_at BIGINT NOT NULL
+    , status_code INT NOT NULL
+    , latency_ms BIGINT NOT NULL
+    , error TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS attempt_job_id_idx ON schedule.attempt (job_id);
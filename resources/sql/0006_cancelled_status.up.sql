@@ -0,0 +1,2 @@
+INSERT INTO schedule.status (Id, Name) VALUES (3, 'Cancelled');
+ALTER TABLE schedule.primary_queue ADD COLUMN IF NOT EXISTS cancelled_at BIGINT;
@@ -0,0 +1 @@
+ALTER TABLE schedule.primary_queue ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS schedule.idempotency_key (
+    key TEXT PRIMARY KEY
+    , job_id INT NOT NULL REFERENCES schedule.primary_queue (id) ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED
+    , expires_at BIGINT NOT NULL
+);
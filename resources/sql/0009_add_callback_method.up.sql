@@ -0,0 +1,4 @@
+ALTER TABLE schedule.primary_queue
+    ADD COLUMN IF NOT EXISTS method VARCHAR(7) NOT NULL DEFAULT 'POST'
+    , ADD COLUMN IF NOT EXISTS query TEXT NOT NULL DEFAULT 'null'
+    , ADD COLUMN IF NOT EXISTS content_type TEXT NOT NULL DEFAULT '';
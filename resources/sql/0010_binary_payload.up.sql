@@ -0,0 +1,6 @@
+ALTER TABLE schedule.primary_queue
+    ALTER COLUMN payload TYPE BYTEA USING convert_to(payload, 'UTF8')
+    , ALTER COLUMN headers TYPE JSONB USING headers::jsonb
+    , ALTER COLUMN query DROP DEFAULT
+    , ALTER COLUMN query TYPE JSONB USING query::jsonb
+    , ALTER COLUMN query SET DEFAULT 'null';
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS schedule.api_key (
+    id BIGSERIAL PRIMARY KEY
+    , name TEXT NOT NULL
+    , key_hash TEXT NOT NULL UNIQUE
+    , scopes TEXT[] NOT NULL
+    , created_at BIGINT NOT NULL
+    , revoked_at BIGINT
+);
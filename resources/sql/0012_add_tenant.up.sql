@@ -0,0 +1,8 @@
+ALTER TABLE schedule.primary_queue ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT 'default';
+CREATE INDEX IF NOT EXISTS primary_queue_tenant_id_idx ON schedule.primary_queue (tenant, id);
+
+ALTER TABLE schedule.idempotency_key ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE schedule.idempotency_key DROP CONSTRAINT IF EXISTS idempotency_key_pkey;
+ALTER TABLE schedule.idempotency_key ADD PRIMARY KEY (tenant, key);
+
+ALTER TABLE schedule.api_key ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT 'default';
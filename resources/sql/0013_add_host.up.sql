@@ -0,0 +1,5 @@
+ALTER TABLE schedule.primary_queue ADD COLUMN IF NOT EXISTS host TEXT GENERATED ALWAYS AS (
+    COALESCE(lower(substring(endpoint FROM '^[A-Za-z][A-Za-z0-9+.-]*://(?:[^@/?#]*@)?([^/?#]+)')), '')
+) STORED;
+
+CREATE INDEX IF NOT EXISTS primary_queue_fair_idx ON schedule.primary_queue (tenant, host, send_after, id) WHERE status = 0;
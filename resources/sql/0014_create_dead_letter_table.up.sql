@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS schedule.dead_letter (
+    id INT PRIMARY KEY
+    , endpoint varchar(1024)
+    , headers JSONB NOT NULL
+    , payload BYTEA NOT NULL
+    , send_after BIGINT NOT NULL
+    , max_retry INT NOT NULL
+    , back_off_ms INT NOT NULL
+    , time_to_live BIGINT NOT NULL
+    , method VARCHAR(7) NOT NULL
+    , query JSONB NOT NULL
+    , content_type TEXT NOT NULL
+    , tenant TEXT NOT NULL
+    , host TEXT GENERATED ALWAYS AS (
+        COALESCE(lower(substring(endpoint FROM '^[A-Za-z][A-Za-z0-9+.-]*://(?:[^@/?#]*@)?([^/?#]+)')), '')
+    ) STORED
+    , reason TEXT NOT NULL
+    , last_error TEXT NOT NULL DEFAULT ''
+    , last_status_code INT NOT NULL DEFAULT 0
+    , attempts INT NOT NULL DEFAULT 0
+    , dead_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS dead_letter_tenant_id_idx ON schedule.dead_letter (tenant, id);
+
+CREATE INDEX IF NOT EXISTS primary_queue_expiry_idx ON schedule.primary_queue (time_to_live) WHERE status = 0;
@@ -0,0 +1,8 @@
+ALTER TABLE schedule.primary_queue
+    ADD COLUMN IF NOT EXISTS retry_policy TEXT NOT NULL DEFAULT ''
+    , ADD COLUMN IF NOT EXISTS max_back_off_ms BIGINT NOT NULL DEFAULT 0
+    , ADD COLUMN IF NOT EXISTS last_back_off_ms BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE schedule.dead_letter
+    ADD COLUMN IF NOT EXISTS retry_policy TEXT NOT NULL DEFAULT ''
+    , ADD COLUMN IF NOT EXISTS max_back_off_ms BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,7 @@
+ALTER TABLE schedule.primary_queue ADD COLUMN IF NOT EXISTS finished_at BIGINT;
+
+UPDATE schedule.primary_queue
+    SET finished_at = COALESCE(cancelled_at, (extract(epoch FROM now()) * 1000)::BIGINT)
+    WHERE status IN (2, 3) AND finished_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS primary_queue_finished_idx ON schedule.primary_queue (finished_at) WHERE status IN (2, 3);
@@ -0,0 +1,4 @@
+ALTER TABLE schedule.dead_letter
+    ADD COLUMN IF NOT EXISTS attempt_log JSONB NOT NULL DEFAULT '[]'
+    , ADD COLUMN IF NOT EXISTS idempotency_key TEXT NOT NULL DEFAULT ''
+    , ADD COLUMN IF NOT EXISTS idempotency_expires_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,322 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kucicm/boomerang/src/server"
+	"github.com/kucicm/boomerang/src/storage"
+	"github.com/kucicm/boomerang/src/verify"
+)
+
+type StorageCfg struct {
+    Backend string `json:"backend"`
+    Postgres storage.StorageServiceCfg `json:"postgres"`
+    Embedded storage.EmbeddedStorageCfg `json:"embedded"`
+}
+
+type Config struct {
+    ListenAddr string `json:"listenAddr"`
+    GrpcListenAddr string `json:"grpcListenAddr"`
+    Accepter server.AccepterCfg `json:"accepter"`
+    Auth server.AuthCfg `json:"auth"`
+    Dispatcher server.DispatcherCfg `json:"dispatcher"`
+    Purger server.PurgerCfg `json:"purger"`
+    Storage StorageCfg `json:"storage"`
+}
+
+func Default() Config {
+    return Config{
+        ListenAddr: ":8888",
+        GrpcListenAddr: ":9090",
+        Accepter: server.AccepterCfg{
+            IdempotencyRetentionMs: 24 * 60 * 60 * 1000,
+            MaxBatchSize: 10_000,
+            MaxBodyBytes: 1 << 20,
+            MaxBatchBodyBytes: 64 << 20,
+            MaxPayloadBytes: 256 << 10,
+        },
+        Auth: server.AuthCfg{
+            Enabled: true,
+            CacheTtlMs: 10_000,
+        },
+        Dispatcher: server.DispatcherCfg{
+            LoadBatchSize: 100,
+            MaxConcurrency: 100,
+            MaxHostConcurrency: 20,
+            DeferMs: 1_000,
+            CallTimeoutMs: 30_000,
+            Breaker: server.BreakerCfg{
+                Failures: 5,
+                OpenMs: 30_000,
+                Probes: 1,
+            },
+        },
+        Purger: server.PurgerCfg{
+            RetentionMs: 7 * 24 * 60 * 60 * 1000,
+            IntervalMs: 60_000,
+            BatchSize: 1_000,
+        },
+        Storage: StorageCfg{
+            Backend: "postgres",
+            Postgres: storage.StorageServiceCfg{
+                SaveQueueSize: 10_000,
+                SaveBatchSize: 1_000,
+                MaxWaitMs: 10,
+                MigrationPath: "file://resources/sql",
+            },
+        },
+    }
+}
+
+// Load reads config in order defaults, file at path (if set), environment
+// variables and returns it only if it is valid.
+func Load(path string) (Config, error) {
+    cfg := Default()
+
+    if path != "" {
+        bs, err := os.ReadFile(path)
+        if err != nil {
+            return cfg, fmt.Errorf("cannot read config file %v", err)
+        }
+
+        if err := json.Unmarshal(bs, &cfg); err != nil {
+            return cfg, fmt.Errorf("cannot parse config file %s %v", path, err)
+        }
+    }
+
+    if err := cfg.loadEnv(); err != nil {
+        return cfg, err
+    }
+
+    if cfg.Auth.KeysFile == "" && cfg.Storage.Backend == "embedded" && cfg.Storage.Embedded.Dir != "" {
+        cfg.Auth.KeysFile = filepath.Join(cfg.Storage.Embedded.Dir, "api_keys.json")
+    }
+
+    return cfg, cfg.Validate()
+}
+
+func (c *Config) loadEnv() error {
+    envString("LISTEN_ADDR", &c.ListenAddr)
+    envString("GRPC_LISTEN_ADDR", &c.GrpcListenAddr)
+    envString("STORAGE_BACKEND", &c.Storage.Backend)
+    envString("DB_URL", &c.Storage.Postgres.DbUrl)
+    envString("MIGRATION_PATH", &c.Storage.Postgres.MigrationPath)
+    envString("STORAGE_DIR", &c.Storage.Embedded.Dir)
+    envString("AUTH_KEYS_FILE", &c.Auth.KeysFile)
+    envStrings("DISPATCHER_SIGNING_SECRETS", &c.Dispatcher.Signing.Secrets)
+
+    return errors.Join(
+        envUint64("IDEMPOTENCY_RETENTION_MS", &c.Accepter.IdempotencyRetentionMs),
+        envInt("SUBMIT_MAX_BATCH_SIZE", &c.Accepter.MaxBatchSize),
+        envInt64("SUBMIT_MAX_BODY_BYTES", &c.Accepter.MaxBodyBytes),
+        envInt64("SUBMIT_MAX_BATCH_BODY_BYTES", &c.Accepter.MaxBatchBodyBytes),
+        envInt("SUBMIT_MAX_PAYLOAD_BYTES", &c.Accepter.MaxPayloadBytes),
+        envBool("AUTH_ENABLED", &c.Auth.Enabled),
+        envUint64("AUTH_CACHE_TTL_MS", &c.Auth.CacheTtlMs),
+        envUint("DISPATCHER_LOAD_BATCH_SIZE", &c.Dispatcher.LoadBatchSize),
+        envUint("DISPATCHER_MAX_CONCURRENCY", &c.Dispatcher.MaxConcurrency),
+        envUint("DISPATCHER_MAX_HOST_CONCURRENCY", &c.Dispatcher.MaxHostConcurrency),
+        envUint64("DISPATCHER_DEFER_MS", &c.Dispatcher.DeferMs),
+        envUint64("DISPATCHER_CALL_TIMEOUT_MS", &c.Dispatcher.CallTimeoutMs),
+        envUint("DISPATCHER_BREAKER_FAILURES", &c.Dispatcher.Breaker.Failures),
+        envUint64("DISPATCHER_BREAKER_OPEN_MS", &c.Dispatcher.Breaker.OpenMs),
+        envUint("DISPATCHER_BREAKER_PROBES", &c.Dispatcher.Breaker.Probes),
+        envUint64("JOB_RETENTION_MS", &c.Purger.RetentionMs),
+        envUint64("PURGE_INTERVAL_MS", &c.Purger.IntervalMs),
+        envInt("PURGE_BATCH_SIZE", &c.Purger.BatchSize),
+        envInt("SAVE_QUEUE_SIZE", &c.Storage.Postgres.SaveQueueSize),
+        envInt("SAVE_BATCH_SIZE", &c.Storage.Postgres.SaveBatchSize),
+        envInt("SAVE_MAX_WAIT_MS", &c.Storage.Postgres.MaxWaitMs),
+        envBool("STORAGE_SYNC_WRITES", &c.Storage.Embedded.SyncWrites),
+    )
+}
+
+func (c Config) Validate() error {
+    var errs []error
+    if c.ListenAddr == "" {
+        errs = append(errs, errors.New("listen address not set"))
+    }
+
+    if c.Accepter.MaxBatchSize <= 0 {
+        errs = append(errs, errors.New("submit max batch size must be positive"))
+    }
+
+    if c.Dispatcher.LoadBatchSize == 0 {
+        errs = append(errs, errors.New("dispatcher load batch size must be positive"))
+    }
+
+    if c.Dispatcher.MaxConcurrency == 0 {
+        errs = append(errs, errors.New("dispatcher max concurrency must be positive"))
+    }
+
+    if c.Dispatcher.DeferMs == 0 {
+        errs = append(errs, errors.New("dispatcher defer must be positive"))
+    }
+
+    if c.Dispatcher.Breaker.Failures > 0 && c.Dispatcher.Breaker.Probes == 0 {
+        errs = append(errs, errors.New("breaker probes must be positive when breaker is enabled"))
+    }
+
+    if c.Purger.RetentionMs > 0 && (c.Purger.IntervalMs == 0 || c.Purger.BatchSize <= 0) {
+        errs = append(errs, errors.New("purge interval and batch size must be positive when job retention is set"))
+    }
+
+    errs = append(errs, validateSecrets(c.Dispatcher.Signing)...)
+
+    for i, limit := range c.Dispatcher.RateLimits {
+        if (limit.Host == "") == (limit.Prefix == "") {
+            errs = append(errs, fmt.Errorf("dispatcher rate limit %d must set exactly one of host and prefix", i))
+        }
+        if limit.PerSecond <= 0 {
+            errs = append(errs, fmt.Errorf("dispatcher rate limit %d per second must be positive", i))
+        }
+    }
+
+    switch c.Storage.Backend {
+    case "postgres":
+        pg := c.Storage.Postgres
+        if pg.DbUrl == "" {
+            errs = append(errs, errors.New("postgres storage requires DB_URL"))
+        }
+        if pg.MigrationPath == "" {
+            errs = append(errs, errors.New("postgres storage requires migration path"))
+        }
+        if pg.SaveQueueSize <= 0 || pg.SaveBatchSize <= 0 || pg.MaxWaitMs <= 0 {
+            errs = append(errs, errors.New("postgres save queue size, batch size and max wait must be positive"))
+        }
+    case "embedded":
+        if c.Storage.Embedded.Dir == "" {
+            errs = append(errs, errors.New("embedded storage requires STORAGE_DIR"))
+        }
+    case "memory":
+        if c.Auth.Enabled && c.Auth.KeysFile == "" {
+            errs = append(errs, errors.New("memory storage with auth requires AUTH_KEYS_FILE"))
+        }
+    default:
+        errs = append(errs, fmt.Errorf("unknown storage backend %q", c.Storage.Backend))
+    }
+
+    if err := errors.Join(errs...); err != nil {
+        return fmt.Errorf("invalid config: %w", err)
+    }
+    return nil
+}
+
+func envString(name string, dst *string) {
+    if v, ok := os.LookupEnv(name); ok {
+        *dst = v
+    }
+}
+
+// envStrings reads comma separated list, empty value clears dst
+func envStrings(name string, dst *[]string) {
+    v, ok := os.LookupEnv(name)
+    if !ok {
+        return
+    }
+
+    *dst = nil
+    for _, s := range strings.Split(v, ",") {
+        if s = strings.TrimSpace(s); s != "" {
+            *dst = append(*dst, s)
+        }
+    }
+}
+
+func envUint(name string, dst *uint) error {
+    v, ok := os.LookupEnv(name)
+    if !ok {
+        return nil
+    }
+
+    n, err := strconv.ParseUint(v, 10, 0)
+    if err != nil {
+        return fmt.Errorf("invalid %s %v", name, err)
+    }
+    *dst = uint(n)
+    return nil
+}
+
+func envUint64(name string, dst *uint64) error {
+    v, ok := os.LookupEnv(name)
+    if !ok {
+        return nil
+    }
+
+    n, err := strconv.ParseUint(v, 10, 64)
+    if err != nil {
+        return fmt.Errorf("invalid %s %v", name, err)
+    }
+    *dst = n
+    return nil
+}
+
+func envInt(name string, dst *int) error {
+    v, ok := os.LookupEnv(name)
+    if !ok {
+        return nil
+    }
+
+    n, err := strconv.Atoi(v)
+    if err != nil {
+        return fmt.Errorf("invalid %s %v", name, err)
+    }
+    *dst = n
+    return nil
+}
+
+func envInt64(name string, dst *int64) error {
+    v, ok := os.LookupEnv(name)
+    if !ok {
+        return nil
+    }
+
+    n, err := strconv.ParseInt(v, 10, 64)
+    if err != nil {
+        return fmt.Errorf("invalid %s %v", name, err)
+    }
+    *dst = n
+    return nil
+}
+
+func envBool(name string, dst *bool) error {
+    v, ok := os.LookupEnv(name)
+    if !ok {
+        return nil
+    }
+
+    b, err := strconv.ParseBool(v)
+    if err != nil {
+        return fmt.Errorf("invalid %s %v", name, err)
+    }
+    *dst = b
+    return nil
+}
+
+func validateSecrets(cfg server.SigningCfg) []error {
+    var errs []error
+    check := func(owner string, secrets []string) {
+        for i, secret := range secrets {
+            if key, err := verify.DecodeSecret(secret); err != nil {
+                errs = append(errs, fmt.Errorf("signing secret %d of %s %v", i, owner, err))
+            } else if len(key) == 0 {
+                errs = append(errs, fmt.Errorf("signing secret %d of %s is empty", i, owner))
+            }
+        }
+    }
+
+    check("default", cfg.Secrets)
+    for tenant, secrets := range cfg.Tenants {
+        check("tenant " + tenant, secrets)
+    }
+    for host, secrets := range cfg.Hosts {
+        check("host " + host, secrets)
+    }
+    return errs
+}
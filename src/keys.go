@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kucicm/boomerang/src/config"
+	"github.com/kucicm/boomerang/src/server"
+	"github.com/kucicm/boomerang/src/storage"
+)
+
+// newKeyStore keeps api keys in postgres next to jobs, other backends use
+// the keys file so the admin command does not touch their data.
+func newKeyStore(cfg config.Config) (server.KeyStore, error) {
+    if cfg.Storage.Backend == "postgres" {
+        return storage.NewStorageService(cfg.Storage.Postgres)
+    }
+    return storage.NewFileKeyStore(cfg.Auth.KeysFile)
+}
+
+const keysUsage = `usage:
+  boomerang keys create -name NAME -tenant TENANT -scopes jobs:write,jobs:read
+  boomerang keys revoke -id ID
+  boomerang keys list`
+
+// runKeys is the admin command which creates, revokes and lists api keys
+func runKeys(cfg config.Config, args []string) error {
+    if len(args) == 0 {
+        return errors.New(keysUsage)
+    }
+
+    keys, err := newKeyStore(cfg)
+    if err != nil {
+        return fmt.Errorf("cannot open key store %v", err)
+    }
+    if s, ok := keys.(interface{ Shutdown() error }); ok {
+        defer s.Shutdown()
+    }
+
+    switch args[0] {
+    case "create":
+        return createKey(keys, args[1:])
+    case "revoke":
+        return revokeKey(keys, args[1:])
+    case "list":
+        return listKeys(keys)
+    default:
+        return fmt.Errorf("unknown keys command %q\n%s", args[0], keysUsage)
+    }
+}
+
+func createKey(keys server.KeyStore, args []string) error {
+    fs := flag.NewFlagSet("keys create", flag.ContinueOnError)
+    name := fs.String("name", "", "name of the key owner")
+    tenant := fs.String("tenant", server.DefaultTenant, "tenant which owns jobs scheduled with the key")
+    scopeList := fs.String("scopes", "", "comma separated scopes "+strings.Join(server.Scopes, ", "))
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+
+    if *name == "" || *tenant == "" {
+        return errors.New("key name and tenant are required")
+    }
+
+    var scopes []string
+    for _, s := range strings.Split(*scopeList, ",") {
+        if s = strings.TrimSpace(s); s == "" {
+            continue
+        }
+        if !server.ValidScope(s) {
+            return fmt.Errorf("unknown scope %q, expected one of %s", s, strings.Join(server.Scopes, ", "))
+        }
+        scopes = append(scopes, s)
+    }
+    if len(scopes) == 0 {
+        return errors.New("at least one scope is required")
+    }
+
+    key, err := server.NewKey()
+    if err != nil {
+        return err
+    }
+
+    id, err := keys.CreateKey(server.ApiKey{Name: *name, Tenant: *tenant, Hash: server.HashKey(key), Scopes: scopes, CreatedAt: time.Now().UTC()})
+    if err != nil {
+        return err
+    }
+
+    fmt.Printf("Created key %d %s for tenant %s with scopes %s\n%s\n", id, *name, *tenant, strings.Join(scopes, ","), key)
+    fmt.Fprintln(os.Stderr, "The key is not stored, save it now")
+    return nil
+}
+
+func revokeKey(keys server.KeyStore, args []string) error {
+    fs := flag.NewFlagSet("keys revoke", flag.ContinueOnError)
+    id := fs.Uint64("id", 0, "id of the key")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+
+    if err := keys.RevokeKey(*id); err != nil {
+        return fmt.Errorf("cannot revoke key %d %w", *id, err)
+    }
+    fmt.Printf("Revoked key %d\n", *id)
+    return nil
+}
+
+func listKeys(keys server.KeyStore) error {
+    list, err := keys.ListKeys()
+    if err != nil {
+        return err
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "ID\tNAME\tTENANT\tSCOPES\tCREATED\tREVOKED")
+    for _, k := range list {
+        revoked := "-"
+        if k.Revoked() {
+            revoked = k.RevokedAt.Format(time.RFC3339)
+        }
+        fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", k.Id, k.Name, k.TenantId(), strings.Join(k.Scopes, ","), k.CreatedAt.Format(time.RFC3339), revoked)
+    }
+    return w.Flush()
+}
@@ -1,40 +1,157 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/kucicm/boomerang/src/config"
 	"github.com/kucicm/boomerang/src/server"
+	"github.com/kucicm/boomerang/src/storage"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+type store interface {
+    Save(server.ScheduleRequest) (uint64, error)
+    SaveBatch([]server.ScheduleRequest) ([]uint64, []error)
+    Load(bs uint) []server.ScheduleRequest
+    Update(req server.ScheduleRequest)
+    Done(req server.ScheduleRequest)
+    AddAttempt(id uint64, attempt server.Attempt)
+    Get(id uint64) (server.Job, error)
+    Cancel(id uint64) error
+    List(filter server.ListFilter) ([]server.Job, error)
+    Patch(id uint64, version uint64, patch server.JobPatch) (server.Job, error)
+    DeadLetter(req server.ScheduleRequest, reason string)
+    GetDeadLetter(id uint64) (server.DeadLetter, error)
+    ListDeadLetters(filter server.DeadLetterFilter) ([]server.DeadLetter, error)
+    CountDeadLetters() (int, error)
+    Redrive(filter server.RedriveFilter, override server.RedriveOverride, dryRun bool) (server.RedriveResult, error)
+    Purge(before time.Time, limit int) (int, error)
+    Shutdown() error
+}
+
+func newStore(cfg config.StorageCfg) (store, error) {
+    switch cfg.Backend {
+    case "embedded":
+        return storage.NewEmbeddedStorage(cfg.Embedded)
+    case "memory":
+        return storage.NewMemoryStorage(), nil
+    default:
+        return storage.NewStorageService(cfg.Postgres)
+    }
+}
 
 func main() {
-    srv := server.NewAccepter(nil)
-    http.HandleFunc("/submit", srv.SubmitHandler)
-    http.Handle("/metrics", promhttp.Handler())
+    configPath := flag.String("config", os.Getenv("CONFIG_PATH"), "path to json config file")
+    flag.Parse()
+
+    cfg, err := config.Load(*configPath)
+    if err != nil {
+        log.Fatalf("Failed to load config %s", err)
+    }
+
+    if flag.Arg(0) == "keys" {
+        if err := runKeys(cfg, flag.Args()[1:]); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
+    if flag.Arg(0) == "redrive" {
+        if err := runRedrive(cfg, flag.Args()[1:]); err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
+    db, err := newStore(cfg.Storage)
+    if err != nil {
+        log.Fatalf("Failed to create storage %s", err)
+    }
+
+    var keys server.KeyStore
+    if cfg.Auth.Enabled {
+        if keys, err = newKeyStore(cfg); err != nil {
+            log.Fatalf("Failed to create key store %s", err)
+        }
+    }
+
+    auth := server.NewAuthenticator(cfg.Auth, keys)
+    acc := server.NewAccepter(cfg.Accepter, db)
+    dispatcher := server.NewDispatcher(cfg.Dispatcher, db)
+    purger := server.NewPurger(cfg.Purger, db)
+
+    // every endpoint goes through auth, new ones too
+    mux := http.NewServeMux()
+    mux.Handle("/submit", auth.Require(server.Scope(server.ScopeJobsWrite), http.HandlerFunc(acc.SubmitHandler)))
+    mux.Handle("/submit/batch", auth.Require(server.Scope(server.ScopeJobsWrite), http.HandlerFunc(acc.BatchSubmitHandler)))
+    mux.Handle("/jobs/", auth.Require(server.JobsScope, server.NewJobsHandler(cfg.Accepter, db)))
+    deadLetters := server.NewDeadLettersHandler(db)
+    mux.Handle("/dead-letters", auth.Require(server.JobsScope, deadLetters))
+    mux.Handle("/dead-letters/", auth.Require(server.JobsScope, deadLetters))
+    mux.Handle("/metrics", auth.Require(server.Scope(server.ScopeMetricsRead), promhttp.Handler()))
+    mux.Handle("/admin/breakers", auth.Require(server.Scope(server.ScopeAdmin), http.HandlerFunc(dispatcher.BreakersHandler)))
+    mux.Handle("/admin/redrive", auth.Require(server.Scope(server.ScopeAdmin), server.NewRedriveHandler(db)))
+    httpSrv := &http.Server{Addr: cfg.ListenAddr, Handler: mux}
 
     go func() {
-        log.Println("Server started")
-        if err := http.ListenAndServe(":8888", nil); !errors.Is(err, http.ErrServerClosed) {
+        log.Printf("Server started on %s\n", cfg.ListenAddr)
+        if err := httpSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
             log.Fatalf("Server failed %s\n", err)
         }
         log.Println("Server stopping...")
     }()
+    grpcSrv := server.NewGrpcServer(cfg.Accepter, db, auth)
+    if cfg.GrpcListenAddr != "" {
+        lis, err := net.Listen("tcp", cfg.GrpcListenAddr)
+        if err != nil {
+            log.Fatalf("Failed to listen on %s %s", cfg.GrpcListenAddr, err)
+        }
 
+        go func() {
+            log.Printf("gRPC server started on %s\n", cfg.GrpcListenAddr)
+            if err := grpcSrv.Serve(lis); err != nil {
+                log.Fatalf("gRPC server failed %s\n", err)
+            }
+        }()
+    }
+    dispatcher.Start()
+    purger.Start()
 
     // wait for shutdown
     ch := make(chan os.Signal, 1)
     signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
     <-ch
 
-    if err := srv.Shutdown(); err != nil {
-        log.Fatalf("Failed to shutdown server %s", err)
+    // stop accepting first, then drain in-flight calls, storage goes last
+    ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+    defer cancel()
+    if err := httpSrv.Shutdown(ctx); err != nil {
+        log.Printf("Failed to shutdown http server %s", err)
     }
-}
+    grpcSrv.GracefulStop()
 
+    if err := acc.Shutdown(); err != nil {
+        log.Printf("Failed to shutdown accepter %s", err)
+    }
+
+    if err := dispatcher.Shutdown(); err != nil {
+        log.Printf("Failed to shutdown dispatcher %s", err)
+    }
 
+    if err := purger.Shutdown(); err != nil {
+        log.Printf("Failed to shutdown purger %s", err)
+    }
+
+    if err := db.Shutdown(); err != nil {
+        log.Fatalf("Failed to shutdown storage %s", err)
+    }
+}
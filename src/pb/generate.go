@@ -0,0 +1,4 @@
+// Package pb holds code generated from proto/boomerang/v1/scheduler.proto
+package pb
+
+//go:generate protoc -I ../../proto --go_out=../.. --go_opt=module=github.com/kucicm/boomerang --go-grpc_out=../.. --go-grpc_opt=module=github.com/kucicm/boomerang boomerang/v1/scheduler.proto
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kucicm/boomerang/src/config"
+	"github.com/kucicm/boomerang/src/server"
+)
+
+const redriveUsage = `usage:
+  boomerang redrive [-ids 1,2] [-tenant T] [-host H] [-dead-after RFC3339] [-dead-before RFC3339]
+                    [-send-after 10m] [-ttl 24h] [-max-retry 3] [-dry-run]`
+
+// runRedrive is the admin command which sends dead letters again, it goes
+// through the admin api of a running server so every backend works the same.
+func runRedrive(cfg config.Config, args []string) error {
+    fs := flag.NewFlagSet("redrive", flag.ContinueOnError)
+    url := fs.String("url", defaultUrl(cfg.ListenAddr), "base url of the boomerang server")
+    key := fs.String("key", os.Getenv("BOOMERANG_API_KEY"), "api key with admin scope")
+    ids := fs.String("ids", "", "comma separated job ids")
+    tenant := fs.String("tenant", "", "tenant of dead letters")
+    host := fs.String("host", "", "destination host of dead letters")
+    deadAfter := fs.String("dead-after", "", "dead letters dead at or after, RFC3339")
+    deadBefore := fs.String("dead-before", "", "dead letters dead before, RFC3339")
+    sendAfter := fs.Duration("send-after", 0, "send redriven jobs after duration from now")
+    ttl := fs.Duration("ttl", 0, "redriven jobs expire after duration from now")
+    maxRetry := fs.Int("max-retry", -1, "max retry of redriven jobs, negative keeps stored value")
+    dryRun := fs.Bool("dry-run", false, "only count dead letters which would be redriven")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+
+    req := server.RedriveRequest{Tenant: *tenant, Host: *host, DryRun: *dryRun}
+    for _, s := range strings.Split(*ids, ",") {
+        if s = strings.TrimSpace(s); s == "" {
+            continue
+        }
+        id, err := strconv.ParseUint(s, 10, 64)
+        if err != nil {
+            return fmt.Errorf("invalid job id %q", s)
+        }
+        req.Ids = append(req.Ids, id)
+    }
+
+    var err error
+    if req.DeadAfter, err = parseTime(*deadAfter); err != nil {
+        return err
+    }
+    if req.DeadBefore, err = parseTime(*deadBefore); err != nil {
+        return err
+    }
+
+    now := time.Now()
+    if *sendAfter > 0 {
+        v := uint64(now.Add(*sendAfter).UnixMilli())
+        req.SendAfter = &v
+    }
+    if *ttl > 0 {
+        v := uint64(now.Add(*ttl).UnixMilli())
+        req.TimeToLive = &v
+    }
+    if *maxRetry >= 0 {
+        req.MaxRetry = maxRetry
+    }
+
+    if len(req.Ids) == 0 && req.Tenant == "" && req.Host == "" && req.DeadAfter.IsZero() && req.DeadBefore.IsZero() {
+        return errors.New(redriveUsage)
+    }
+
+    res, err := postRedrive(*url, *key, req)
+    if err != nil {
+        return err
+    }
+
+    if res.DryRun {
+        fmt.Printf("Would redrive %d dead letters, %d expired would be skipped\n", res.Count, res.Skipped)
+    } else {
+        fmt.Printf("Redrove %d dead letters, skipped %d expired\n", res.Count, res.Skipped)
+    }
+    return nil
+}
+
+func postRedrive(url, key string, req server.RedriveRequest) (server.RedriveResponse, error) {
+    var res server.RedriveResponse
+    body, err := json.Marshal(req)
+    if err != nil {
+        return res, err
+    }
+
+    httpReq, err := http.NewRequest(http.MethodPost, strings.TrimRight(url, "/")+"/admin/redrive", bytes.NewReader(body))
+    if err != nil {
+        return res, err
+    }
+    httpReq.Header.Set("Content-Type", "application/json")
+    if key != "" {
+        httpReq.Header.Set("Authorization", "Bearer "+key)
+    }
+
+    client := &http.Client{Timeout: 30 * time.Second}
+    resp, err := client.Do(httpReq)
+    if err != nil {
+        return res, fmt.Errorf("cannot call redrive %v", err)
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        msg, _ := io.ReadAll(resp.Body)
+        return res, fmt.Errorf("redrive failed %s %s", resp.Status, msg)
+    }
+
+    if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+        return res, fmt.Errorf("cannot parse redrive response %v", err)
+    }
+    return res, nil
+}
+
+// defaultUrl is url of the server listening on addr of this config
+func defaultUrl(addr string) string {
+    if strings.HasPrefix(addr, ":") {
+        addr = "localhost" + addr
+    }
+    return "http://" + addr
+}
+
+func parseTime(v string) (time.Time, error) {
+    if v == "" {
+        return time.Time{}, nil
+    }
+    t, err := time.Parse(time.RFC3339, v)
+    if err != nil {
+        return t, fmt.Errorf("invalid time %q, expected RFC3339", v)
+    }
+    return t, nil
+}
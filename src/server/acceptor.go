@@ -1,7 +1,7 @@
 package server
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -18,7 +18,7 @@ var (
             Name: "boomerang_submit_request",
             Help: "boomerang_submit_request",
         },
-        []string{"status"},
+        []string{"tenant", "status"},
     )
 )
 
@@ -31,25 +31,66 @@ type ScheduleRequest struct {
     MaxRetry int `json:"maxRetry"`
     BackOffMs uint64 `json:"backOffMs"`
     TimeToLive uint64 `json:"TimeToLive"`
+    IdempotencyKey string `json:"idempotencyKey,omitempty"`
+    IdempotencyExpiresAt uint64 `json:"-"`
+    Tenant string `json:"-"`
+    Method string `json:"method,omitempty"`
+    Query map[string]string `json:"query,omitempty"`
+    ContentType string `json:"contentType,omitempty"`
+    RetryPolicy string `json:"retryPolicy,omitempty"`
+    MaxBackOffMs uint64 `json:"maxBackOffMs,omitempty"`
+    // LastBackOffMs is how long the last retry waited, policies grow it
+    LastBackOffMs uint64 `json:"-"`
 }
 
+// CallMethod returns http method of the callback, POST when not set
+func (r ScheduleRequest) CallMethod() string {
+    if r.Method == "" {
+        return http.MethodPost
+    }
+    return r.Method
+}
+
+// AccepterCfg limits, zero means no limit
+type AccepterCfg struct {
+    IdempotencyRetentionMs uint64
+    MaxBatchSize int
+    MaxBodyBytes int64
+    MaxBatchBodyBytes int64
+    MaxPayloadBytes int
+}
+
+type SubmitResponse struct {
+    Id uint64 `json:"id"`
+    ScheduledFor time.Time `json:"scheduledFor"`
+    ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ErrDuplicateRequest is returned by Save together with id of the job
+// which was already scheduled with the same idempotency key.
+var ErrDuplicateRequest = errors.New("duplicate idempotency key")
+
 type store interface {
-    Save(ScheduleRequest) error
+    Save(ScheduleRequest) (uint64, error)
+    SaveBatch([]ScheduleRequest) ([]uint64, []error)
+    Get(id uint64) (Job, error)
 }
 
 type accepter struct {
+    cfg AccepterCfg
     store store
+    validator validator
 }
 
-func NewAccepter(store store) *accepter {
+func NewAccepter(cfg AccepterCfg, store store) *accepter {
     log.Println("Accepter init")
-    return &accepter{store}
+    return &accepter{cfg, store, validator{cfg.MaxPayloadBytes, time.Now}}
 }
 
 func (a *accepter) SubmitHandler(w http.ResponseWriter, r *http.Request) {
-    var status = "ok"
+    var status, tenant = "ok", TenantFrom(r.Context())
     defer func(start time.Time) {
-        summary.WithLabelValues(status).Observe(float64(time.Since(start).Nanoseconds()))
+        summary.WithLabelValues(tenant, status).Observe(float64(time.Since(start).Nanoseconds()))
     }(time.Now())
 
     if r.Method != http.MethodPost { // TODO replace with new stuff
@@ -58,33 +99,93 @@ func (a *accepter) SubmitHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    body, err := io.ReadAll(r.Body)
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        fmt.Fprintf(w, "Error reading request body %v", err)
-        log.Printf("Error in submit handler %v\n", err)
+    body, ok := readBody(w, r, a.cfg.MaxBodyBytes)
+    if !ok {
         status = "invalid body"
         return
     }
-    defer r.Body.Close()
 
-    var req ScheduleRequest
-    if err = json.Unmarshal(body, &req); err != nil {
-        w.WriteHeader(http.StatusBadRequest)
-        fmt.Fprintf(w, "Cannot parse request body %v", err)
-        log.Printf("Cannot parse schedule request body %v\n", err)
+    req, errs := a.parse(body)
+    if len(errs) > 0 {
+        writeJSON(w, http.StatusBadRequest, ValidationResponse{errs})
         status = "invalid request"
         return
     }
 
-    if err := a.store.Save(req); err != nil {
+    req = a.withOwner(req, tenant, r.Header.Get("Idempotency-Key"))
+    id, err := a.store.Save(req)
+    if errors.Is(err, ErrDuplicateRequest) {
+        a.writeDuplicate(w, id)
+        status = "duplicate"
+        return
+    }
+
+    if err != nil {
         w.WriteHeader(http.StatusInternalServerError)
         fmt.Fprintf(w, "Cannot save schadule request %v", err)
         status = "save fail"
         return
     }
 
-    fmt.Fprintf(w, "%s", body) // debug
+    w.Header().Set("Location", fmt.Sprintf("/jobs/%d", id))
+    writeJSON(w, http.StatusCreated, SubmitResponse{
+        Id: id,
+        ScheduledFor: time.UnixMilli(int64(req.SendAfter)).UTC(),
+        ExpiresAt: time.UnixMilli(int64(req.TimeToLive)).UTC(),
+    })
+}
+
+// withOwner sets tenant of req and its idempotency key (when given it wins
+// over the one in body) with retention, keys are unique per tenant.
+func (a *accepter) withOwner(req ScheduleRequest, tenant, key string) ScheduleRequest {
+    req.Tenant = tenant
+    if key != "" {
+        req.IdempotencyKey = key
+    }
+    if req.IdempotencyKey != "" {
+        req.IdempotencyExpiresAt = uint64(time.Now().UnixMilli()) + a.cfg.IdempotencyRetentionMs
+    }
+    return req
+}
+
+// readBody reads up to limit bytes of body, on failure the response is
+// already written.
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, bool) {
+    defer r.Body.Close()
+    if limit > 0 {
+        r.Body = http.MaxBytesReader(w, r.Body, limit)
+    }
+
+    body, err := io.ReadAll(r.Body)
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        writeJSON(w, http.StatusRequestEntityTooLarge, ValidationResponse{ValidationErrors{
+            {"", CodeTooLarge, fmt.Sprintf("body is over %d bytes", limit)},
+        }})
+        return nil, false
+    }
+
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        fmt.Fprintf(w, "Error reading request body %v", err)
+        log.Printf("Error reading submit body %v\n", err)
+        return nil, false
+    }
+    return body, true
+}
+
+// writeDuplicate answers a repeated submit with the job scheduled first
+func (a *accepter) writeDuplicate(w http.ResponseWriter, id uint64) {
+    resp := SubmitResponse{Id: id}
+    if job, err := a.store.Get(id); err == nil {
+        resp.ScheduledFor = time.UnixMilli(int64(job.Request.SendAfter)).UTC()
+        resp.ExpiresAt = time.UnixMilli(int64(job.Request.TimeToLive)).UTC()
+    } else {
+        log.Printf("Cannot load job %d of duplicate request %v\n", id, err)
+    }
+
+    w.Header().Set("Location", fmt.Sprintf("/jobs/%d", id))
+    writeJSON(w, http.StatusOK, resp)
 }
 
 func (a *accepter) Shutdown() error {
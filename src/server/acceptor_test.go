@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 
@@ -15,22 +16,51 @@ type mockStore struct {
     returnErr error
     called bool
     item *ScheduleRequest
+    keys map[string]uint64
+    saved []ScheduleRequest
 }
 
-func (s *mockStore) Save(r ScheduleRequest) error {
+func (s *mockStore) Save(r ScheduleRequest) (uint64, error) {
     s.called = true
     s.item = &r
-    return s.returnErr
+    if s.returnErr != nil {
+        return 0, s.returnErr
+    }
+
+    if s.keys == nil {
+        s.keys = make(map[string]uint64)
+    }
+    if id, ok := s.keys[r.IdempotencyKey]; ok && r.IdempotencyKey != "" {
+        return id, ErrDuplicateRequest
+    }
+    s.keys[r.IdempotencyKey] = 42
+    return 42, nil
+}
+
+func (s *mockStore) SaveBatch(reqs []ScheduleRequest) ([]uint64, []error) {
+    ids, errs := make([]uint64, len(reqs)), make([]error, len(reqs))
+    for i, r := range reqs {
+        ids[i], errs[i] = s.Save(r)
+        s.saved = append(s.saved, r)
+    }
+    return ids, errs
+}
+
+func (s *mockStore) Get(id uint64) (Job, error) {
+    if s.item == nil {
+        return Job{}, ErrJobNotFound
+    }
+    return Job{Request: *s.item}, nil
 }
 
 func TestHappyPath(t *testing.T) {
     expectedReq := ScheduleRequest{
-        Endpoint: "example.com/test",
+        Endpoint: "http://example.com/test",
         Headers: map[string]string{"test1": "123"},
         Payload: "example",
-        SendAfter: 200032,
+        SendAfter: 4_102_444_800_000,
         BackOffMs: 20,
-        TimeToLive: 200050,
+        TimeToLive: 4_102_444_900_000,
     }
 
     store := &mockStore{
@@ -38,7 +68,7 @@ func TestHappyPath(t *testing.T) {
     	called:    false,
     	item:      &ScheduleRequest{},
     }
-    srv := NewAccepter(store)
+    srv := NewAccepter(AccepterCfg{IdempotencyRetentionMs: 60_000}, store)
 
     bs, err := json.Marshal(expectedReq)
     if err != nil {
@@ -54,8 +84,8 @@ func TestHappyPath(t *testing.T) {
 
     srv.SubmitHandler(rr, req)
 
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusCreated)
 	}
 
     if !store.called {
@@ -65,16 +95,33 @@ func TestHappyPath(t *testing.T) {
     if reflect.DeepEqual(expectedReq, store.item) {
         t.Errorf("failed to save expected item, got %+v expected: %+v", store.item, expectedReq)
     }
+
+    if location := rr.Header().Get("Location"); location != "/jobs/42" {
+        t.Errorf("expected location /jobs/42 got %s", location)
+    }
+
+    var resp SubmitResponse
+    if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+        t.Fatalf("cannot decode response %s", err)
+    }
+
+    if resp.Id != 42 {
+        t.Errorf("expected id 42 got %d", resp.Id)
+    }
+
+    if resp.ScheduledFor.UnixMilli() != int64(expectedReq.SendAfter) || resp.ExpiresAt.UnixMilli() != int64(expectedReq.TimeToLive) {
+        t.Errorf("unexpected response times %+v", resp)
+    }
 }
 
 func TestFailedSave(t *testing.T) {
     expectedReq := ScheduleRequest{
-        Endpoint: "example.com/test",
+        Endpoint: "http://example.com/test",
         Headers: map[string]string{"test1": "123"},
         Payload: "example",
-        SendAfter: 200032,
+        SendAfter: 4_102_444_800_000,
         BackOffMs: 20,
-        TimeToLive: 200050,
+        TimeToLive: 4_102_444_900_000,
     }
 
     store := &mockStore{
@@ -82,7 +129,7 @@ func TestFailedSave(t *testing.T) {
     	called:    false,
     	item:      &ScheduleRequest{},
     }
-    srv := NewAccepter(store)
+    srv := NewAccepter(AccepterCfg{IdempotencyRetentionMs: 60_000}, store)
 
     bs, err := json.Marshal(expectedReq)
     if err != nil {
@@ -119,7 +166,7 @@ func TestBadRequest(t *testing.T) {
     	called:    false,
     	item:      &ScheduleRequest{},
     }
-    srv := NewAccepter(store)
+    srv := NewAccepter(AccepterCfg{IdempotencyRetentionMs: 60_000}, store)
 
     requestBody := strings.NewReader("")
     req, err := http.NewRequest(http.MethodPost, "/submit", requestBody)
@@ -139,3 +186,56 @@ func TestBadRequest(t *testing.T) {
         t.Error("store called")
     }
 }
+
+func TestIdempotencyKey(t *testing.T) {
+    store := &mockStore{}
+    srv := NewAccepter(AccepterCfg{IdempotencyRetentionMs: 60_000}, store)
+
+    body := `{"endpoint": "http://example.com/test", "sendAfter": 4102444800000, "TimeToLive": 4102444900000}`
+    codes := []int{http.StatusCreated, http.StatusOK}
+    for _, code := range codes {
+        req, err := http.NewRequest(http.MethodPost, "/submit", strings.NewReader(body))
+        if err != nil {
+            t.Fatal(err)
+        }
+        req.Header.Set("Idempotency-Key", "key-1")
+
+        rr := httptest.NewRecorder()
+        srv.SubmitHandler(rr, req)
+        if rr.Code != code {
+            t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, code)
+        }
+
+        var resp SubmitResponse
+        if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+            t.Fatal(err)
+        }
+        if resp.Id != 42 || resp.ScheduledFor.UnixMilli() != 4_102_444_800_000 {
+            t.Errorf("expected original job in response got %+v", resp)
+        }
+    }
+
+    if store.item.IdempotencyKey != "key-1" || store.item.IdempotencyExpiresAt < uint64(time.Now().UnixMilli()) {
+        t.Errorf("expected key with retention to be saved got %+v", store.item)
+    }
+}
+
+func TestSubmitTenant(t *testing.T) {
+    store := &mockStore{}
+    srv := NewAccepter(AccepterCfg{}, store)
+
+    body := `{"endpoint": "http://example.com/test", "sendAfter": 4102444800000, "TimeToLive": 4102444900000}`
+    req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(body))
+    rr := httptest.NewRecorder()
+    srv.SubmitHandler(rr, req.WithContext(WithTenant(req.Context(), "team-a")))
+
+    if rr.Code != http.StatusCreated || store.item.Tenant != "team-a" {
+        t.Errorf("expected request saved for tenant got %d %+v", rr.Code, store.item)
+    }
+
+    req = httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(body))
+    srv.SubmitHandler(httptest.NewRecorder(), req)
+    if store.item.Tenant != DefaultTenant {
+        t.Errorf("expected default tenant without auth got %q", store.item.Tenant)
+    }
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kucicm/boomerang/src/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// scopes an api key can be granted, admin allows everything
+const (
+    ScopeJobsWrite = "jobs:write"
+    ScopeJobsRead = "jobs:read"
+    ScopeMetricsRead = "metrics:read"
+    ScopeAdmin = "admin"
+)
+
+var Scopes = []string{ScopeJobsWrite, ScopeJobsRead, ScopeMetricsRead, ScopeAdmin}
+
+const keyPrefix = "bmr_"
+
+// DefaultTenant owns jobs when auth is disabled and jobs saved before
+// tenants existed
+const DefaultTenant = "default"
+
+var (
+    ErrKeyNotFound = errors.New("api key not found")
+    errUnauthenticated = errors.New("missing or invalid api key")
+    errForbidden = errors.New("api key does not have required scope")
+)
+
+// ApiKey is stored with a hash of the key only, the key itself is shown
+// once when it is created.
+type ApiKey struct {
+    Id uint64 `json:"id"`
+    Name string `json:"name"`
+    Tenant string `json:"tenant"`
+    Hash string `json:"hash"`
+    Scopes []string `json:"scopes"`
+    CreatedAt time.Time `json:"createdAt"`
+    RevokedAt time.Time `json:"revokedAt"`
+}
+
+func (k ApiKey) Revoked() bool {
+    return !k.RevokedAt.IsZero()
+}
+
+// TenantId is the tenant which owns jobs of the key
+func (k ApiKey) TenantId() string {
+    if k.Tenant == "" {
+        return DefaultTenant
+    }
+    return k.Tenant
+}
+
+// Allows reports if key grants scope, empty scope only needs a valid key
+func (k ApiKey) Allows(scope string) bool {
+    if k.Revoked() {
+        return false
+    }
+
+    if scope == "" {
+        return true
+    }
+
+    for _, s := range k.Scopes {
+        if s == scope || s == ScopeAdmin {
+            return true
+        }
+    }
+    return false
+}
+
+type KeyStore interface {
+    CreateKey(key ApiKey) (uint64, error)
+    FindKey(hash string) (ApiKey, error)
+    RevokeKey(id uint64) error
+    ListKeys() ([]ApiKey, error)
+}
+
+func ValidScope(scope string) bool {
+    for _, s := range Scopes {
+        if s == scope {
+            return true
+        }
+    }
+    return false
+}
+
+// NewKey returns a random api key, only its HashKey should be stored
+func NewKey() (string, error) {
+    bs := make([]byte, 32)
+    if _, err := rand.Read(bs); err != nil {
+        return "", fmt.Errorf("cannot generate api key %v", err)
+    }
+    return keyPrefix + base64.RawURLEncoding.EncodeToString(bs), nil
+}
+
+// HashKey is sha256 of the key, keys are random so no salt or slow hash
+// is needed and the hash can be looked up directly.
+func HashKey(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return hex.EncodeToString(sum[:])
+}
+
+type AuthCfg struct {
+    Enabled bool
+    KeysFile string
+    CacheTtlMs uint64
+}
+
+type cachedKey struct {
+    key ApiKey
+    loadedAt time.Time
+}
+
+type authenticator struct {
+    cfg AuthCfg
+    keys KeyStore
+    mu sync.Mutex
+    cache map[string]cachedKey
+}
+
+func NewAuthenticator(cfg AuthCfg, keys KeyStore) *authenticator {
+    log.Println("Authenticator init")
+    if !cfg.Enabled {
+        log.Println("API key authentication is disabled")
+    }
+    return &authenticator{cfg: cfg, keys: keys, cache: make(map[string]cachedKey)}
+}
+
+type tenantKey struct{}
+
+func WithTenant(ctx context.Context, tenant string) context.Context {
+    return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFrom returns tenant of the caller authenticated by the request,
+// DefaultTenant when auth is disabled.
+func TenantFrom(ctx context.Context) string {
+    if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+        return tenant
+    }
+    return DefaultTenant
+}
+
+// authorize checks key has scope, found keys are cached for CacheTtlMs so
+// revoked keys keep working at most that long.
+func (a *authenticator) authorize(key, scope string) (ApiKey, error) {
+    if !a.cfg.Enabled {
+        return ApiKey{}, nil
+    }
+
+    if !strings.HasPrefix(key, keyPrefix) {
+        return ApiKey{}, errUnauthenticated
+    }
+
+    hash := HashKey(key)
+    ttl := time.Duration(a.cfg.CacheTtlMs) * time.Millisecond
+    a.mu.Lock()
+    cached, ok := a.cache[hash]
+    a.mu.Unlock()
+
+    if !ok || time.Since(cached.loadedAt) >= ttl {
+        k, err := a.keys.FindKey(hash)
+        if errors.Is(err, ErrKeyNotFound) {
+            a.mu.Lock()
+            delete(a.cache, hash)
+            a.mu.Unlock()
+            return ApiKey{}, errUnauthenticated
+        }
+
+        if err != nil {
+            return ApiKey{}, fmt.Errorf("cannot load api key %v", err)
+        }
+
+        cached = cachedKey{k, time.Now()}
+        a.mu.Lock()
+        a.cache[hash] = cached
+        a.mu.Unlock()
+    }
+
+    if cached.key.Revoked() {
+        return ApiKey{}, errUnauthenticated
+    }
+
+    if !cached.key.Allows(scope) {
+        return ApiKey{}, errForbidden
+    }
+    return cached.key, nil
+}
+
+// Require wraps h so only requests with an api key having scope of the
+// request get through, with tenant of the key in their context. Key is read
+// from Authorization: Bearer or X-Api-Key.
+func (a *authenticator) Require(scope func(r *http.Request) string, h http.Handler) http.Handler {
+    if !a.cfg.Enabled {
+        return h
+    }
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        key := r.Header.Get("X-Api-Key")
+        if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+            key = strings.TrimSpace(bearer)
+        }
+
+        need := scope(r)
+        k, err := a.authorize(key, need)
+        switch {
+        case errors.Is(err, errUnauthenticated):
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            w.WriteHeader(http.StatusUnauthorized)
+            fmt.Fprint(w, "Missing or invalid API key")
+        case errors.Is(err, errForbidden):
+            w.WriteHeader(http.StatusForbidden)
+            fmt.Fprintf(w, "API key does not have scope %s", need)
+        case err != nil:
+            w.WriteHeader(http.StatusInternalServerError)
+            fmt.Fprintf(w, "Cannot verify API key %v", err)
+            log.Printf("Error verifying api key %v\n", err)
+        default:
+            h.ServeHTTP(w, r.WithContext(WithTenant(r.Context(), k.TenantId())))
+        }
+    })
+}
+
+// Scope requires the same scope for every request
+func Scope(scope string) func(r *http.Request) string {
+    return func(*http.Request) string {
+        return scope
+    }
+}
+
+// JobsScope reads jobs with GET and changes them with other methods
+func JobsScope(r *http.Request) string {
+    if r.Method == http.MethodGet || r.Method == http.MethodHead {
+        return ScopeJobsRead
+    }
+    return ScopeJobsWrite
+}
+
+// grpcScopes of Scheduler methods, other methods (reflection) only need a
+// valid key
+var grpcScopes = map[string]string{
+    pb.Scheduler_Schedule_FullMethodName: ScopeJobsWrite,
+    pb.Scheduler_BatchSchedule_FullMethodName: ScopeJobsWrite,
+    pb.Scheduler_Cancel_FullMethodName: ScopeJobsWrite,
+    pb.Scheduler_Get_FullMethodName: ScopeJobsRead,
+    pb.Scheduler_List_FullMethodName: ScopeJobsRead,
+}
+
+func (a *authenticator) authorizeGrpc(ctx context.Context, method string) (context.Context, error) {
+    var key string
+    md, _ := metadata.FromIncomingContext(ctx)
+    if vs := md.Get("x-api-key"); len(vs) > 0 {
+        key = vs[0]
+    }
+    if vs := md.Get("authorization"); len(vs) > 0 {
+        if bearer, ok := strings.CutPrefix(vs[0], "Bearer "); ok {
+            key = strings.TrimSpace(bearer)
+        }
+    }
+
+    k, err := a.authorize(key, grpcScopes[method])
+    switch {
+    case errors.Is(err, errUnauthenticated):
+        return ctx, status.Error(codes.Unauthenticated, err.Error())
+    case errors.Is(err, errForbidden):
+        return ctx, status.Errorf(codes.PermissionDenied, "api key does not have scope %s", grpcScopes[method])
+    case err != nil:
+        log.Printf("Error verifying api key %v\n", err)
+        return ctx, status.Errorf(codes.Internal, "cannot verify api key %v", err)
+    }
+    return WithTenant(ctx, k.TenantId()), nil
+}
+
+func (a *authenticator) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+    ctx, err := a.authorizeGrpc(ctx, info.FullMethod)
+    if err != nil {
+        return nil, err
+    }
+    return handler(ctx, req)
+}
+
+func (a *authenticator) streamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+    if _, err := a.authorizeGrpc(ss.Context(), info.FullMethod); err != nil {
+        return err
+    }
+    return handler(srv, ss)
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kucicm/boomerang/src/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type mockKeyStore struct {
+    keys []ApiKey
+}
+
+func (s *mockKeyStore) CreateKey(key ApiKey) (uint64, error) {
+    key.Id = uint64(len(s.keys) + 1)
+    s.keys = append(s.keys, key)
+    return key.Id, nil
+}
+
+func (s *mockKeyStore) FindKey(hash string) (ApiKey, error) {
+    for _, k := range s.keys {
+        if k.Hash == hash {
+            return k, nil
+        }
+    }
+    return ApiKey{}, ErrKeyNotFound
+}
+
+func (s *mockKeyStore) RevokeKey(id uint64) error {
+    if id == 0 || id > uint64(len(s.keys)) {
+        return ErrKeyNotFound
+    }
+    s.keys[id - 1].RevokedAt = time.Now()
+    return nil
+}
+
+func (s *mockKeyStore) ListKeys() ([]ApiKey, error) {
+    return s.keys, nil
+}
+
+func newTestKey(t *testing.T, store *mockKeyStore, scopes ...string) (string, uint64) {
+    key, err := NewKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    id, _ := store.CreateKey(ApiKey{Name: "test", Hash: HashKey(key), Scopes: scopes})
+    return key, id
+}
+
+func TestRequireScope(t *testing.T) {
+    store := &mockKeyStore{}
+    writer, writerId := newTestKey(t, store, ScopeJobsWrite)
+    reader, _ := newTestKey(t, store, ScopeJobsRead)
+    admin, _ := newTestKey(t, store, ScopeAdmin)
+
+    auth := NewAuthenticator(AuthCfg{Enabled: true}, store)
+    handler := auth.Require(JobsScope, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNoContent)
+    }))
+
+    cases := []struct {
+        method string
+        header string
+        value string
+        expected int
+    }{
+        {http.MethodDelete, "", "", http.StatusUnauthorized},
+        {http.MethodDelete, "Authorization", "Bearer bmr_unknown", http.StatusUnauthorized},
+        {http.MethodDelete, "Authorization", "Bearer " + reader, http.StatusForbidden},
+        {http.MethodGet, "Authorization", "Bearer " + reader, http.StatusNoContent},
+        {http.MethodDelete, "X-Api-Key", writer, http.StatusNoContent},
+        {http.MethodGet, "X-Api-Key", writer, http.StatusForbidden},
+        {http.MethodGet, "Authorization", "Bearer " + admin, http.StatusNoContent},
+    }
+
+    for _, c := range cases {
+        r := httptest.NewRequest(c.method, "/jobs/1", nil)
+        if c.header != "" {
+            r.Header.Set(c.header, c.value)
+        }
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+
+        if w.Code != c.expected {
+            t.Errorf("%s with %s %q expected %d got %d", c.method, c.header, c.value, c.expected, w.Code)
+        }
+    }
+
+    store.RevokeKey(writerId)
+    r := httptest.NewRequest(http.MethodDelete, "/jobs/1", nil)
+    r.Header.Set("X-Api-Key", writer)
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, r)
+
+    if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+        t.Errorf("expected revoked key to be rejected got %d", w.Code)
+    }
+}
+
+func TestRequireDisabled(t *testing.T) {
+    auth := NewAuthenticator(AuthCfg{}, nil)
+    handler := auth.Require(Scope(ScopeAdmin), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNoContent)
+    }))
+
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+    if w.Code != http.StatusNoContent {
+        t.Errorf("expected request to pass with auth disabled got %d", w.Code)
+    }
+}
+
+func TestAuthCache(t *testing.T) {
+    store := &mockKeyStore{}
+    key, id := newTestKey(t, store, ScopeJobsRead)
+    auth := NewAuthenticator(AuthCfg{Enabled: true, CacheTtlMs: 60_000}, store)
+
+    if _, err := auth.authorize(key, ScopeJobsRead); err != nil {
+        t.Fatal(err)
+    }
+
+    store.RevokeKey(id)
+    if _, err := auth.authorize(key, ScopeJobsRead); err != nil {
+        t.Errorf("expected cached key to be used got %v", err)
+    }
+
+    auth.cfg.CacheTtlMs = 0
+    if _, err := auth.authorize(key, ScopeJobsRead); err != errUnauthenticated {
+        t.Errorf("expected revoked key after cache expired got %v", err)
+    }
+}
+
+func TestGrpcAuth(t *testing.T) {
+    keys := &mockKeyStore{}
+    reader, _ := newTestKey(t, keys, ScopeJobsRead)
+    store := &mockGrpcStore{mockJobStore: mockJobStore{jobs: map[uint64]Job{1: {Request: ScheduleRequest{Id: 1}}}}}
+    client := newTestGrpcClient(t, store, NewAuthenticator(AuthCfg{Enabled: true}, keys))
+
+    _, err := client.Get(context.Background(), &pb.GetRequest{Id: 1})
+    if status.Code(err) != codes.Unauthenticated {
+        t.Errorf("expected unauthenticated without key got %v", err)
+    }
+
+    ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer " + reader)
+    if _, err := client.Get(ctx, &pb.GetRequest{Id: 1}); err != nil {
+        t.Errorf("expected get with read key got %v", err)
+    }
+
+    _, err = client.Cancel(ctx, &pb.CancelRequest{Id: 1})
+    if status.Code(err) != codes.PermissionDenied || !strings.Contains(err.Error(), ScopeJobsWrite) {
+        t.Errorf("expected permission denied on cancel got %v", err)
+    }
+}
+
+func TestGrpcTenant(t *testing.T) {
+    keys := &mockKeyStore{}
+    keyA, _ := newTestKey(t, keys, ScopeAdmin)
+    keyB, _ := newTestKey(t, keys, ScopeAdmin)
+    keys.keys[0].Tenant, keys.keys[1].Tenant = "team-a", "team-b"
+
+    store := &mockGrpcStore{mockJobStore: mockJobStore{jobs: map[uint64]Job{
+        1: {Request: ScheduleRequest{Id: 1, Tenant: "team-a"}, Status: StatusInitial},
+        2: {Request: ScheduleRequest{Id: 2, Tenant: "team-b"}, Status: StatusInitial},
+    }}}
+    client := newTestGrpcClient(t, store, NewAuthenticator(AuthCfg{Enabled: true}, keys))
+    ctxA := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", keyA)
+    ctxB := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", keyB)
+
+    if _, err := client.Get(ctxB, &pb.GetRequest{Id: 1}); status.Code(err) != codes.NotFound {
+        t.Errorf("expected job of other tenant to be not found got %v", err)
+    }
+
+    if _, err := client.Cancel(ctxB, &pb.CancelRequest{Id: 1}); status.Code(err) != codes.NotFound || len(store.cancelled) != 0 {
+        t.Errorf("expected cancel of other tenant job to fail got %v", err)
+    }
+
+    page, err := client.List(ctxA, &pb.ListRequest{})
+    if err != nil || len(page.Jobs) != 1 || page.Jobs[0].Id != 1 {
+        t.Errorf("expected only own jobs listed got %+v %v", page, err)
+    }
+
+    _, err = client.Schedule(ctxB, &pb.ScheduleRequest{Endpoint: "http://example.com", Delay: "1m", Ttl: "1h"})
+    if err != nil || store.item.Tenant != "team-b" {
+        t.Errorf("expected request saved for tenant got %+v %v", store.item, err)
+    }
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+    batchSummary = promauto.NewSummaryVec(
+        prometheus.SummaryOpts{
+            Name: "boomerang_submit_batch_request",
+            Help: "boomerang_submit_batch_request",
+        },
+        []string{"tenant", "status"},
+    )
+)
+
+type BatchItemResponse struct {
+    Id uint64 `json:"id,omitempty"`
+    Status int `json:"status"`
+    ScheduledFor *time.Time `json:"scheduledFor,omitempty"`
+    ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+    Error string `json:"error,omitempty"`
+    Errors ValidationErrors `json:"errors,omitempty"`
+}
+
+type BatchSubmitResponse struct {
+    Items []BatchItemResponse `json:"items"`
+}
+
+// BatchSubmitHandler handles /submit/batch, body is a JSON array or NDJSON
+// stream of schedule requests. Items are saved together and every item gets
+// its own status, an invalid item does not fail the rest of the batch.
+func (a *accepter) BatchSubmitHandler(w http.ResponseWriter, r *http.Request) {
+    var status, tenant = "ok", TenantFrom(r.Context())
+    defer func(start time.Time) {
+        batchSummary.WithLabelValues(tenant, status).Observe(float64(time.Since(start).Nanoseconds()))
+    }(time.Now())
+
+    if r.Method != http.MethodPost {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        status = "invalid method"
+        return
+    }
+
+    body, ok := readBody(w, r, a.cfg.MaxBatchBodyBytes)
+    if !ok {
+        status = "invalid body"
+        return
+    }
+
+    items, err := splitBatch(body)
+    if err != nil {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprintf(w, "Cannot parse request body %v", err)
+        status = "invalid request"
+        return
+    }
+
+    if len(items) == 0 {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprint(w, "Batch is empty")
+        status = "invalid request"
+        return
+    }
+
+    if a.cfg.MaxBatchSize > 0 && len(items) > a.cfg.MaxBatchSize {
+        w.WriteHeader(http.StatusRequestEntityTooLarge)
+        fmt.Fprintf(w, "Batch of %d requests is over limit of %d", len(items), a.cfg.MaxBatchSize)
+        status = "too large"
+        return
+    }
+
+    resp := BatchSubmitResponse{Items: make([]BatchItemResponse, len(items))}
+    reqs := make([]ScheduleRequest, 0, len(items))
+    positions := make([]int, 0, len(items))
+    for i, item := range items {
+        req, errs := a.parse(item)
+        if len(errs) > 0 {
+            resp.Items[i] = BatchItemResponse{Status: http.StatusBadRequest, Errors: errs}
+            continue
+        }
+
+        reqs = append(reqs, a.withOwner(req, tenant, ""))
+        positions = append(positions, i)
+    }
+
+    ids, errs := a.saveBatch(reqs)
+    for j, i := range positions {
+        switch {
+        case errors.Is(errs[j], ErrDuplicateRequest):
+            resp.Items[i] = a.duplicateItem(ids[j])
+        case errs[j] != nil:
+            resp.Items[i] = BatchItemResponse{Status: http.StatusInternalServerError, Error: errs[j].Error()}
+            status = "save fail"
+        default:
+            scheduledFor := time.UnixMilli(int64(reqs[j].SendAfter)).UTC()
+            expiresAt := time.UnixMilli(int64(reqs[j].TimeToLive)).UTC()
+            resp.Items[i] = BatchItemResponse{Id: ids[j], Status: http.StatusCreated, ScheduledFor: &scheduledFor, ExpiresAt: &expiresAt}
+        }
+    }
+
+    writeJSON(w, http.StatusOK, resp)
+}
+
+// duplicateItem answers a repeated batch item with the job scheduled first,
+// like writeDuplicate does for /submit
+func (a *accepter) duplicateItem(id uint64) BatchItemResponse {
+    item := BatchItemResponse{Id: id, Status: http.StatusOK}
+    job, err := a.store.Get(id)
+    if err != nil {
+        log.Printf("Cannot load job %d of duplicate request %v\n", id, err)
+        return item
+    }
+
+    scheduledFor := time.UnixMilli(int64(job.Request.SendAfter)).UTC()
+    expiresAt := time.UnixMilli(int64(job.Request.TimeToLive)).UTC()
+    item.ScheduledFor, item.ExpiresAt = &scheduledFor, &expiresAt
+    return item
+}
+
+func (a *accepter) saveBatch(reqs []ScheduleRequest) ([]uint64, []error) {
+    if len(reqs) == 0 {
+        return nil, nil
+    }
+    return a.store.SaveBatch(reqs)
+}
+
+// splitBatch returns raw items of a JSON array or of NDJSON lines
+func splitBatch(body []byte) ([]json.RawMessage, error) {
+    body = bytes.TrimSpace(body)
+    if len(body) > 0 && body[0] == '[' {
+        var items []json.RawMessage
+        if err := json.Unmarshal(body, &items); err != nil {
+            return nil, err
+        }
+        return items, nil
+    }
+
+    var items []json.RawMessage
+    scanner := bufio.NewScanner(bytes.NewReader(body))
+    scanner.Buffer(make([]byte, 64 * 1024), len(body) + 1)
+    for scanner.Scan() {
+        line := bytes.TrimSpace(scanner.Bytes())
+        if len(line) == 0 {
+            continue
+        }
+        items = append(items, json.RawMessage(append([]byte(nil), line...)))
+    }
+    return items, scanner.Err()
+}
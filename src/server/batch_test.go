@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchSubmit(t *testing.T) {
+    bodies := map[string]string{
+        "array": `[
+            {"endpoint": "http://example.com/a", "TimeToLive": 4102444800000, "idempotencyKey": "key-1"},
+            {"endpoint": ""},
+            {"endpoint": 12},
+            {"endpoint": "http://example.com/b", "TimeToLive": 4102444800000, "idempotencyKey": "key-1"}
+        ]`,
+        "ndjson": `{"endpoint": "http://example.com/a", "TimeToLive": 4102444800000, "idempotencyKey": "key-1"}
+{"endpoint": ""}
+
+{"endpoint": 12}
+{"endpoint": "http://example.com/b", "TimeToLive": 4102444800000, "idempotencyKey": "key-1"}
+`,
+    }
+
+    for name, body := range bodies {
+        store := &mockStore{}
+        srv := NewAccepter(AccepterCfg{IdempotencyRetentionMs: 60_000, MaxBatchSize: 10}, store)
+
+        rr := httptest.NewRecorder()
+        srv.BatchSubmitHandler(rr, httptest.NewRequest(http.MethodPost, "/submit/batch", strings.NewReader(body)))
+        if rr.Code != http.StatusOK {
+            t.Fatalf("%s: handler returned wrong status code: got %v want %v", name, rr.Code, http.StatusOK)
+        }
+
+        var resp BatchSubmitResponse
+        if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+            t.Fatal(err)
+        }
+
+        expected := []int{http.StatusCreated, http.StatusBadRequest, http.StatusBadRequest, http.StatusOK}
+        if len(resp.Items) != len(expected) {
+            t.Fatalf("%s: expected %d items got %+v", name, len(expected), resp.Items)
+        }
+
+        for i, code := range expected {
+            if resp.Items[i].Status != code {
+                t.Errorf("%s: item %d expected status %d got %+v", name, i, code, resp.Items[i])
+            }
+        }
+
+        if resp.Items[0].Id != 42 || resp.Items[3].Id != 42 || len(resp.Items[1].Errors) == 0 {
+            t.Errorf("%s: unexpected items %+v", name, resp.Items)
+        }
+
+        if resp.Items[3].ScheduledFor == nil || resp.Items[3].ExpiresAt == nil || !resp.Items[3].ExpiresAt.Equal(*resp.Items[0].ExpiresAt) {
+            t.Errorf("%s: expected duplicate with times of stored job got %+v", name, resp.Items[3])
+        }
+
+        if len(store.saved) != 2 || store.saved[0].IdempotencyExpiresAt == 0 {
+            t.Errorf("%s: expected only valid items to be saved got %+v", name, store.saved)
+        }
+    }
+}
+
+func TestBatchSubmitLimits(t *testing.T) {
+    srv := NewAccepter(AccepterCfg{MaxBatchSize: 1}, &mockStore{})
+
+    bodies := map[string]int{
+        `[{"endpoint": "http://a"}, {"endpoint": "http://b"}]`: http.StatusRequestEntityTooLarge,
+        `[]`: http.StatusBadRequest,
+        `[{"endpoint": "a"}`: http.StatusBadRequest,
+    }
+
+    for body, code := range bodies {
+        rr := httptest.NewRecorder()
+        srv.BatchSubmitHandler(rr, httptest.NewRequest(http.MethodPost, "/submit/batch", strings.NewReader(body)))
+        if rr.Code != code {
+            t.Errorf("body %s: handler returned wrong status code: got %v want %v", body, rr.Code, code)
+        }
+    }
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+    breakerGauge = promauto.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Name: "boomerang_breaker_state",
+            Help: "boomerang_breaker_state 0 closed, 1 open, 2 half open",
+        },
+        []string{"host"},
+    )
+)
+
+const (
+    BreakerClosed = "closed"
+    BreakerOpen = "open"
+    BreakerHalfOpen = "half_open"
+)
+
+// BreakerCfg opens breaker of a host after Failures consecutive failed
+// calls. OpenMs later up to Probes calls go through, first of them to finish
+// closes it again or keeps it open. Zero Failures disables breakers.
+type BreakerCfg struct {
+    Failures uint
+    OpenMs uint64
+    Probes uint
+}
+
+// BreakerState is what admin endpoint shows about a host breaker
+type BreakerState struct {
+    Host string `json:"host"`
+    State string `json:"state"`
+    Failures uint `json:"failures"`
+    OpenedAt *time.Time `json:"openedAt,omitempty"`
+    Probes uint `json:"probes"`
+}
+
+type breaker struct {
+    state string
+    failures uint
+    openedAt time.Time
+    probes uint
+}
+
+// breakers keeps breaker of hosts with failed calls, hosts without one
+// are closed
+type breakers struct {
+    cfg BreakerCfg
+    halfOpenWait time.Duration
+    mu sync.Mutex
+    hosts map[string]*breaker
+}
+
+func newBreakers(cfg BreakerCfg, halfOpenWait time.Duration) *breakers {
+    if cfg.Probes == 0 {
+        cfg.Probes = 1
+    }
+    return &breakers{cfg: cfg, halfOpenWait: halfOpenWait, hosts: make(map[string]*breaker)}
+}
+
+// allow reports if a call to host may go out at now, a half open breaker
+// lets it through as a probe. When it may not it returns how long to wait.
+func (b *breakers) allow(host string, now time.Time) (time.Duration, bool) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    br, ok := b.hosts[host]
+    if !ok || br.state == BreakerClosed {
+        return 0, true
+    }
+
+    if br.state == BreakerOpen {
+        reopen := br.openedAt.Add(time.Duration(b.cfg.OpenMs) * time.Millisecond)
+        if now.Before(reopen) {
+            return reopen.Sub(now), false
+        }
+        b.set(host, br, BreakerHalfOpen)
+    }
+
+    if br.probes >= b.cfg.Probes {
+        return b.halfOpenWait, false
+    }
+    br.probes++
+    return 0, true
+}
+
+// release gives back probe of a call allowed but not sent
+func (b *breakers) release(host string) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if br, ok := b.hosts[host]; ok && br.state == BreakerHalfOpen && br.probes > 0 {
+        br.probes--
+    }
+}
+
+// record counts result of a call to host. Results of calls which finish
+// while breaker is open do not change it.
+func (b *breakers) record(host string, success bool, now time.Time) {
+    if b.cfg.Failures == 0 {
+        return
+    }
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    br, ok := b.hosts[host]
+    if !ok {
+        if success {
+            return
+        }
+        br = &breaker{state: BreakerClosed}
+        b.hosts[host] = br
+    }
+
+    switch br.state {
+    case BreakerClosed:
+        if success {
+            delete(b.hosts, host)
+            return
+        }
+        br.failures++
+        if br.failures >= b.cfg.Failures {
+            br.openedAt = now
+            b.set(host, br, BreakerOpen)
+        }
+    case BreakerHalfOpen:
+        if success {
+            delete(b.hosts, host)
+            breakerGauge.WithLabelValues(host).Set(0)
+            return
+        }
+        br.failures++
+        br.openedAt = now
+        b.set(host, br, BreakerOpen)
+    }
+}
+
+func (b *breakers) set(host string, br *breaker, state string) {
+    br.state, br.probes = state, 0
+    value := 1.0
+    if state == BreakerHalfOpen {
+        value = 2
+    }
+    breakerGauge.WithLabelValues(host).Set(value)
+}
+
+// states returns breakers which are not closed or have failures, sorted by host
+func (b *breakers) states() []BreakerState {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    out := make([]BreakerState, 0, len(b.hosts))
+    for host, br := range b.hosts {
+        s := BreakerState{Host: host, State: br.state, Failures: br.failures, Probes: br.probes}
+        if !br.openedAt.IsZero() {
+            openedAt := br.openedAt.UTC()
+            s.OpenedAt = &openedAt
+        }
+        out = append(out, s)
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+    return out
+}
+
+// BreakersHandler lists breakers of hosts with failed calls
+func (d *dispatcher) BreakersHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+    writeJSON(w, http.StatusOK, d.breakers.states())
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAndProbes(t *testing.T) {
+    now := time.Unix(1_700_000_000, 0)
+    b := newBreakers(BreakerCfg{Failures: 3, OpenMs: 10_000, Probes: 1}, time.Second)
+
+    b.record("down.com", false, now)
+    b.record("down.com", false, now)
+    b.record("down.com", true, now)
+    b.record("down.com", false, now)
+    b.record("down.com", false, now)
+    if _, ok := b.allow("down.com", now); !ok {
+        t.Error("expected success to reset consecutive failures")
+    }
+
+    b.record("down.com", false, now)
+    wait, ok := b.allow("down.com", now.Add(4 * time.Second))
+    if ok || wait != 6 * time.Second {
+        t.Errorf("expected open breaker to defer until it half opens got %v %t", wait, ok)
+    }
+
+    if _, ok := b.allow("up.com", now); !ok {
+        t.Error("expected breaker of other host to stay closed")
+    }
+
+    later := now.Add(10 * time.Second)
+    if _, ok := b.allow("down.com", later); !ok {
+        t.Error("expected half open breaker to let a probe through")
+    }
+    if wait, ok := b.allow("down.com", later); ok || wait != time.Second {
+        t.Errorf("expected calls over probes to wait got %v %t", wait, ok)
+    }
+
+    b.record("down.com", false, later)
+    if _, ok := b.allow("down.com", later.Add(time.Second)); ok {
+        t.Error("expected failed probe to open breaker again")
+    }
+
+    latest := later.Add(10 * time.Second)
+    if _, ok := b.allow("down.com", latest); !ok {
+        t.Error("expected breaker to half open again")
+    }
+    b.record("down.com", true, latest)
+    for i := 0; i < 3; i++ {
+        if _, ok := b.allow("down.com", latest); !ok {
+            t.Error("expected successful probe to close breaker")
+        }
+    }
+
+    if states := b.states(); len(states) != 0 {
+        t.Errorf("expected closed breaker to be forgotten got %+v", states)
+    }
+}
+
+func TestBreakerRelease(t *testing.T) {
+    now := time.Unix(1_700_000_000, 0)
+    b := newBreakers(BreakerCfg{Failures: 1, OpenMs: 1_000, Probes: 1}, time.Second)
+    b.record("down.com", false, now)
+
+    later := now.Add(time.Second)
+    if _, ok := b.allow("down.com", later); !ok {
+        t.Fatal("expected a probe")
+    }
+    b.release("down.com")
+    if _, ok := b.allow("down.com", later); !ok {
+        t.Error("expected released probe to be given to the next call")
+    }
+}
+
+func TestBreakersHandler(t *testing.T) {
+    d := newDispatcher(DispatcherCfg{MaxConcurrency: 1, Breaker: BreakerCfg{Failures: 2, OpenMs: 1_000}}, &mockStorage{})
+    now := time.Now()
+    d.breakers.record("b.com", false, now)
+    d.breakers.record("a.com", false, now)
+    d.breakers.record("a.com", false, now)
+
+    rec := httptest.NewRecorder()
+    d.BreakersHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/breakers", nil))
+    if rec.Code != http.StatusOK {
+        t.Fatalf("expected 200 got %d", rec.Code)
+    }
+
+    var states []BreakerState
+    if err := json.NewDecoder(rec.Body).Decode(&states); err != nil {
+        t.Fatal(err)
+    }
+
+    if len(states) != 2 || states[0].Host != "a.com" || states[0].State != BreakerOpen || states[0].OpenedAt == nil ||
+        states[1].Host != "b.com" || states[1].State != BreakerClosed || states[1].Failures != 1 {
+        t.Errorf("unexpected breaker states %+v", states)
+    }
+
+    rec = httptest.NewRecorder()
+    d.BreakersHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/breakers", nil))
+    if rec.Code != http.StatusMethodNotAllowed {
+        t.Errorf("expected 405 got %d", rec.Code)
+    }
+}
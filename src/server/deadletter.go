@@ -0,0 +1,209 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+    deadLetterSummary = promauto.NewSummaryVec(
+        prometheus.SummaryOpts{
+            Name: "boomerang_dead_letters_request",
+            Help: "boomerang_dead_letters_request",
+        },
+        []string{"method", "status"},
+    )
+)
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+const (
+    DeadReasonExhausted = "exhausted"
+    DeadReasonExpired = "expired"
+
+    defaultDeadLetterLimit = 100
+    maxDeadLetterLimit = 1_000
+)
+
+// DeadLetter is a job which ran out of retries or expired, it keeps the
+// job id and request so it can be sent again.
+type DeadLetter struct {
+    Request ScheduleRequest
+    Reason string
+    LastError string
+    LastStatusCode int
+    Attempts int
+    DeadAt time.Time
+}
+
+// TenantId is tenant which owns dead letter, DefaultTenant when not set
+func (dl DeadLetter) TenantId() string {
+    if dl.Request.Tenant == "" {
+        return DefaultTenant
+    }
+    return dl.Request.Tenant
+}
+
+// DeadLetterFilter selects dead letters with id after AfterId, ordered by
+// id. Empty Tenant matches every tenant.
+type DeadLetterFilter struct {
+    Tenant string
+    AfterId uint64
+    Limit int
+}
+
+type DeadLetterResponse struct {
+    Id uint64 `json:"id"`
+    Request ScheduleRequest `json:"request"`
+    PayloadBase64 string `json:"payloadBase64,omitempty"`
+    Reason string `json:"reason"`
+    LastError string `json:"lastError,omitempty"`
+    LastStatusCode int `json:"lastStatusCode"`
+    Attempts int `json:"attempts"`
+    DeadAt time.Time `json:"deadAt"`
+}
+
+type deadLetterStore interface {
+    GetDeadLetter(id uint64) (DeadLetter, error)
+    ListDeadLetters(filter DeadLetterFilter) ([]DeadLetter, error)
+    CountDeadLetters() (int, error)
+}
+
+type deadLettersHandler struct {
+    store deadLetterStore
+}
+
+var depthOnce sync.Once
+
+// NewDeadLettersHandler serves /dead-letters, boomerang_dead_letter_depth
+// reports depth of the store of the first handler.
+func NewDeadLettersHandler(store deadLetterStore) *deadLettersHandler {
+    log.Println("Dead letters handler init")
+    depthOnce.Do(func() {
+        promauto.NewGaugeFunc(
+            prometheus.GaugeOpts{
+                Name: "boomerang_dead_letter_depth",
+                Help: "boomerang_dead_letter_depth",
+            },
+            func() float64 {
+                n, err := store.CountDeadLetters()
+                if err != nil {
+                    log.Printf("Error counting dead letters %v\n", err)
+                    return 0
+                }
+                return float64(n)
+            },
+        )
+    })
+    return &deadLettersHandler{store}
+}
+
+// ServeHTTP handles /dead-letters and /dead-letters/{id}
+func (h *deadLettersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var status = "ok"
+    defer func(start time.Time) {
+        deadLetterSummary.WithLabelValues(r.Method, status).Observe(float64(time.Since(start).Nanoseconds()))
+    }(time.Now())
+
+    if r.Method != http.MethodGet {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        status = "invalid method"
+        return
+    }
+
+    tenant := TenantFrom(r.Context())
+    path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/dead-letters"), "/")
+    if path == "" {
+        status = h.list(w, r, tenant)
+        return
+    }
+
+    id, err := strconv.ParseUint(path, 10, 64)
+    if err != nil {
+        w.WriteHeader(http.StatusNotFound)
+        fmt.Fprintf(w, "Invalid dead letter id %s", r.URL.Path)
+        status = "invalid id"
+        return
+    }
+    status = h.get(w, tenant, id)
+}
+
+func (h *deadLettersHandler) get(w http.ResponseWriter, tenant string, id uint64) string {
+    dl, err := h.store.GetDeadLetter(id)
+    if errors.Is(err, ErrDeadLetterNotFound) || err == nil && dl.TenantId() != tenant {
+        w.WriteHeader(http.StatusNotFound)
+        fmt.Fprintf(w, "Dead letter %d not found", id)
+        return "not found"
+    }
+
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        fmt.Fprintf(w, "Cannot load dead letter %d %v", id, err)
+        log.Printf("Error loading dead letter %d %v\n", id, err)
+        return "load fail"
+    }
+
+    writeJSON(w, http.StatusOK, newDeadLetterResponse(dl))
+    return "ok"
+}
+
+func (h *deadLettersHandler) list(w http.ResponseWriter, r *http.Request, tenant string) string {
+    filter := DeadLetterFilter{Tenant: tenant, Limit: defaultDeadLetterLimit}
+    if v := r.URL.Query().Get("afterId"); v != "" {
+        afterId, err := strconv.ParseUint(v, 10, 64)
+        if err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "Invalid afterId %s", v)
+            return "invalid request"
+        }
+        filter.AfterId = afterId
+    }
+
+    if v := r.URL.Query().Get("limit"); v != "" {
+        limit, err := strconv.Atoi(v)
+        if err != nil || limit <= 0 || limit > maxDeadLetterLimit {
+            w.WriteHeader(http.StatusBadRequest)
+            fmt.Fprintf(w, "Invalid limit %s, must be between 1 and %d", v, maxDeadLetterLimit)
+            return "invalid request"
+        }
+        filter.Limit = limit
+    }
+
+    dls, err := h.store.ListDeadLetters(filter)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        fmt.Fprintf(w, "Cannot list dead letters %v", err)
+        log.Printf("Error listing dead letters %v\n", err)
+        return "list fail"
+    }
+
+    out := make([]DeadLetterResponse, len(dls))
+    for i, dl := range dls {
+        out[i] = newDeadLetterResponse(dl)
+    }
+    writeJSON(w, http.StatusOK, out)
+    return "ok"
+}
+
+func newDeadLetterResponse(dl DeadLetter) DeadLetterResponse {
+    req, payloadBase64 := jsonPayload(dl.Request)
+    return DeadLetterResponse{
+        Id: dl.Request.Id,
+        Request: req,
+        PayloadBase64: payloadBase64,
+        Reason: dl.Reason,
+        LastError: dl.LastError,
+        LastStatusCode: dl.LastStatusCode,
+        Attempts: dl.Attempts,
+        DeadAt: dl.DeadAt.UTC(),
+    }
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type mockDeadLetterStore struct {
+    dead map[uint64]DeadLetter
+    returnErr error
+    filters []DeadLetterFilter
+}
+
+func (s *mockDeadLetterStore) GetDeadLetter(id uint64) (DeadLetter, error) {
+    if s.returnErr != nil {
+        return DeadLetter{}, s.returnErr
+    }
+
+    dl, ok := s.dead[id]
+    if !ok {
+        return dl, ErrDeadLetterNotFound
+    }
+    return dl, nil
+}
+
+func (s *mockDeadLetterStore) ListDeadLetters(filter DeadLetterFilter) ([]DeadLetter, error) {
+    s.filters = append(s.filters, filter)
+    if s.returnErr != nil {
+        return nil, s.returnErr
+    }
+
+    out := make([]DeadLetter, 0)
+    for id := filter.AfterId + 1; id <= uint64(len(s.dead)); id++ {
+        if dl := s.dead[id]; dl.TenantId() == filter.Tenant {
+            out = append(out, dl)
+        }
+    }
+    return out, nil
+}
+
+func (s *mockDeadLetterStore) CountDeadLetters() (int, error) {
+    return len(s.dead), s.returnErr
+}
+
+func newTestDeadLetters() *mockDeadLetterStore {
+    deadAt := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+    return &mockDeadLetterStore{dead: map[uint64]DeadLetter{
+        1: {Request: ScheduleRequest{Id: 1, Endpoint: "http://a.com"}, Reason: DeadReasonExhausted, LastStatusCode: 503, Attempts: 3, DeadAt: deadAt},
+        2: {Request: ScheduleRequest{Id: 2, Tenant: "team-a", Payload: "\xff"}, Reason: DeadReasonExpired, DeadAt: deadAt},
+        3: {Request: ScheduleRequest{Id: 3}, Reason: DeadReasonExpired, LastError: "timeout", Attempts: 1, DeadAt: deadAt},
+    }}
+}
+
+func TestDeadLettersGet(t *testing.T) {
+    h := NewDeadLettersHandler(newTestDeadLetters())
+
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/dead-letters/1", nil))
+    if rr.Code != http.StatusOK {
+        t.Fatalf("expected %d got %d", http.StatusOK, rr.Code)
+    }
+
+    var res DeadLetterResponse
+    if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+        t.Fatal(err)
+    }
+    if res.Id != 1 || res.Reason != DeadReasonExhausted || res.LastStatusCode != 503 || res.Attempts != 3 || res.Request.Endpoint != "http://a.com" {
+        t.Errorf("unexpected dead letter %+v", res)
+    }
+
+    for path, code := range map[string]int{"/dead-letters/2": http.StatusNotFound, "/dead-letters/9": http.StatusNotFound, "/dead-letters/x": http.StatusNotFound} {
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+        if rr.Code != code {
+            t.Errorf("%s expected %d got %d", path, code, rr.Code)
+        }
+    }
+
+    r := httptest.NewRequest(http.MethodGet, "/dead-letters/2", nil)
+    rr = httptest.NewRecorder()
+    h.ServeHTTP(rr, r.WithContext(WithTenant(r.Context(), "team-a")))
+    res = DeadLetterResponse{}
+    json.NewDecoder(rr.Body).Decode(&res)
+    if rr.Code != http.StatusOK || res.PayloadBase64 != "/w==" {
+        t.Errorf("expected owner to get dead letter with binary payload got %d %+v", rr.Code, res)
+    }
+
+    rr = httptest.NewRecorder()
+    h.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/dead-letters/1", nil))
+    if rr.Code != http.StatusMethodNotAllowed {
+        t.Errorf("expected %d got %d", http.StatusMethodNotAllowed, rr.Code)
+    }
+}
+
+func TestDeadLettersList(t *testing.T) {
+    store := newTestDeadLetters()
+    h := NewDeadLettersHandler(store)
+
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/dead-letters?afterId=1&limit=10", nil))
+    if rr.Code != http.StatusOK {
+        t.Fatalf("expected %d got %d", http.StatusOK, rr.Code)
+    }
+
+    var res []DeadLetterResponse
+    if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+        t.Fatal(err)
+    }
+    if len(res) != 1 || res[0].Id != 3 || res[0].LastError != "timeout" {
+        t.Errorf("expected dead letters of default tenant after 1 got %+v", res)
+    }
+
+    if f := store.filters[0]; f.Tenant != DefaultTenant || f.AfterId != 1 || f.Limit != 10 {
+        t.Errorf("unexpected filter %+v", f)
+    }
+
+    for _, path := range []string{"/dead-letters?limit=0", "/dead-letters?limit=1001", "/dead-letters?afterId=x"} {
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+        if rr.Code != http.StatusBadRequest {
+            t.Errorf("%s expected %d got %d", path, http.StatusBadRequest, rr.Code)
+        }
+    }
+
+    store.returnErr = errors.New("ups")
+    rr = httptest.NewRecorder()
+    h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/dead-letters", nil))
+    if rr.Code != http.StatusInternalServerError || store.filters[len(store.filters) - 1].Limit != defaultDeadLetterLimit {
+        t.Errorf("expected %d with default limit got %d", http.StatusInternalServerError, rr.Code)
+    }
+}
@@ -2,28 +2,60 @@ package server
 
 import (
 	"bytes"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+    deferredCounter = promauto.NewCounterVec(
+        prometheus.CounterOpts{
+            Name: "boomerang_dispatch_deferred",
+            Help: "boomerang_dispatch_deferred",
+        },
+        []string{"reason"},
+    )
 )
 
+// DispatcherCfg limits calls in flight, MaxHostConcurrency caps every host
+// and HostConcurrency overrides it for listed hosts (zero means no cap).
+// Jobs of a saturated host are put back DeferMs later, jobs over one of
+// RateLimits are put back when their turn comes and jobs of a host with
+// open breaker when it half opens. Calls taking longer than CallTimeoutMs
+// fail.
 type DispatcherCfg struct {
     LoadBatchSize uint
     MaxConcurrency uint
+    MaxHostConcurrency uint
+    HostConcurrency map[string]uint
+    DeferMs uint64
+    CallTimeoutMs uint64
+    RateLimits []RateLimit
+    Breaker BreakerCfg
+    Signing SigningCfg
 }
 
 type sendResult struct {
     req ScheduleRequest
     success bool
     timeTaken int64 // ns
+    attempt Attempt
 }
 
 type storage interface {
     Load(bs uint) []ScheduleRequest
     Update(req ScheduleRequest)
-    Delete(req ScheduleRequest)
+    Done(req ScheduleRequest)
+    AddAttempt(id uint64, attempt Attempt)
+    // DeadLetter moves req with its last attempt to dead letters
+    DeadLetter(req ScheduleRequest, reason string)
 }
 
 type dispatcher struct {
@@ -32,40 +64,80 @@ type dispatcher struct {
     stopSingal int32
     wg sync.WaitGroup
     semaphore chan struct{}
+    hosts *hostLimiter
+    rates *rateLimiter
+    breakers *breakers
+    signer *signer
+    retries map[string]RetryPolicy
+    client *http.Client
+    now func() time.Time
+    started sync.Once
 }
 
+const defaultCallTimeout = 30 * time.Second
+
 var dispathcer *dispatcher
 var onceDispathcer sync.Once
 func NewDispatcher(cfg DispatcherCfg,store storage) *dispatcher {
     onceDispathcer.Do(func() {
-        dispathcer = &dispatcher{
-            cfg: cfg,
-            store: store,
-            stopSingal: 0,
-            wg: sync.WaitGroup{},
-            semaphore: make(chan struct{}, cfg.MaxConcurrency),
-        }
+        dispathcer = newDispatcher(cfg, store)
     })
     return dispathcer
 }
 
-var startOnlyOnce sync.Once
+func newDispatcher(cfg DispatcherCfg, store storage) *dispatcher {
+    timeout := time.Duration(cfg.CallTimeoutMs) * time.Millisecond
+    if timeout == 0 {
+        timeout = defaultCallTimeout
+    }
+
+    return &dispatcher{
+        cfg: cfg,
+        store: store,
+        stopSingal: 0,
+        wg: sync.WaitGroup{},
+        semaphore: make(chan struct{}, cfg.MaxConcurrency),
+        hosts: newHostLimiter(cfg.MaxHostConcurrency, cfg.HostConcurrency),
+        rates: newRateLimiter(cfg.RateLimits),
+        breakers: newBreakers(cfg.Breaker, time.Duration(cfg.DeferMs) * time.Millisecond),
+        signer: newSigner(cfg.Signing),
+        retries: defaultRetryPolicies,
+        client: &http.Client{Timeout: timeout},
+        now: time.Now,
+    }
+}
+
 func (d *dispatcher) Start() {
-    startOnlyOnce.Do(func() {
+    d.started.Do(func() {
         d.wg.Add(1)
         go func() {
             defer d.wg.Done()
             for atomic.LoadInt32(&d.stopSingal) == 0 {
                 batch := d.loadBatch()
                 results := d.sendBatch(batch)
-                d.finalizeCall(results)
+                // calls are finalized as they finish, a slow host does not
+                // hold loading of the next batch
+                d.wg.Add(1)
+                go func() {
+                    defer d.wg.Done()
+                    d.finalizeCall(results)
+                }()
             }
         }()
     })
 }
 
+// loadBatch waits for a free call slot and loads at most as many jobs as
+// there are free slots
 func (d *dispatcher) loadBatch() []ScheduleRequest {
-    return d.store.Load(d.cfg.LoadBatchSize)
+    d.semaphore <- struct{}{}
+    <- d.semaphore
+
+    bs := uint(cap(d.semaphore) - len(d.semaphore))
+    if bs > d.cfg.LoadBatchSize {
+        bs = d.cfg.LoadBatchSize
+    }
+    return d.store.Load(bs)
 }
 
 func (d *dispatcher) sendBatch(batch []ScheduleRequest) <-chan sendResult {
@@ -78,11 +150,30 @@ func (d *dispatcher) sendBatch(batch []ScheduleRequest) <-chan sendResult {
     }
 
     wg := &sync.WaitGroup{}
-    wg.Add(len(batch))
-
     for _, req := range batch {
+        // saturated host waits for a later batch instead of holding this one
+        host := HostOf(req.Endpoint)
+        if wait, ok := d.breakers.allow(host, time.Now()); !ok {
+            d.deferCall(req, wait, "circuit_open")
+            continue
+        }
+
+        if !d.hosts.acquire(host) {
+            d.breakers.release(host)
+            d.deferCall(req, time.Duration(d.cfg.DeferMs) * time.Millisecond, "host_concurrency")
+            continue
+        }
+
+        if wait, ok := d.rates.take(req.Endpoint, time.Now()); !ok {
+            d.hosts.release(host)
+            d.breakers.release(host)
+            d.deferCall(req, wait, "rate_limit")
+            continue
+        }
+
         d.semaphore <- struct{}{}
-        go d.doCall(req, ret, wg)
+        wg.Add(1)
+        go d.doCall(req, host, ret, wg)
     }
 
     go func(w *sync.WaitGroup, c chan sendResult) {
@@ -93,50 +184,124 @@ func (d *dispatcher) sendBatch(batch []ScheduleRequest) <-chan sendResult {
     return ret
 }
 
-func (d *dispatcher) doCall(req ScheduleRequest, res chan sendResult, wg *sync.WaitGroup) {
+// deferCall puts req back to storage after wait without counting it as
+// an attempt
+func (d *dispatcher) deferCall(req ScheduleRequest, wait time.Duration, reason string) {
+    deferredCounter.WithLabelValues(reason).Inc()
+    req.SendAfter = uint64(time.Now().Add(wait).UnixMilli())
+    d.store.Update(req)
+}
+
+func (d *dispatcher) doCall(req ScheduleRequest, host string, res chan sendResult, wg *sync.WaitGroup) {
     var success bool
-    defer func(success bool, start time.Time) {
-        res <- sendResult{req: req, success: success, timeTaken: time.Since(start).Nanoseconds()}
+    var statusCode int
+    var callErr error
+    start := time.Now()
+    defer func() {
+        attempt := Attempt{At: start.UTC(), StatusCode: statusCode, LatencyMs: time.Since(start).Milliseconds()}
+        if callErr != nil {
+            attempt.Error = callErr.Error()
+        }
+        d.breakers.record(host, success, time.Now())
+        res <- sendResult{req: req, success: success, timeTaken: time.Since(start).Nanoseconds(), attempt: attempt}
         <- d.semaphore
+        d.hosts.release(host)
         wg.Done()
-    }(success, time.Now())
+    }()
 
-    httpReq, err := http.NewRequest(http.MethodPost, req.Endpoint, bytes.NewBufferString(req.Payload))
+    httpReq, err := newCallRequest(req)
     if err != nil {
         log.Printf("Failed to create http request %v\n", err)
+        callErr = err
         return
     }
+    d.signer.sign(httpReq, req, time.Now())
 
-    for k, v := range req.Headers {
-        httpReq.Header.Add(k, v)
-    }
-
-    client := &http.Client{}
-    resp, err := client.Do(httpReq)
+    resp, err := d.client.Do(httpReq)
     if err != nil {
         log.Printf("error calling %s %s\n", req.Endpoint, err)
+        callErr = err
         return
     }
     defer resp.Body.Close()
 
+    statusCode = resp.StatusCode
     if resp.StatusCode < 500 {
         success = true
     }
 }
 
+// newCallRequest builds callback of req, query is merged into endpoint
+// query and payload is not sent with GET and HEAD.
+func newCallRequest(req ScheduleRequest) (*http.Request, error) {
+    u, err := url.Parse(req.Endpoint)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(req.Query) > 0 {
+        q := u.Query()
+        for k, v := range req.Query {
+            q.Set(k, v)
+        }
+        u.RawQuery = q.Encode()
+    }
+
+    var body io.Reader
+    if hasBody(req) {
+        body = bytes.NewBufferString(req.Payload)
+    }
+
+    httpReq, err := http.NewRequest(req.CallMethod(), u.String(), body)
+    if err != nil {
+        return nil, err
+    }
+
+    for k, v := range req.Headers {
+        httpReq.Header.Add(k, v)
+    }
+    if req.ContentType != "" {
+        httpReq.Header.Set("Content-Type", req.ContentType)
+    }
+    return httpReq, nil
+}
+
+// hasBody reports if payload is sent with req, GET and HEAD go without it
+func hasBody(req ScheduleRequest) bool {
+    method := req.CallMethod()
+    return method != http.MethodGet && method != http.MethodHead
+}
+
+// callBody is what is sent as body of req
+func callBody(req ScheduleRequest) string {
+    if !hasBody(req) {
+        return ""
+    }
+    return req.Payload
+}
+
 func (d *dispatcher) finalizeCall(results <-chan sendResult) {
     for res := range results {
         req := res.req
-        if res.success || !isValidForRetry(req){
-            d.store.Delete(req)
+        d.store.AddAttempt(req.Id, res.attempt)
+        if res.success {
+            d.store.Done(req)
+        } else if next, ok := d.retryPolicyOf(req).Retry(req, d.now()); ok {
+            d.store.Update(next)
         } else {
-            req.SendAfter += req.BackOffMs
-            req.MaxRetry -= 1
-            d.store.Update(req)
+            d.store.DeadLetter(req, deadReason(req))
         }
     }
 }
 
+// retryPolicyOf returns policy of req, fixed for unknown ones
+func (d *dispatcher) retryPolicyOf(req ScheduleRequest) RetryPolicy {
+    if p, ok := d.retries[req.RetryPolicy]; ok {
+        return p
+    }
+    return d.retries[RetryFixed]
+}
+
 func (d *dispatcher) Shutdown() error {
     log.Println("Shutdown dispatcher...")
     atomic.StoreInt32(&d.stopSingal, 1)
@@ -4,8 +4,12 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/kucicm/boomerang/src/verify"
 )
 
 var testDispatcher *dispatcher
@@ -24,7 +28,13 @@ func (s *mockStorage) Load(bs uint) []ScheduleRequest {
 func (s *mockStorage) Update(ScheduleRequest) {
 }
 
-func (s *mockStorage) Delete(ScheduleRequest) {
+func (s *mockStorage) Done(ScheduleRequest) {
+}
+
+func (s *mockStorage) AddAttempt(uint64, Attempt) {
+}
+
+func (s *mockStorage) DeadLetter(ScheduleRequest, string) {
 }
 
 func init() {
@@ -145,3 +155,346 @@ func TestCallHttpWithHeaders(t *testing.T) {
     }
 }
 
+
+func TestCallHttpMethodAndQuery(t *testing.T) {
+    type call struct {
+        method string
+        query string
+        contentType string
+        body string
+    }
+    calls := make(chan call, 1)
+    srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+        body, err := io.ReadAll(r.Body)
+        if err != nil {
+            t.Error(err)
+        }
+        calls <- call{r.Method, r.URL.RawQuery, r.Header.Get("Content-Type"), string(body)}
+    }))
+    defer srv.Close()
+
+    reqs := []struct {
+        req ScheduleRequest
+        expected call
+    }{
+        {
+            ScheduleRequest{Endpoint: srv.URL + "?a=1", Method: http.MethodGet, Query: map[string]string{"b": "2"}},
+            call{http.MethodGet, "a=1&b=2", "", ""},
+        },
+        {
+            ScheduleRequest{Endpoint: srv.URL, Method: http.MethodPut, Payload: `{"a":1}`, ContentType: "application/json"},
+            call{http.MethodPut, "", "application/json", `{"a":1}`},
+        },
+    }
+
+    for _, test := range reqs {
+        ms.ret = []ScheduleRequest{test.req}
+
+        select {
+        case got := <-calls:
+            if got != test.expected {
+                t.Errorf("expected call %+v got %+v", test.expected, got)
+            }
+        case <-time.After(2 * time.Second):
+            t.Error("timoute, endpoint not called in 2 seconds")
+        }
+    }
+}
+
+type recordingStorage struct {
+    mockStorage
+    mu sync.Mutex
+    updated []ScheduleRequest
+    done []ScheduleRequest
+    dead map[uint64]string
+}
+
+func (s *recordingStorage) Update(req ScheduleRequest) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.updated = append(s.updated, req)
+}
+
+func (s *recordingStorage) Done(req ScheduleRequest) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.done = append(s.done, req)
+}
+
+func (s *recordingStorage) DeadLetter(req ScheduleRequest, reason string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.dead == nil {
+        s.dead = make(map[uint64]string)
+    }
+    s.dead[req.Id] = reason
+}
+
+func TestHostConcurrency(t *testing.T) {
+    var inFlight, maxInFlight int32
+    release := make(chan struct{})
+    slow := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+        n := atomic.AddInt32(&inFlight, 1)
+        for {
+            max := atomic.LoadInt32(&maxInFlight)
+            if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+                break
+            }
+        }
+        <-release
+        atomic.AddInt32(&inFlight, -1)
+    }))
+    defer slow.Close()
+
+    fast := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+    defer fast.Close()
+
+    store := &recordingStorage{}
+    d := newDispatcher(DispatcherCfg{MaxConcurrency: 10, MaxHostConcurrency: 2, DeferMs: 1_000}, store)
+
+    batch := []ScheduleRequest{{Id: 1, Endpoint: slow.URL}, {Id: 2, Endpoint: slow.URL}, {Id: 3, Endpoint: slow.URL}}
+    batch = append(batch, ScheduleRequest{Id: 4, Endpoint: fast.URL + "/hook"}, ScheduleRequest{Id: 5, Endpoint: slow.URL})
+    before := uint64(time.Now().UnixMilli())
+    results := d.sendBatch(batch)
+
+    store.mu.Lock()
+    if len(store.updated) != 2 || store.updated[0].Id != 3 || store.updated[1].Id != 5 || store.updated[0].SendAfter < before + 1_000 {
+        t.Errorf("expected jobs over host limit to be deferred got %+v", store.updated)
+    }
+    store.mu.Unlock()
+
+    close(release)
+    d.finalizeCall(results)
+
+    if maxInFlight > 2 {
+        t.Errorf("expected at most 2 calls in flight to slow host got %d", maxInFlight)
+    }
+
+    if len(store.done) != 3 {
+        t.Errorf("expected calls within limit and to other host to be done got %+v", store.done)
+    }
+
+    if !d.hosts.acquire(HostOf(slow.URL)) || !d.hosts.acquire(HostOf(slow.URL)) {
+        t.Error("expected host slots to be released after calls")
+    }
+}
+
+func TestRateLimitDefers(t *testing.T) {
+    var calls int32
+    srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+        atomic.AddInt32(&calls, 1)
+    }))
+    defer srv.Close()
+
+    store := &recordingStorage{}
+    d := newDispatcher(DispatcherCfg{
+        MaxConcurrency: 10,
+        MaxHostConcurrency: 10,
+        DeferMs: 60_000,
+        RateLimits: []RateLimit{{Host: HostOf(srv.URL), PerSecond: 10, Burst: 2}},
+    }, store)
+
+    batch := []ScheduleRequest{{Id: 1, Endpoint: srv.URL}, {Id: 2, Endpoint: srv.URL}, {Id: 3, Endpoint: srv.URL}, {Id: 4, Endpoint: srv.URL}}
+    before := uint64(time.Now().UnixMilli())
+    d.finalizeCall(d.sendBatch(batch))
+
+    if calls != 2 || len(store.done) != 2 {
+        t.Errorf("expected burst of 2 calls got %d calls and %+v done", calls, store.done)
+    }
+
+    if len(store.updated) != 2 || store.updated[0].Id != 3 || store.updated[1].Id != 4 {
+        t.Fatalf("expected calls over rate limit to be deferred got %+v", store.updated)
+    }
+
+    first, second := store.updated[0], store.updated[1]
+    if first.SendAfter < before + 50 || first.SendAfter >= before + 1_000 || second.SendAfter <= first.SendAfter {
+        t.Errorf("expected deferred calls to be spread by token interval got %d and %d after %d", first.SendAfter, second.SendAfter, before)
+    }
+
+    if first.MaxRetry != 0 || second.MaxRetry != 0 {
+        t.Error("expected deferral not to count as a retry")
+    }
+
+    if len(d.hosts.inFlight) != 0 {
+        t.Errorf("expected host slots of deferred calls to be released got %v", d.hosts.inFlight)
+    }
+}
+
+func TestBreakerDefers(t *testing.T) {
+    var calls int32
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+        atomic.AddInt32(&calls, 1)
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }))
+    defer srv.Close()
+
+    store := &recordingStorage{}
+    d := newDispatcher(DispatcherCfg{MaxConcurrency: 1, Breaker: BreakerCfg{Failures: 2, OpenMs: 60_000, Probes: 1}}, store)
+
+    ttl := uint64(time.Now().Add(time.Hour).UnixMilli())
+    batch := []ScheduleRequest{{Id: 1, Endpoint: srv.URL, MaxRetry: 3, TimeToLive: ttl}, {Id: 2, Endpoint: srv.URL, MaxRetry: 3, TimeToLive: ttl}}
+    d.finalizeCall(d.sendBatch(batch))
+    if calls != 2 || len(store.updated) != 2 || store.updated[0].MaxRetry != 2 {
+        t.Fatalf("expected failed calls to use a retry got %d calls %+v", calls, store.updated)
+    }
+
+    store.updated = nil
+    before := uint64(time.Now().UnixMilli())
+    d.finalizeCall(d.sendBatch([]ScheduleRequest{{Id: 3, Endpoint: srv.URL + "/other", MaxRetry: 3, TimeToLive: ttl}}))
+    if calls != 2 {
+        t.Errorf("expected no call to host with open breaker got %d", calls)
+    }
+
+    if len(store.updated) != 1 || store.updated[0].MaxRetry != 3 || store.updated[0].SendAfter < before + 59_000 {
+        t.Errorf("expected job to be deferred until breaker half opens without using a retry got %+v", store.updated)
+    }
+}
+
+func TestSignedCallback(t *testing.T) {
+    v, _ := verify.NewVerifier("whsec_c2VjcmV0")
+    var verifyErr error
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        _, verifyErr = v.VerifyRequest(r)
+    }))
+    defer srv.Close()
+
+    store := &recordingStorage{}
+    d := newDispatcher(DispatcherCfg{MaxConcurrency: 1, Signing: SigningCfg{Secrets: []string{"whsec_c2VjcmV0"}}}, store)
+    req := ScheduleRequest{Id: 1, Endpoint: srv.URL + "/hook?a=1", Query: map[string]string{"b": "2"}, Payload: `{"x":1}`}
+    d.finalizeCall(d.sendBatch([]ScheduleRequest{req}))
+
+    if len(store.done) != 1 || verifyErr != nil {
+        t.Errorf("expected receiver to verify callback got %v", verifyErr)
+    }
+}
+
+func TestDeadLetterFailedCalls(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+        w.WriteHeader(http.StatusBadGateway)
+    }))
+    defer srv.Close()
+
+    store := &recordingStorage{}
+    d := newDispatcher(DispatcherCfg{MaxConcurrency: 2}, store)
+    ttl := uint64(time.Now().Add(time.Hour).UnixMilli())
+    batch := []ScheduleRequest{
+        {Id: 1, Endpoint: srv.URL, MaxRetry: 1, TimeToLive: ttl},
+        {Id: 2, Endpoint: srv.URL, MaxRetry: 3, TimeToLive: 1},
+        {Id: 3, Endpoint: srv.URL, MaxRetry: 3, TimeToLive: ttl},
+    }
+    d.finalizeCall(d.sendBatch(batch))
+
+    if len(store.dead) != 2 || store.dead[1] != DeadReasonExhausted || store.dead[2] != DeadReasonExpired {
+        t.Errorf("expected exhausted and expired jobs to be dead lettered got %v", store.dead)
+    }
+
+    if len(store.updated) != 1 || store.updated[0].Id != 3 {
+        t.Errorf("expected job with retries left to be retried got %+v", store.updated)
+    }
+}
+
+func TestRetryFromFailedAttempt(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }))
+    defer srv.Close()
+
+    store := &recordingStorage{}
+    d := newDispatcher(DispatcherCfg{MaxConcurrency: 2}, store)
+    now := time.Now()
+    d.now = func() time.Time { return now }
+    at, ttl := uint64(now.UnixMilli()), uint64(now.Add(time.Hour).UnixMilli())
+    batch := []ScheduleRequest{
+        {Id: 1, Endpoint: srv.URL, SendAfter: 1, BackOffMs: 100, MaxRetry: 3, TimeToLive: ttl},
+        {Id: 2, Endpoint: srv.URL, SendAfter: 1, BackOffMs: 100, LastBackOffMs: 400, RetryPolicy: RetryExponential, TimeToLive: ttl},
+    }
+    d.finalizeCall(d.sendBatch(batch))
+
+    got := make(map[uint64]ScheduleRequest)
+    for _, req := range store.updated {
+        got[req.Id] = req
+    }
+
+    if r := got[1]; r.SendAfter != at + 100 || r.MaxRetry != 2 {
+        t.Errorf("expected fixed retry 100ms after the attempt got %+v", r)
+    }
+    if r := got[2]; r.SendAfter != at + 800 || r.LastBackOffMs != 800 {
+        t.Errorf("expected exponential retry to double last backoff got %+v", r)
+    }
+}
+
+// queueStorage loads jobs queued by the test
+type queueStorage struct {
+    recordingStorage
+    queued chan ScheduleRequest
+}
+
+func (s *queueStorage) Load(bs uint) []ScheduleRequest {
+    out := []ScheduleRequest{}
+    for uint(len(out)) < bs {
+        select {
+        case req := <-s.queued:
+            out = append(out, req)
+        default:
+            return out
+        }
+    }
+    return out
+}
+
+func (s *queueStorage) isDone(id uint64) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, req := range s.done {
+        if req.Id == id {
+            return true
+        }
+    }
+    return false
+}
+
+func TestBlockedHostDoesNotHoldOthers(t *testing.T) {
+    arrived, release := make(chan struct{}, 1), make(chan struct{})
+    blocked := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+        arrived <- struct{}{}
+        <-release
+    }))
+    defer blocked.Close()
+
+    called := make(chan struct{}, 1)
+    fast := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+        called <- struct{}{}
+    }))
+    defer fast.Close()
+
+    store := &queueStorage{queued: make(chan ScheduleRequest, 10)}
+    d := newDispatcher(DispatcherCfg{LoadBatchSize: 10, MaxConcurrency: 4, DeferMs: 1_000}, store)
+    d.Start()
+    defer d.Shutdown()
+    defer close(release)
+
+    store.queued <- ScheduleRequest{Id: 1, Endpoint: blocked.URL}
+    select {
+    case <-arrived:
+    case <-time.After(3 * time.Second):
+        t.Fatal("blocked host not called in 3 seconds")
+    }
+
+    store.queued <- ScheduleRequest{Id: 2, Endpoint: fast.URL}
+    select {
+    case <-called:
+    case <-time.After(3 * time.Second):
+        t.Fatal("other host not called in 3 seconds while blocked host is in flight")
+    }
+
+    deadline := time.Now().Add(2 * time.Second)
+    for !store.isDone(2) && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if !store.isDone(2) {
+        t.Error("call to other host not finalized while blocked host is in flight")
+    }
+    if store.isDone(1) {
+        t.Error("blocked call finalized before it finished")
+    }
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/kucicm/boomerang/src/pb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+type grpcStore interface {
+    store
+    jobStore
+    List(filter ListFilter) ([]Job, error)
+}
+
+type schedulerServer struct {
+    pb.UnimplementedSchedulerServer
+    accepter *accepter
+    store grpcStore
+}
+
+// NewGrpcServer serves the Scheduler service from the same store as the
+// http handlers, with reflection enabled for tools like grpcurl. Every call
+// is checked by auth the same way as http requests.
+func NewGrpcServer(cfg AccepterCfg, store grpcStore, auth *authenticator) *grpc.Server {
+    log.Println("gRPC server init")
+    var opts []grpc.ServerOption
+    if auth.cfg.Enabled {
+        opts = append(opts, grpc.UnaryInterceptor(auth.unaryInterceptor), grpc.StreamInterceptor(auth.streamInterceptor))
+    }
+    s := grpc.NewServer(opts...)
+    pb.RegisterSchedulerServer(s, &schedulerServer{accepter: NewAccepter(cfg, store), store: store})
+    reflection.Register(s)
+    return s
+}
+
+func (s *schedulerServer) Schedule(ctx context.Context, in *pb.ScheduleRequest) (*pb.ScheduleResponse, error) {
+    req, errs := s.accepter.prepare(fromPbRequest(in))
+    if len(errs) > 0 {
+        return nil, invalidArgument(errs)
+    }
+
+    req = s.accepter.withOwner(req, TenantFrom(ctx), "")
+    id, err := s.store.Save(req)
+    if errors.Is(err, ErrDuplicateRequest) {
+        job, err := s.store.Get(id)
+        if err != nil {
+            return nil, status.Errorf(codes.Internal, "cannot load job %d %v", id, err)
+        }
+        return &pb.ScheduleResponse{Id: id, Duplicate: true, ScheduledFor: job.Request.SendAfter, ExpiresAt: job.Request.TimeToLive}, nil
+    }
+
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot save schedule request %v", err)
+    }
+    return &pb.ScheduleResponse{Id: id, ScheduledFor: req.SendAfter, ExpiresAt: req.TimeToLive}, nil
+}
+
+func (s *schedulerServer) BatchSchedule(ctx context.Context, in *pb.BatchScheduleRequest) (*pb.BatchScheduleResponse, error) {
+    if len(in.Requests) == 0 {
+        return nil, status.Error(codes.InvalidArgument, "batch is empty")
+    }
+
+    if max := s.accepter.cfg.MaxBatchSize; max > 0 && len(in.Requests) > max {
+        return nil, status.Errorf(codes.InvalidArgument, "batch of %d requests is over limit of %d", len(in.Requests), max)
+    }
+
+    out := &pb.BatchScheduleResponse{Items: make([]*pb.BatchScheduleItem, len(in.Requests))}
+    reqs := make([]ScheduleRequest, 0, len(in.Requests))
+    positions := make([]int, 0, len(in.Requests))
+    for i, r := range in.Requests {
+        req, errs := s.accepter.prepare(fromPbRequest(r))
+        if len(errs) > 0 {
+            out.Items[i] = &pb.BatchScheduleItem{Errors: toPbErrors(errs)}
+            continue
+        }
+        reqs = append(reqs, s.accepter.withOwner(req, TenantFrom(ctx), ""))
+        positions = append(positions, i)
+    }
+
+    ids, errs := s.accepter.saveBatch(reqs)
+    for j, i := range positions {
+        switch {
+        case errors.Is(errs[j], ErrDuplicateRequest):
+            out.Items[i] = &pb.BatchScheduleItem{Id: ids[j], Duplicate: true}
+            if job, err := s.store.Get(ids[j]); err == nil {
+                out.Items[i].ScheduledFor, out.Items[i].ExpiresAt = job.Request.SendAfter, job.Request.TimeToLive
+            } else {
+                log.Printf("Cannot load job %d of duplicate request %v\n", ids[j], err)
+            }
+        case errs[j] != nil:
+            out.Items[i] = &pb.BatchScheduleItem{Error: errs[j].Error()}
+        default:
+            out.Items[i] = &pb.BatchScheduleItem{Id: ids[j], ScheduledFor: reqs[j].SendAfter, ExpiresAt: reqs[j].TimeToLive}
+        }
+    }
+    return out, nil
+}
+
+func (s *schedulerServer) Get(ctx context.Context, in *pb.GetRequest) (*pb.Job, error) {
+    job, err := tenantJob(s.store, TenantFrom(ctx), in.Id)
+    if err != nil {
+        return nil, toStatus(in.Id, err)
+    }
+    return toPbJob(job), nil
+}
+
+func (s *schedulerServer) Cancel(ctx context.Context, in *pb.CancelRequest) (*pb.CancelResponse, error) {
+    if _, err := tenantJob(s.store, TenantFrom(ctx), in.Id); err != nil {
+        return nil, toStatus(in.Id, err)
+    }
+
+    if err := s.store.Cancel(in.Id); err != nil {
+        return nil, toStatus(in.Id, err)
+    }
+    return &pb.CancelResponse{}, nil
+}
+
+func (s *schedulerServer) List(ctx context.Context, in *pb.ListRequest) (*pb.ListResponse, error) {
+    limit := int(in.Limit)
+    if limit <= 0 || limit > 1000 {
+        limit = 1000
+    }
+
+    jobs, err := s.store.List(ListFilter{Tenant: TenantFrom(ctx), Status: in.Status, AfterId: in.AfterId, Limit: limit})
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "cannot list jobs %v", err)
+    }
+
+    out := &pb.ListResponse{Jobs: make([]*pb.Job, len(jobs))}
+    for i, job := range jobs {
+        out.Jobs[i] = toPbJob(job)
+    }
+    if len(jobs) == limit {
+        out.NextAfterId = jobs[len(jobs) - 1].Request.Id
+    }
+    return out, nil
+}
+
+// invalidArgument carries field errors as BadRequest details
+func invalidArgument(errs ValidationErrors) error {
+    st := status.New(codes.InvalidArgument, errs.Error())
+    details := &errdetails.BadRequest{}
+    for _, e := range errs {
+        details.FieldViolations = append(details.FieldViolations, &errdetails.BadRequest_FieldViolation{
+            Field: e.Field,
+            Description: e.Code + ": " + e.Message,
+        })
+    }
+
+    if withDetails, err := st.WithDetails(details); err == nil {
+        st = withDetails
+    }
+    return st.Err()
+}
+
+func toStatus(id uint64, err error) error {
+    switch {
+    case errors.Is(err, ErrJobNotFound):
+        return status.Errorf(codes.NotFound, "job %d not found", id)
+    case errors.Is(err, ErrJobNotPending):
+        return status.Errorf(codes.FailedPrecondition, "job %d %v", id, err)
+    default:
+        return status.Errorf(codes.Internal, "job %d %v", id, err)
+    }
+}
+
+func fromPbRequest(in *pb.ScheduleRequest) SubmitRequest {
+    return SubmitRequest{
+        ScheduleRequest: ScheduleRequest{
+            Endpoint: in.Endpoint,
+            Headers: in.Headers,
+            Payload: string(in.Payload),
+            SendAfter: in.SendAfter,
+            MaxRetry: int(in.MaxRetry),
+            BackOffMs: in.BackOffMs,
+            TimeToLive: in.TimeToLive,
+            IdempotencyKey: in.IdempotencyKey,
+            Method: in.Method,
+            Query: in.Query,
+            ContentType: in.ContentType,
+            RetryPolicy: in.RetryPolicy,
+            MaxBackOffMs: in.MaxBackOffMs,
+        },
+        Delay: in.Delay,
+        SendAt: in.SendAt,
+        Ttl: in.Ttl,
+        Backoff: in.Backoff,
+        MaxBackoff: in.MaxBackoff,
+    }
+}
+
+func toPbJob(job Job) *pb.Job {
+    r := job.Request
+    out := &pb.Job{
+        Id: r.Id,
+        Status: job.Status,
+        Request: &pb.ScheduleRequest{
+            Endpoint: r.Endpoint,
+            Headers: r.Headers,
+            Payload: []byte(r.Payload),
+            SendAfter: r.SendAfter,
+            MaxRetry: int32(r.MaxRetry),
+            BackOffMs: r.BackOffMs,
+            TimeToLive: r.TimeToLive,
+            IdempotencyKey: r.IdempotencyKey,
+            Method: r.CallMethod(),
+            Query: r.Query,
+            ContentType: r.ContentType,
+            RetryPolicy: r.RetryPolicy,
+            MaxBackOffMs: r.MaxBackOffMs,
+        },
+        RemainingRetries: int32(remainingRetries(r)),
+        Version: job.Version,
+    }
+
+    if !job.CancelledAt.IsZero() {
+        out.CancelledAt = uint64(job.CancelledAt.UnixMilli())
+    }
+
+    for _, a := range job.Attempts {
+        out.Attempts = append(out.Attempts, &pb.Attempt{
+            At: uint64(a.At.UnixMilli()),
+            StatusCode: int32(a.StatusCode),
+            LatencyMs: a.LatencyMs,
+            Error: a.Error,
+        })
+    }
+    return out
+}
+
+func toPbErrors(errs ValidationErrors) []*pb.FieldError {
+    out := make([]*pb.FieldError, len(errs))
+    for i, e := range errs {
+        out[i] = &pb.FieldError{Field: e.Field, Code: e.Code, Message: e.Message}
+    }
+    return out
+}
+
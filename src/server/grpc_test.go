@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/kucicm/boomerang/src/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type mockGrpcStore struct {
+    mockStore
+    mockJobStore
+}
+
+func (s *mockGrpcStore) Get(id uint64) (Job, error) {
+    return s.mockJobStore.Get(id)
+}
+
+func (s *mockGrpcStore) List(filter ListFilter) ([]Job, error) {
+    var out []Job
+    for id := filter.AfterId + 1; len(out) < filter.Limit && id <= uint64(len(s.jobs)); id++ {
+        job := s.jobs[id]
+        if (filter.Tenant == "" || tenantOf(job) == filter.Tenant) && (filter.Status == "" || job.Status == filter.Status) {
+            out = append(out, job)
+        }
+    }
+    return out, nil
+}
+
+func newTestGrpcClient(t *testing.T, store *mockGrpcStore, auth *authenticator) pb.SchedulerClient {
+    lis := bufconn.Listen(1 << 20)
+    srv := NewGrpcServer(AccepterCfg{MaxBatchSize: 10}, store, auth)
+    go srv.Serve(lis)
+    t.Cleanup(srv.Stop)
+
+    conn, err := grpc.Dial("bufnet",
+        grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+        grpc.WithTransportCredentials(insecure.NewCredentials()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    return pb.NewSchedulerClient(conn)
+}
+
+func TestGrpcSchedule(t *testing.T) {
+    store := &mockGrpcStore{}
+    client := newTestGrpcClient(t, store, NewAuthenticator(AuthCfg{}, nil))
+    ctx := context.Background()
+
+    resp, err := client.Schedule(ctx, &pb.ScheduleRequest{Endpoint: "http://example.com", Payload: []byte{0, 1}, Ttl: "1h"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if resp.Id != 42 || resp.ExpiresAt != resp.ScheduledFor + 3_600_000 {
+        t.Errorf("unexpected schedule response %+v", resp)
+    }
+
+    if store.item.Payload != "\x00\x01" {
+        t.Errorf("expected exact payload bytes to be saved got %q", store.item.Payload)
+    }
+
+    _, err = client.Schedule(ctx, &pb.ScheduleRequest{
+        Endpoint: "http://example.com", Ttl: "1h", Backoff: "1s", RetryPolicy: RetryExponential, MaxBackoff: "1m"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if store.item.RetryPolicy != RetryExponential || store.item.MaxBackOffMs != 60_000 {
+        t.Errorf("expected retry policy and max back off to be saved got %+v", store.item)
+    }
+
+    _, err = client.Schedule(ctx, &pb.ScheduleRequest{Endpoint: "http://example.com", Ttl: "1h", RetryPolicy: "random"})
+    if status.Code(err) != codes.InvalidArgument {
+        t.Errorf("expected unknown retry policy to be invalid argument got %v", err)
+    }
+
+    _, err = client.Schedule(ctx, &pb.ScheduleRequest{Endpoint: "http://example.com", Ttl: "1h", MaxBackoff: "1m", MaxBackOffMs: 5})
+    if status.Code(err) != codes.InvalidArgument {
+        t.Errorf("expected max backoff with max back off ms to be invalid argument got %v", err)
+    }
+
+    _, err = client.Schedule(ctx, &pb.ScheduleRequest{Endpoint: "ftp://example.com"})
+    if status.Code(err) != codes.InvalidArgument {
+        t.Errorf("expected invalid argument got %v", err)
+    }
+
+    batch, err := client.BatchSchedule(ctx, &pb.BatchScheduleRequest{Requests: []*pb.ScheduleRequest{
+        {Endpoint: "http://example.com", Ttl: "1h"},
+        {Endpoint: ""},
+    }})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(batch.Items) != 2 || batch.Items[0].Id != 42 || len(batch.Items[1].Errors) == 0 {
+        t.Errorf("unexpected batch response %+v", batch.Items)
+    }
+
+    store.jobs = map[uint64]Job{42: {Request: ScheduleRequest{Id: 42, SendAfter: 5_000, TimeToLive: 9_000}}}
+    batch, err = client.BatchSchedule(ctx, &pb.BatchScheduleRequest{Requests: []*pb.ScheduleRequest{
+        {Endpoint: "http://example.com", Ttl: "1h", IdempotencyKey: "key-1"},
+        {Endpoint: "http://example.com", Ttl: "1h", IdempotencyKey: "key-1"},
+    }})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    dup := batch.Items[1]
+    if !dup.Duplicate || dup.Id != 42 || dup.ScheduledFor != 5_000 || dup.ExpiresAt != 9_000 {
+        t.Errorf("expected duplicate with times of stored job got %+v", dup)
+    }
+}
+
+func TestGrpcJobs(t *testing.T) {
+    store := &mockGrpcStore{mockJobStore: mockJobStore{jobs: map[uint64]Job{
+        1: {Request: ScheduleRequest{Id: 1, Endpoint: "http://a", MaxRetry: 3, RetryPolicy: RetryLinear, MaxBackOffMs: 5_000},
+            Status: StatusInitial, Attempts: []Attempt{{StatusCode: 503}}},
+        2: {Request: ScheduleRequest{Id: 2, Endpoint: "http://b"}, Status: StatusDone},
+        3: {Request: ScheduleRequest{Id: 3, Endpoint: "http://c"}, Status: StatusInitial},
+    }}}
+    client := newTestGrpcClient(t, store, NewAuthenticator(AuthCfg{}, nil))
+    ctx := context.Background()
+
+    job, err := client.Get(ctx, &pb.GetRequest{Id: 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if job.Id != 1 || job.Status != StatusInitial || job.RemainingRetries != 2 || len(job.Attempts) != 1 || job.Request.Method != "POST" {
+        t.Errorf("unexpected job %+v", job)
+    }
+
+    if job.Request.RetryPolicy != RetryLinear || job.Request.MaxBackOffMs != 5_000 {
+        t.Errorf("expected retry policy and max back off of job got %+v", job.Request)
+    }
+
+    if _, err := client.Get(ctx, &pb.GetRequest{Id: 9}); status.Code(err) != codes.NotFound {
+        t.Errorf("expected not found got %v", err)
+    }
+
+    if _, err := client.Cancel(ctx, &pb.CancelRequest{Id: 1}); err != nil || len(store.cancelled) != 1 {
+        t.Errorf("expected job to be cancelled got %v", err)
+    }
+
+    if _, err := client.Cancel(ctx, &pb.CancelRequest{Id: 2}); status.Code(err) != codes.FailedPrecondition {
+        t.Errorf("expected failed precondition got %v", err)
+    }
+
+    page, err := client.List(ctx, &pb.ListRequest{Status: StatusInitial, Limit: 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(page.Jobs) != 1 || page.Jobs[0].Id != 1 || page.NextAfterId != 1 {
+        t.Fatalf("unexpected first page %+v", page)
+    }
+
+    page, err = client.List(ctx, &pb.ListRequest{Status: StatusInitial, AfterId: page.NextAfterId, Limit: 1})
+    if err != nil || len(page.Jobs) != 1 || page.Jobs[0].Id != 3 {
+        t.Errorf("unexpected second page %+v %v", page, err)
+    }
+}
@@ -0,0 +1,389 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+    jobsSummary = promauto.NewSummaryVec(
+        prometheus.SummaryOpts{
+            Name: "boomerang_jobs_request",
+            Help: "boomerang_jobs_request",
+        },
+        []string{"method", "status"},
+    )
+)
+
+var (
+    ErrJobNotFound = errors.New("job not found")
+    ErrJobNotPending = errors.New("job is not pending")
+    ErrVersionMismatch = errors.New("job version mismatch")
+)
+
+// names from schedule.status
+const (
+    StatusInitial = "Initial"
+    StatusRunning = "Running"
+    StatusDone = "Done"
+    StatusCancelled = "Cancelled"
+)
+
+type Attempt struct {
+    At time.Time `json:"at"`
+    StatusCode int `json:"statusCode"`
+    LatencyMs int64 `json:"latencyMs"`
+    Error string `json:"error,omitempty"`
+}
+
+type Job struct {
+    Request ScheduleRequest
+    Status string
+    Attempts []Attempt
+    CancelledAt time.Time
+    Version uint64
+}
+
+// ListFilter selects jobs with id after AfterId, ordered by id. Empty
+// Tenant or Status matches every tenant or status.
+type ListFilter struct {
+    Tenant string
+    Status string
+    AfterId uint64
+    Limit int
+}
+
+// JobPatch holds fields of a pending job which can be changed, nil fields
+// are left as they are.
+type JobPatch struct {
+    SendAfter *uint64 `json:"sendAfter"`
+    TimeToLive *uint64 `json:"TimeToLive"`
+    Headers *map[string]string `json:"headers"`
+    Payload *string `json:"payload"`
+    MaxRetry *int `json:"maxRetry"`
+    BackOffMs *uint64 `json:"backOffMs"`
+}
+
+func (p JobPatch) Apply(req *ScheduleRequest) {
+    if p.SendAfter != nil {
+        req.SendAfter = *p.SendAfter
+    }
+    if p.TimeToLive != nil {
+        req.TimeToLive = *p.TimeToLive
+    }
+    if p.Headers != nil {
+        req.Headers = *p.Headers
+    }
+    if p.Payload != nil {
+        req.Payload = *p.Payload
+    }
+    if p.MaxRetry != nil {
+        req.MaxRetry = *p.MaxRetry
+    }
+    if p.BackOffMs != nil {
+        req.BackOffMs = *p.BackOffMs
+    }
+}
+
+func (p JobPatch) empty() bool {
+    return p == JobPatch{}
+}
+
+type JobResponse struct {
+    Id uint64 `json:"id"`
+    Status string `json:"status"`
+    Request ScheduleRequest `json:"request"`
+    PayloadBase64 string `json:"payloadBase64,omitempty"`
+    RemainingRetries int `json:"remainingRetries"`
+    NextSendAfter time.Time `json:"nextSendAfter"`
+    ExpiresAt time.Time `json:"expiresAt"`
+    Attempts []Attempt `json:"attempts"`
+    CancelledAt *time.Time `json:"cancelledAt,omitempty"`
+    Version uint64 `json:"version"`
+}
+
+type jobStore interface {
+    Get(id uint64) (Job, error)
+    Cancel(id uint64) error
+    // Patch changes a pending job, version 0 skips the version check
+    Patch(id uint64, version uint64, patch JobPatch) (Job, error)
+}
+
+type jobsHandler struct {
+    store jobStore
+    maxBodyBytes int64
+    validator validator
+}
+
+// NewJobsHandler serves /jobs/{id}, patched jobs are held to the same
+// limits as submitted ones
+func NewJobsHandler(cfg AccepterCfg, store jobStore) *jobsHandler {
+    log.Println("Jobs handler init")
+    return &jobsHandler{store, cfg.MaxBodyBytes, validator{cfg.MaxPayloadBytes, time.Now}}
+}
+
+// ServeHTTP handles /jobs/{id}
+func (h *jobsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var status = "ok"
+    defer func(start time.Time) {
+        jobsSummary.WithLabelValues(r.Method, status).Observe(float64(time.Since(start).Nanoseconds()))
+    }(time.Now())
+
+    id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/jobs/"), 10, 64)
+    if err != nil {
+        w.WriteHeader(http.StatusNotFound)
+        fmt.Fprintf(w, "Invalid job id %s", r.URL.Path)
+        status = "invalid id"
+        return
+    }
+
+    tenant := TenantFrom(r.Context())
+    switch r.Method {
+    case http.MethodGet:
+        status = h.get(w, tenant, id)
+    case http.MethodDelete:
+        status = h.cancel(w, tenant, id)
+    case http.MethodPatch:
+        status = h.patch(w, r, tenant, id)
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        status = "invalid method"
+    }
+}
+
+// tenantOf is tenant which owns job, jobs saved before tenants existed
+// belong to the default one
+func tenantOf(job Job) string {
+    if job.Request.Tenant == "" {
+        return DefaultTenant
+    }
+    return job.Request.Tenant
+}
+
+// tenantJob loads a job only when it belongs to tenant, jobs of other
+// tenants are not found so their ids do not leak.
+func tenantJob(store jobStore, tenant string, id uint64) (Job, error) {
+    job, err := store.Get(id)
+    if err != nil {
+        return job, err
+    }
+
+    if tenantOf(job) != tenant {
+        return Job{}, ErrJobNotFound
+    }
+    return job, nil
+}
+
+func (h *jobsHandler) get(w http.ResponseWriter, tenant string, id uint64) string {
+    job, err := tenantJob(h.store, tenant, id)
+    if errors.Is(err, ErrJobNotFound) {
+        w.WriteHeader(http.StatusNotFound)
+        fmt.Fprintf(w, "Job %d not found", id)
+        return "not found"
+    }
+
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        fmt.Fprintf(w, "Cannot load job %d %v", id, err)
+        log.Printf("Error loading job %d %v\n", id, err)
+        return "load fail"
+    }
+
+    w.Header().Set("ETag", etag(job.Version))
+    writeJSON(w, http.StatusOK, newJobResponse(job))
+    return "ok"
+}
+
+// patch changes a job which was not claimed yet, If-Match with the ETag
+// from GET makes sure nobody changed it in between.
+func (h *jobsHandler) patch(w http.ResponseWriter, r *http.Request, tenant string, id uint64) string {
+    version, err := parseIfMatch(r.Header.Get("If-Match"))
+    if err != nil {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprintf(w, "Invalid If-Match header %v", err)
+        return "invalid version"
+    }
+
+    body, ok := readBody(w, r, h.maxBodyBytes)
+    if !ok {
+        return "invalid body"
+    }
+
+    var patch JobPatch
+    decoder := json.NewDecoder(bytes.NewReader(body))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(&patch); err != nil {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprintf(w, "Cannot parse patch body %v", err)
+        return "invalid request"
+    }
+
+    if patch.empty() {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprint(w, "Patch does not change any field")
+        return "invalid request"
+    }
+
+    job, errs, err := h.validPatch(tenant, id, version, patch)
+    if len(errs) > 0 {
+        writeJSON(w, http.StatusBadRequest, ValidationResponse{errs})
+        return "invalid request"
+    }
+
+    switch {
+    case errors.Is(err, ErrJobNotFound):
+        w.WriteHeader(http.StatusNotFound)
+        fmt.Fprintf(w, "Job %d not found", id)
+        return "not found"
+    case errors.Is(err, ErrJobNotPending), errors.Is(err, ErrVersionMismatch) && version == 0:
+        w.WriteHeader(http.StatusConflict)
+        fmt.Fprintf(w, "Cannot patch job %d %v", id, err)
+        return "conflict"
+    case errors.Is(err, ErrVersionMismatch):
+        w.WriteHeader(http.StatusPreconditionFailed)
+        fmt.Fprintf(w, "Cannot patch job %d %v", id, err)
+        return "version mismatch"
+    case err != nil:
+        w.WriteHeader(http.StatusInternalServerError)
+        fmt.Fprintf(w, "Cannot patch job %d %v", id, err)
+        log.Printf("Error patching job %d %v\n", id, err)
+        return "patch fail"
+    }
+
+    w.Header().Set("ETag", etag(job.Version))
+    writeJSON(w, http.StatusOK, newJobResponse(job))
+    return "ok"
+}
+
+// patchRetries is how often a patch without If-Match is validated again
+// when the job changed between load and patch
+const patchRetries = 3
+
+// validPatch patches job when the patched request is valid. The patch is
+// stored only on the version it was validated against so concurrent patches
+// cannot add up to an invalid job, without If-Match it is retried on the
+// newer version.
+func (h *jobsHandler) validPatch(tenant string, id uint64, version uint64, patch JobPatch) (Job, ValidationErrors, error) {
+    for i := 0; ; i++ {
+        job, err := tenantJob(h.store, tenant, id)
+        if err != nil {
+            return job, nil, err
+        }
+
+        req := job.Request
+        patch.Apply(&req)
+        if errs := h.validator.validate(req); len(errs) > 0 {
+            return job, errs, nil
+        }
+
+        expected := version
+        if expected == 0 {
+            expected = job.Version
+        }
+        job, err = h.store.Patch(id, expected, patch)
+        if version != 0 || i == patchRetries || !errors.Is(err, ErrVersionMismatch) {
+            return job, nil, err
+        }
+    }
+}
+
+// cancel stops a job which was not sent yet, jobs which are already
+// claimed by dispatcher or finished are a conflict.
+func (h *jobsHandler) cancel(w http.ResponseWriter, tenant string, id uint64) string {
+    _, err := tenantJob(h.store, tenant, id)
+    if err == nil {
+        err = h.store.Cancel(id)
+    }
+    if errors.Is(err, ErrJobNotFound) {
+        w.WriteHeader(http.StatusNotFound)
+        fmt.Fprintf(w, "Job %d not found", id)
+        return "not found"
+    }
+
+    if errors.Is(err, ErrJobNotPending) {
+        w.WriteHeader(http.StatusConflict)
+        fmt.Fprintf(w, "Cannot cancel job %d %v", id, err)
+        return "conflict"
+    }
+
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        fmt.Fprintf(w, "Cannot cancel job %d %v", id, err)
+        log.Printf("Error cancelling job %d %v\n", id, err)
+        return "cancel fail"
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+    return "ok"
+}
+
+func newJobResponse(job Job) JobResponse {
+    attempts := job.Attempts
+    if attempts == nil {
+        attempts = []Attempt{}
+    }
+
+    var cancelledAt *time.Time
+    if !job.CancelledAt.IsZero() {
+        cancelledAt = &job.CancelledAt
+    }
+
+    req, payloadBase64 := jsonPayload(job.Request)
+
+    return JobResponse{
+        Id: job.Request.Id,
+        Status: job.Status,
+        Request: req,
+        PayloadBase64: payloadBase64,
+        RemainingRetries: remainingRetries(job.Request),
+        NextSendAfter: time.UnixMilli(int64(job.Request.SendAfter)).UTC(),
+        ExpiresAt: time.UnixMilli(int64(job.Request.TimeToLive)).UTC(),
+        Attempts: attempts,
+        CancelledAt: cancelledAt,
+        Version: job.Version,
+    }
+}
+
+// jsonPayload moves binary payload of req to base64 since it would not
+// survive as a JSON string
+func jsonPayload(req ScheduleRequest) (ScheduleRequest, string) {
+    if utf8.ValidString(req.Payload) {
+        return req, ""
+    }
+    payload := base64.StdEncoding.EncodeToString([]byte(req.Payload))
+    req.Payload = ""
+    return req, payload
+}
+
+func etag(version uint64) string {
+    return fmt.Sprintf("\"%d\"", version)
+}
+
+// parseIfMatch returns version from If-Match header, 0 when any version matches
+func parseIfMatch(header string) (uint64, error) {
+    header = strings.TrimPrefix(strings.TrimSpace(header), "W/")
+    if header == "" || header == "*" {
+        return 0, nil
+    }
+    return strconv.ParseUint(strings.Trim(header, "\""), 10, 64)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    if err := json.NewEncoder(w).Encode(v); err != nil {
+        log.Printf("Error writing response %v\n", err)
+    }
+}
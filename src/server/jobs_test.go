@@ -0,0 +1,360 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockJobStore struct {
+    jobs map[uint64]Job
+    returnErr error
+    cancelled []uint64
+}
+
+func (s *mockJobStore) Get(id uint64) (Job, error) {
+    if s.returnErr != nil {
+        return Job{}, s.returnErr
+    }
+
+    job, ok := s.jobs[id]
+    if !ok {
+        return Job{}, ErrJobNotFound
+    }
+    return job, nil
+}
+
+func (s *mockJobStore) Cancel(id uint64) error {
+    if s.returnErr != nil {
+        return s.returnErr
+    }
+
+    job, ok := s.jobs[id]
+    if !ok {
+        return ErrJobNotFound
+    }
+
+    if job.Status != StatusInitial {
+        return ErrJobNotPending
+    }
+    s.cancelled = append(s.cancelled, id)
+    return nil
+}
+
+func (s *mockJobStore) Patch(id uint64, version uint64, patch JobPatch) (Job, error) {
+    job, ok := s.jobs[id]
+    if !ok {
+        return Job{}, ErrJobNotFound
+    }
+
+    if job.Status != StatusInitial {
+        return Job{}, ErrJobNotPending
+    }
+
+    if version != 0 && version != job.Version {
+        return Job{}, ErrVersionMismatch
+    }
+
+    patch.Apply(&job.Request)
+    job.Version++
+    s.jobs[id] = job
+    return job, nil
+}
+
+func TestGetJob(t *testing.T) {
+    at := time.UnixMilli(1_700_000_000_000).UTC()
+    store := &mockJobStore{jobs: map[uint64]Job{
+        7: {
+            Request: ScheduleRequest{Id: 7, Endpoint: "example.com/test", SendAfter: 1_700_000_001_000, MaxRetry: 3, TimeToLive: 1_700_000_100_000},
+            Status: StatusInitial,
+            Attempts: []Attempt{{At: at, StatusCode: 503, LatencyMs: 12}},
+        },
+    }}
+    h := NewJobsHandler(AccepterCfg{}, store)
+
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/jobs/7", nil))
+
+    if rr.Code != http.StatusOK {
+        t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+    }
+
+    var resp JobResponse
+    if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+        t.Fatal(err)
+    }
+
+    if resp.Id != 7 || resp.Status != StatusInitial || resp.RemainingRetries != 2 {
+        t.Errorf("unexpected job response %+v", resp)
+    }
+
+    if resp.NextSendAfter.UnixMilli() != 1_700_000_001_000 {
+        t.Errorf("unexpected next send after %s", resp.NextSendAfter)
+    }
+
+    if len(resp.Attempts) != 1 || resp.Attempts[0].StatusCode != 503 || !resp.Attempts[0].At.Equal(at) {
+        t.Errorf("unexpected attempts %+v", resp.Attempts)
+    }
+}
+
+func TestGetJobBinaryPayload(t *testing.T) {
+    store := &mockJobStore{jobs: map[uint64]Job{
+        1: {Request: ScheduleRequest{Id: 1, Payload: "\x1f\x8b\xff"}, Status: StatusInitial},
+        2: {Request: ScheduleRequest{Id: 2, Payload: `{"a":1}`}, Status: StatusInitial},
+    }}
+    h := NewJobsHandler(AccepterCfg{}, store)
+
+    for id, expected := range map[string][2]string{"1": {"", "H4v/"}, "2": {`{"a":1}`, ""}} {
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/jobs/" + id, nil))
+
+        var resp JobResponse
+        if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+            t.Fatal(err)
+        }
+
+        if resp.Request.Payload != expected[0] || resp.PayloadBase64 != expected[1] {
+            t.Errorf("job %s: expected payload %q base64 %q got %+v", id, expected[0], expected[1], resp)
+        }
+    }
+}
+
+func TestGetJobErrors(t *testing.T) {
+    cases := []struct {
+        path string
+        err error
+        code int
+    }{
+        {"/jobs/1", nil, http.StatusNotFound},
+        {"/jobs/abc", nil, http.StatusNotFound},
+        {"/jobs/1", errors.New("ups"), http.StatusInternalServerError},
+    }
+
+    for _, c := range cases {
+        h := NewJobsHandler(AccepterCfg{}, &mockJobStore{returnErr: c.err})
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, c.path, nil))
+
+        if rr.Code != c.code {
+            t.Errorf("%s with error %v returned %d want %d", c.path, c.err, rr.Code, c.code)
+        }
+    }
+}
+
+func TestCancelJob(t *testing.T) {
+    store := &mockJobStore{jobs: map[uint64]Job{
+        1: {Request: ScheduleRequest{Id: 1}, Status: StatusInitial},
+        2: {Request: ScheduleRequest{Id: 2}, Status: StatusRunning},
+    }}
+    h := NewJobsHandler(AccepterCfg{}, store)
+
+    cases := []struct {
+        path string
+        code int
+    }{
+        {"/jobs/1", http.StatusNoContent},
+        {"/jobs/2", http.StatusConflict},
+        {"/jobs/3", http.StatusNotFound},
+    }
+
+    for _, c := range cases {
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, c.path, nil))
+        if rr.Code != c.code {
+            t.Errorf("cancel %s returned %d want %d", c.path, rr.Code, c.code)
+        }
+    }
+
+    if len(store.cancelled) != 1 || store.cancelled[0] != 1 {
+        t.Errorf("expected only job 1 to be cancelled got %+v", store.cancelled)
+    }
+}
+
+func TestPatchJob(t *testing.T) {
+    ttl := uint64(time.Now().Add(time.Hour).UnixMilli())
+    store := &mockJobStore{jobs: map[uint64]Job{
+        1: {Request: ScheduleRequest{Id: 1, Endpoint: "http://a.com", Payload: "old", MaxRetry: 3, TimeToLive: ttl}, Status: StatusInitial, Version: 4},
+        2: {Request: ScheduleRequest{Id: 2, Endpoint: "http://a.com", TimeToLive: ttl}, Status: StatusRunning, Version: 1},
+    }}
+    h := NewJobsHandler(AccepterCfg{}, store)
+
+    cases := []struct {
+        path string
+        ifMatch string
+        body string
+        code int
+    }{
+        {"/jobs/1", `"3"`, `{"payload": "new"}`, http.StatusPreconditionFailed},
+        {"/jobs/1", `"4"`, `{"payload": "new", "sendAfter": 10}`, http.StatusOK},
+        {"/jobs/1", "", `{"endpoint": "other.com"}`, http.StatusBadRequest},
+        {"/jobs/1", "", `{}`, http.StatusBadRequest},
+        {"/jobs/1", "abc", `{"payload": "new"}`, http.StatusBadRequest},
+        {"/jobs/2", "", `{"payload": "new"}`, http.StatusConflict},
+        {"/jobs/3", "", `{"payload": "new"}`, http.StatusNotFound},
+    }
+
+    for _, c := range cases {
+        req := httptest.NewRequest(http.MethodPatch, c.path, strings.NewReader(c.body))
+        if c.ifMatch != "" {
+            req.Header.Set("If-Match", c.ifMatch)
+        }
+
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, req)
+        if rr.Code != c.code {
+            t.Errorf("patch %s %s %s returned %d want %d", c.path, c.ifMatch, c.body, rr.Code, c.code)
+        }
+    }
+
+    job := store.jobs[1]
+    if job.Request.Payload != "new" || job.Request.SendAfter != 10 || job.Request.MaxRetry != 3 || job.Version != 5 {
+        t.Errorf("unexpected patched job %+v", job)
+    }
+
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/jobs/1", nil))
+    if etag := rr.Header().Get("ETag"); etag != `"5"` {
+        t.Errorf("expected ETag \"5\" got %s", etag)
+    }
+}
+
+func TestPatchJobValidation(t *testing.T) {
+    ttl := uint64(time.Now().Add(time.Hour).UnixMilli())
+    job := Job{Request: ScheduleRequest{Id: 1, Endpoint: "http://a.com", Method: http.MethodGet, SendAfter: 10, TimeToLive: ttl}, Status: StatusInitial}
+    store := &mockJobStore{jobs: map[uint64]Job{1: job}}
+    h := NewJobsHandler(AccepterCfg{MaxBodyBytes: 128, MaxPayloadBytes: 8}, store)
+
+    cases := []struct {
+        body string
+        code int
+        field string
+    }{
+        {`{"maxRetry": -7}`, http.StatusBadRequest, "maxRetry"},
+        {`{"TimeToLive": 1}`, http.StatusBadRequest, "TimeToLive"},
+        {fmt.Sprintf(`{"sendAfter": %d}`, ttl + 1), http.StatusBadRequest, "sendAfter"},
+        {`{"headers": {"X-A\r\nB": "ok"}}`, http.StatusBadRequest, "headers.X-A\r\nB"},
+        {`{"headers": {"X-A": "a\r\nB: b"}}`, http.StatusBadRequest, "headers.X-A"},
+        {`{"payload": "body"}`, http.StatusBadRequest, "payload"},
+        {`{"payload": "` + strings.Repeat("a", 200) + `"}`, http.StatusRequestEntityTooLarge, ""},
+    }
+
+    for _, c := range cases {
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, httptest.NewRequest(http.MethodPatch, "/jobs/1", strings.NewReader(c.body)))
+        if rr.Code != c.code {
+            t.Errorf("patch %s returned %d want %d", c.body, rr.Code, c.code)
+            continue
+        }
+
+        var res ValidationResponse
+        if err := json.NewDecoder(rr.Body).Decode(&res); err != nil || len(res.Errors) != 1 || res.Errors[0].Field != c.field {
+            t.Errorf("patch %s expected error on %q got %+v %v", c.body, c.field, res, err)
+        }
+    }
+
+    if got := store.jobs[1]; got.Version != 0 || got.Request.MaxRetry != 0 || len(got.Request.Headers) != 0 {
+        t.Errorf("expected invalid patches not to be stored got %+v", got)
+    }
+
+    store.jobs[1] = Job{Request: ScheduleRequest{Id: 1, Endpoint: "http://a.com", TimeToLive: ttl}, Status: StatusInitial}
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, httptest.NewRequest(http.MethodPatch, "/jobs/1", strings.NewReader(`{"payload": "too large"}`)))
+    if rr.Code != http.StatusBadRequest {
+        t.Errorf("expected payload over limit to be rejected got %d", rr.Code)
+    }
+
+    if got := store.jobs[1]; got.Version != 0 || got.Request.Payload != "" {
+        t.Errorf("expected payload over limit not to be stored got %+v", got)
+    }
+}
+
+// racingJobStore runs race before patches, like another client patching
+// the job between load and patch
+type racingJobStore struct {
+    mockJobStore
+    race func(s *mockJobStore)
+}
+
+func (s *racingJobStore) Patch(id uint64, version uint64, patch JobPatch) (Job, error) {
+    s.race(&s.mockJobStore)
+    return s.mockJobStore.Patch(id, version, patch)
+}
+
+func TestPatchJobConcurrent(t *testing.T) {
+    ttl := uint64(time.Now().Add(time.Hour).UnixMilli())
+    newStore := func(race func(s *mockJobStore)) *racingJobStore {
+        job := Job{Request: ScheduleRequest{Id: 1, Endpoint: "http://a.com", TimeToLive: ttl}, Status: StatusInitial, Version: 1}
+        return &racingJobStore{mockJobStore{jobs: map[uint64]Job{1: job}}, race}
+    }
+    lowerTtl := func(s *mockJobStore) {
+        if job := s.jobs[1]; job.Request.TimeToLive == ttl {
+            job.Request.TimeToLive, job.Version = ttl - 60_000, job.Version + 1
+            s.jobs[1] = job
+        }
+    }
+    changeAlways := func(s *mockJobStore) {
+        job := s.jobs[1]
+        job.Version++
+        s.jobs[1] = job
+    }
+
+    tests := []struct {
+        race func(s *mockJobStore)
+        body string
+        code int
+    }{
+        // valid alone, after the other patch send after would be past time to live
+        {lowerTtl, fmt.Sprintf(`{"sendAfter": %d}`, ttl - 1_000), http.StatusBadRequest},
+        {lowerTtl, `{"payload": "new"}`, http.StatusOK},
+        {changeAlways, `{"payload": "new"}`, http.StatusConflict},
+    }
+
+    for _, test := range tests {
+        store := newStore(test.race)
+        rr := httptest.NewRecorder()
+        NewJobsHandler(AccepterCfg{}, store).ServeHTTP(rr, httptest.NewRequest(http.MethodPatch, "/jobs/1", strings.NewReader(test.body)))
+        if rr.Code != test.code {
+            t.Errorf("patch %s returned %d want %d", test.body, rr.Code, test.code)
+        }
+
+        if job := store.jobs[1]; job.Request.SendAfter > job.Request.TimeToLive {
+            t.Errorf("patch %s stored invalid job %+v", test.body, job)
+        }
+    }
+}
+
+func TestJobsTenantIsolation(t *testing.T) {
+    store := &mockJobStore{jobs: map[uint64]Job{
+        7: {Request: ScheduleRequest{Id: 7, Tenant: "team-a"}, Status: StatusInitial},
+    }}
+    h := NewJobsHandler(AccepterCfg{}, store)
+
+    requests := []*http.Request{
+        httptest.NewRequest(http.MethodGet, "/jobs/7", nil),
+        httptest.NewRequest(http.MethodDelete, "/jobs/7", nil),
+        httptest.NewRequest(http.MethodPatch, "/jobs/7", strings.NewReader(`{"maxRetry": 1}`)),
+    }
+    for _, r := range requests {
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, r.WithContext(WithTenant(r.Context(), "team-b")))
+        if rr.Code != http.StatusNotFound {
+            t.Errorf("%s of other tenant job expected %d got %d", r.Method, http.StatusNotFound, rr.Code)
+        }
+    }
+
+    if len(store.cancelled) != 0 || store.jobs[7].Request.MaxRetry != 0 {
+        t.Errorf("expected job of other tenant to be untouched got %+v %v", store.jobs[7], store.cancelled)
+    }
+
+    r := httptest.NewRequest(http.MethodDelete, "/jobs/7", nil)
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, r.WithContext(WithTenant(r.Context(), "team-a")))
+    if rr.Code != http.StatusNoContent || len(store.cancelled) != 1 {
+        t.Errorf("expected owner to cancel job got %d", rr.Code)
+    }
+}
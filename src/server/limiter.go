@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// HostOf is the host (with port) calls of endpoint go to
+func HostOf(endpoint string) string {
+    u, err := url.Parse(endpoint)
+    if err != nil {
+        return ""
+    }
+    return strings.ToLower(u.Host)
+}
+
+// hostLimiter caps calls in flight per destination host, hosts in limits
+// get their own cap and the rest share max. Zero means no cap.
+type hostLimiter struct {
+    mu sync.Mutex
+    max uint
+    limits map[string]uint
+    inFlight map[string]uint
+}
+
+func newHostLimiter(max uint, limits map[string]uint) *hostLimiter {
+    normalized := make(map[string]uint, len(limits))
+    for host, limit := range limits {
+        normalized[strings.ToLower(host)] = limit
+    }
+    return &hostLimiter{max: max, limits: normalized, inFlight: make(map[string]uint)}
+}
+
+func (l *hostLimiter) limit(host string) uint {
+    if limit, ok := l.limits[host]; ok {
+        return limit
+    }
+    return l.max
+}
+
+// acquire takes a slot of host, false when host is saturated
+func (l *hostLimiter) acquire(host string) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if limit := l.limit(host); limit > 0 && l.inFlight[host] >= limit {
+        return false
+    }
+    l.inFlight[host]++
+    return true
+}
+
+func (l *hostLimiter) release(host string) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if l.inFlight[host] <= 1 {
+        delete(l.inFlight, host)
+        return
+    }
+    l.inFlight[host]--
+}
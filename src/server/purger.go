@@ -0,0 +1,103 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+    purgedCounter = promauto.NewCounter(
+        prometheus.CounterOpts{
+            Name: "boomerang_purged_jobs",
+            Help: "boomerang_purged_jobs",
+        },
+    )
+)
+
+// PurgerCfg keeps done and cancelled jobs for RetentionMs after they
+// finished (zero keeps them forever), every IntervalMs at most BatchSize
+// of older ones are deleted at a time until none is left.
+type PurgerCfg struct {
+    RetentionMs uint64
+    IntervalMs uint64
+    BatchSize int
+}
+
+type purgeStore interface {
+    Purge(before time.Time, limit int) (int, error)
+}
+
+type purger struct {
+    cfg PurgerCfg
+    store purgeStore
+    now func() time.Time
+    stop chan struct{}
+    wg sync.WaitGroup
+}
+
+func NewPurger(cfg PurgerCfg, store purgeStore) *purger {
+    return &purger{cfg: cfg, store: store, now: time.Now, stop: make(chan struct{})}
+}
+
+func (p *purger) Start() {
+    if p.cfg.RetentionMs == 0 {
+        log.Println("Job retention not set, finished jobs are kept")
+        return
+    }
+
+    p.wg.Add(1)
+    go func() {
+        defer p.wg.Done()
+        ticker := time.NewTicker(time.Duration(p.cfg.IntervalMs) * time.Millisecond)
+        defer ticker.Stop()
+        for {
+            p.purge()
+            select {
+            case <-p.stop:
+                return
+            case <-ticker.C:
+            }
+        }
+    }()
+}
+
+// purge deletes batches of expired jobs until a batch is not full
+func (p *purger) purge() int {
+    before := p.now().Add(-time.Duration(p.cfg.RetentionMs) * time.Millisecond)
+    var total int
+    for {
+        n, err := p.store.Purge(before, p.cfg.BatchSize)
+        if err != nil {
+            log.Printf("Failed to purge finished jobs %s\n", err)
+            return total
+        }
+
+        total += n
+        purgedCounter.Add(float64(n))
+        if n == 0 || n < p.cfg.BatchSize {
+            break
+        }
+
+        select {
+        case <-p.stop:
+            return total
+        default:
+        }
+    }
+
+    if total > 0 {
+        log.Printf("Purged %d jobs finished before %s\n", total, before.UTC().Format(time.RFC3339))
+    }
+    return total
+}
+
+func (p *purger) Shutdown() error {
+    log.Println("Shutdown purger...")
+    close(p.stop)
+    p.wg.Wait()
+    return nil
+}
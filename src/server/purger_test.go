@@ -0,0 +1,72 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type mockPurgeStore struct {
+    left int
+    befores []time.Time
+    limits []int
+    returnErr error
+}
+
+func (s *mockPurgeStore) Purge(before time.Time, limit int) (int, error) {
+    s.befores = append(s.befores, before)
+    s.limits = append(s.limits, limit)
+    if s.returnErr != nil {
+        return 0, s.returnErr
+    }
+
+    n := s.left
+    if n > limit {
+        n = limit
+    }
+    s.left -= n
+    return n, nil
+}
+
+func TestPurgeBatches(t *testing.T) {
+    now := time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)
+    store := &mockPurgeStore{left: 5}
+    p := NewPurger(PurgerCfg{RetentionMs: 24 * 60 * 60 * 1000, IntervalMs: 1_000, BatchSize: 2}, store)
+    p.now = func() time.Time { return now }
+
+    if n := p.purge(); n != 5 {
+        t.Errorf("expected 5 purged got %d", n)
+    }
+
+    if len(store.befores) != 3 {
+        t.Fatalf("expected 3 batches got %d", len(store.befores))
+    }
+
+    for i, before := range store.befores {
+        if !before.Equal(now.Add(-24 * time.Hour)) || store.limits[i] != 2 {
+            t.Errorf("batch %d expected cutoff a day ago and limit 2 got %s %d", i, before, store.limits[i])
+        }
+    }
+}
+
+func TestPurgeStopsOnError(t *testing.T) {
+    store := &mockPurgeStore{left: 5, returnErr: errors.New("db down")}
+    p := NewPurger(PurgerCfg{RetentionMs: 1_000, IntervalMs: 1_000, BatchSize: 2}, store)
+
+    if n := p.purge(); n != 0 || len(store.befores) != 1 {
+        t.Errorf("expected one failed batch got %d purged in %d batches", n, len(store.befores))
+    }
+}
+
+func TestPurgerDisabled(t *testing.T) {
+    store := &mockPurgeStore{left: 5}
+    p := NewPurger(PurgerCfg{}, store)
+    p.Start()
+    if err := p.Shutdown(); err != nil {
+        t.Fatal(err)
+    }
+
+    if len(store.befores) != 0 {
+        t.Errorf("expected purger without retention not to purge got %d calls", len(store.befores))
+    }
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit caps calls per second to Host or to endpoints starting with
+// Prefix, Burst calls may go out at once (defaults to one second worth).
+type RateLimit struct {
+    Host string
+    Prefix string
+    PerSecond float64
+    Burst uint
+}
+
+// tokenBucket refills PerSecond tokens a second up to burst. Calls that
+// find it empty are given turns after the next token, one per token, so
+// deferred calls do not come back all at once.
+type tokenBucket struct {
+    perSecond float64
+    burst float64
+    tokens float64
+    last time.Time
+    nextTurn time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+    burst := float64(limit.Burst)
+    if burst == 0 {
+        burst = math.Max(1, math.Ceil(limit.PerSecond))
+    }
+    return &tokenBucket{perSecond: limit.PerSecond, burst: burst, tokens: burst}
+}
+
+// take takes a token at now, when there is none it returns how long the
+// call should wait for its turn
+func (b *tokenBucket) take(now time.Time) (time.Duration, bool) {
+    if !b.last.IsZero() && now.After(b.last) {
+        b.tokens = math.Min(b.burst, b.tokens + now.Sub(b.last).Seconds() * b.perSecond)
+    }
+    if now.After(b.last) {
+        b.last = now
+    }
+
+    if b.tokens >= 1 {
+        b.tokens--
+        return 0, true
+    }
+
+    interval := time.Duration(float64(time.Second) / b.perSecond)
+    turn := now.Add(time.Duration((1 - b.tokens) * float64(interval)))
+    if b.nextTurn.After(turn) {
+        turn = b.nextTurn
+    }
+    b.nextTurn = turn.Add(interval)
+    return turn.Sub(now), false
+}
+
+type prefixBucket struct {
+    prefix string
+    bucket *tokenBucket
+}
+
+// rateLimiter finds bucket of an endpoint, the longest matching prefix
+// wins over the host limit
+type rateLimiter struct {
+    mu sync.Mutex
+    prefixes []prefixBucket
+    hosts map[string]*tokenBucket
+}
+
+func newRateLimiter(limits []RateLimit) *rateLimiter {
+    l := &rateLimiter{hosts: make(map[string]*tokenBucket)}
+    for _, limit := range limits {
+        if limit.PerSecond <= 0 {
+            continue
+        }
+
+        if limit.Prefix != "" {
+            l.prefixes = append(l.prefixes, prefixBucket{limit.Prefix, newTokenBucket(limit)})
+        } else if limit.Host != "" {
+            l.hosts[strings.ToLower(limit.Host)] = newTokenBucket(limit)
+        }
+    }
+    sort.SliceStable(l.prefixes, func(i, j int) bool {
+        return len(l.prefixes[i].prefix) > len(l.prefixes[j].prefix)
+    })
+    return l
+}
+
+func (l *rateLimiter) bucket(endpoint string) *tokenBucket {
+    for _, p := range l.prefixes {
+        if strings.HasPrefix(endpoint, p.prefix) {
+            return p.bucket
+        }
+    }
+    return l.hosts[HostOf(endpoint)]
+}
+
+// take takes a token for a call to endpoint, false and how long to wait
+// when it is over its limit
+func (l *rateLimiter) take(endpoint string, now time.Time) (time.Duration, bool) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    b := l.bucket(endpoint)
+    if b == nil {
+        return 0, true
+    }
+    return b.take(now)
+}
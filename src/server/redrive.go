@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+    redriveSummary = promauto.NewSummaryVec(
+        prometheus.SummaryOpts{
+            Name: "boomerang_redrive_request",
+            Help: "boomerang_redrive_request",
+        },
+        []string{"dry_run", "status"},
+    )
+)
+
+// RedriveFilter selects dead letters to send again, every set field has
+// to match. DeadAfter is inclusive and DeadBefore exclusive.
+type RedriveFilter struct {
+    Ids []uint64
+    Tenant string
+    Host string
+    DeadAfter time.Time
+    DeadBefore time.Time
+}
+
+func (f RedriveFilter) empty() bool {
+    return len(f.Ids) == 0 && f.Tenant == "" && f.Host == "" && f.DeadAfter.IsZero() && f.DeadBefore.IsZero()
+}
+
+// Matches reports if dl is selected by filter
+func (f RedriveFilter) Matches(dl DeadLetter) bool {
+    if len(f.Ids) > 0 && !containsId(f.Ids, dl.Request.Id) {
+        return false
+    }
+
+    return (f.Tenant == "" || f.Tenant == dl.TenantId()) &&
+        (f.Host == "" || strings.EqualFold(f.Host, HostOf(dl.Request.Endpoint))) &&
+        (f.DeadAfter.IsZero() || !dl.DeadAt.Before(f.DeadAfter)) &&
+        (f.DeadBefore.IsZero() || dl.DeadAt.Before(f.DeadBefore))
+}
+
+func containsId(ids []uint64, id uint64) bool {
+    for _, it := range ids {
+        if it == id {
+            return true
+        }
+    }
+    return false
+}
+
+// RedriveOverride replaces fields of redriven requests, nil fields keep
+// the dead letter value.
+type RedriveOverride struct {
+    SendAfter *uint64
+    MaxRetry *int
+    TimeToLive *uint64
+}
+
+func (o RedriveOverride) Apply(req *ScheduleRequest) {
+    if o.SendAfter != nil {
+        req.SendAfter = *o.SendAfter
+    }
+    if o.MaxRetry != nil {
+        req.MaxRetry = *o.MaxRetry
+    }
+    if o.TimeToLive != nil {
+        req.TimeToLive = *o.TimeToLive
+    }
+}
+
+// Redrivable reports if req redriven at now can still be sent, expired
+// ones would go straight back to dead letters
+func Redrivable(req ScheduleRequest, now uint64) bool {
+    return req.TimeToLive > now && req.SendAfter <= req.TimeToLive
+}
+
+// RedriveResult counts matching dead letters which were sent again and
+// the ones skipped since they are not Redrivable
+type RedriveResult struct {
+    Redriven int
+    Skipped int
+}
+
+type RedriveRequest struct {
+    Ids []uint64 `json:"ids"`
+    Tenant string `json:"tenant"`
+    Host string `json:"host"`
+    DeadAfter time.Time `json:"deadAfter"`
+    DeadBefore time.Time `json:"deadBefore"`
+    SendAfter *uint64 `json:"sendAfter"`
+    MaxRetry *int `json:"maxRetry"`
+    TimeToLive *uint64 `json:"TimeToLive"`
+    DryRun bool `json:"dryRun"`
+}
+
+type RedriveResponse struct {
+    Count int `json:"count"`
+    Skipped int `json:"skipped"`
+    DryRun bool `json:"dryRun"`
+}
+
+type redriveStore interface {
+    // Redrive moves dead letters selected by filter back to the queue with
+    // their job id at version 1, attempts and idempotency key (unless a newer
+    // job took it), dry run only counts them. Dead letters which are not
+    // Redrivable with override are skipped.
+    Redrive(filter RedriveFilter, override RedriveOverride, dryRun bool) (RedriveResult, error)
+}
+
+type redriveHandler struct {
+    store redriveStore
+}
+
+func NewRedriveHandler(store redriveStore) *redriveHandler {
+    log.Println("Redrive handler init")
+    return &redriveHandler{store}
+}
+
+// ServeHTTP handles POST /admin/redrive
+func (h *redriveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var status, dryRun = "ok", "unknown"
+    defer func(start time.Time) {
+        redriveSummary.WithLabelValues(dryRun, status).Observe(float64(time.Since(start).Nanoseconds()))
+    }(time.Now())
+
+    if r.Method != http.MethodPost {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        status = "invalid method"
+        return
+    }
+
+    var req RedriveRequest
+    decoder := json.NewDecoder(r.Body)
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(&req); err != nil {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprintf(w, "Cannot parse redrive body %v", err)
+        status = "invalid request"
+        return
+    }
+    dryRun = fmt.Sprint(req.DryRun)
+
+    filter := RedriveFilter{Ids: req.Ids, Tenant: req.Tenant, Host: req.Host, DeadAfter: req.DeadAfter, DeadBefore: req.DeadBefore}
+    override := RedriveOverride{SendAfter: req.SendAfter, MaxRetry: req.MaxRetry, TimeToLive: req.TimeToLive}
+    if err := validateRedrive(filter, override, uint64(time.Now().UnixMilli())); err != "" {
+        w.WriteHeader(http.StatusBadRequest)
+        fmt.Fprint(w, err)
+        status = "invalid request"
+        return
+    }
+
+    res, err := h.store.Redrive(filter, override, req.DryRun)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        fmt.Fprintf(w, "Cannot redrive dead letters %v", err)
+        log.Printf("Error redriving dead letters %v\n", err)
+        status = "redrive fail"
+        return
+    }
+
+    if !req.DryRun {
+        log.Printf("Redrove %d dead letters, skipped %d expired\n", res.Redriven, res.Skipped)
+    }
+    writeJSON(w, http.StatusOK, RedriveResponse{Count: res.Redriven, Skipped: res.Skipped, DryRun: req.DryRun})
+}
+
+// validateRedrive returns what is wrong with redrive, empty when it is valid
+func validateRedrive(filter RedriveFilter, override RedriveOverride, now uint64) string {
+    if filter.empty() {
+        return "Redrive needs at least one of ids, tenant, host, deadAfter and deadBefore"
+    }
+
+    if !filter.DeadAfter.IsZero() && !filter.DeadBefore.IsZero() && !filter.DeadAfter.Before(filter.DeadBefore) {
+        return "deadAfter must be before deadBefore"
+    }
+
+    if override.MaxRetry != nil && *override.MaxRetry < 0 {
+        return "maxRetry must not be negative"
+    }
+
+    if override.TimeToLive != nil && *override.TimeToLive <= now {
+        return "TimeToLive must be in the future"
+    }
+
+    if override.SendAfter != nil && override.TimeToLive != nil && *override.SendAfter > *override.TimeToLive {
+        return "sendAfter must not be after TimeToLive"
+    }
+    return ""
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockRedriveStore struct {
+    filters []RedriveFilter
+    overrides []RedriveOverride
+    dryRuns []bool
+    returnErr error
+}
+
+func (s *mockRedriveStore) Redrive(filter RedriveFilter, override RedriveOverride, dryRun bool) (RedriveResult, error) {
+    s.filters = append(s.filters, filter)
+    s.overrides = append(s.overrides, override)
+    s.dryRuns = append(s.dryRuns, dryRun)
+    return RedriveResult{Redriven: 2, Skipped: 1}, s.returnErr
+}
+
+func TestRedriveHandler(t *testing.T) {
+    store := &mockRedriveStore{}
+    h := NewRedriveHandler(store)
+
+    body := `{"ids": [1, 2], "host": "a.com", "deadAfter": "2024-01-01T00:00:00Z", "maxRetry": 3, "dryRun": true}`
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/redrive", strings.NewReader(body)))
+    if rr.Code != http.StatusOK {
+        t.Fatalf("expected %d got %d %s", http.StatusOK, rr.Code, rr.Body)
+    }
+
+    var res RedriveResponse
+    if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+        t.Fatal(err)
+    }
+    if res.Count != 2 || res.Skipped != 1 || !res.DryRun {
+        t.Errorf("unexpected response %+v", res)
+    }
+
+    f, o := store.filters[0], store.overrides[0]
+    if len(f.Ids) != 2 || f.Host != "a.com" || !f.DeadAfter.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) || !store.dryRuns[0] {
+        t.Errorf("unexpected filter %+v", f)
+    }
+    if o.MaxRetry == nil || *o.MaxRetry != 3 || o.SendAfter != nil || o.TimeToLive != nil {
+        t.Errorf("unexpected override %+v", o)
+    }
+
+    for _, body := range []string{`{}`, `{"tenant": "a", "maxRetry": -1}`, `{"tenant": "a", "TimeToLive": 1}`, `{"tenant": "a", "unknown": 1}`, `x`} {
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/redrive", strings.NewReader(body)))
+        if rr.Code != http.StatusBadRequest {
+            t.Errorf("%s expected %d got %d", body, http.StatusBadRequest, rr.Code)
+        }
+    }
+    if len(store.filters) != 1 {
+        t.Errorf("expected invalid requests not to reach the store got %d calls", len(store.filters))
+    }
+
+    rr = httptest.NewRecorder()
+    h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/redrive", nil))
+    if rr.Code != http.StatusMethodNotAllowed {
+        t.Errorf("expected %d got %d", http.StatusMethodNotAllowed, rr.Code)
+    }
+
+    store.returnErr = errors.New("ups")
+    rr = httptest.NewRecorder()
+    h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/redrive", strings.NewReader(`{"tenant": "a"}`)))
+    if rr.Code != http.StatusInternalServerError {
+        t.Errorf("expected %d got %d", http.StatusInternalServerError, rr.Code)
+    }
+}
+
+func TestValidateRedrive(t *testing.T) {
+    now := uint64(1_000)
+    before, after := uint64(500), uint64(2_000)
+    t1, t2 := time.Unix(1, 0), time.Unix(2, 0)
+    tests := []struct {
+        filter RedriveFilter
+        override RedriveOverride
+        valid bool
+    }{
+        {RedriveFilter{}, RedriveOverride{}, false},
+        {RedriveFilter{Ids: []uint64{1}}, RedriveOverride{}, true},
+        {RedriveFilter{DeadAfter: t1, DeadBefore: t2}, RedriveOverride{}, true},
+        {RedriveFilter{DeadAfter: t2, DeadBefore: t1}, RedriveOverride{}, false},
+        {RedriveFilter{DeadAfter: t1, DeadBefore: t1}, RedriveOverride{}, false},
+        {RedriveFilter{Tenant: "a"}, RedriveOverride{TimeToLive: &before}, false},
+        {RedriveFilter{Tenant: "a"}, RedriveOverride{TimeToLive: &after, SendAfter: &before}, true},
+        {RedriveFilter{Tenant: "a"}, RedriveOverride{TimeToLive: &now, SendAfter: &after}, false},
+    }
+
+    for i, tt := range tests {
+        if got := validateRedrive(tt.filter, tt.override, now); (got == "") != tt.valid {
+            t.Errorf("%d expected valid %v got %q", i, tt.valid, got)
+        }
+    }
+}
+
+func TestRedriveFilterMatches(t *testing.T) {
+    deadAt := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+    dl := DeadLetter{Request: ScheduleRequest{Id: 7, Tenant: "team-a", Endpoint: "https://Api.Example.com/hook"}, DeadAt: deadAt}
+
+    tests := []struct {
+        filter RedriveFilter
+        matches bool
+    }{
+        {RedriveFilter{Ids: []uint64{1, 7}}, true},
+        {RedriveFilter{Ids: []uint64{1}}, false},
+        {RedriveFilter{Tenant: "team-a", Host: "api.example.com"}, true},
+        {RedriveFilter{Tenant: DefaultTenant}, false},
+        {RedriveFilter{Host: "example.com"}, false},
+        {RedriveFilter{DeadAfter: deadAt, DeadBefore: deadAt.Add(time.Second)}, true},
+        {RedriveFilter{DeadBefore: deadAt}, false},
+        {RedriveFilter{DeadAfter: deadAt.Add(time.Second)}, false},
+    }
+
+    for i, tt := range tests {
+        if got := tt.filter.Matches(dl); got != tt.matches {
+            t.Errorf("%d expected %v got %v", i, tt.matches, got)
+        }
+    }
+
+    if !(RedriveFilter{}).Matches(DeadLetter{}) {
+        t.Errorf("expected empty filter to match")
+    }
+}
+
+func TestRedrivable(t *testing.T) {
+    now := uint64(1_000)
+    tests := []struct {
+        req ScheduleRequest
+        ok bool
+    }{
+        {ScheduleRequest{SendAfter: 10, TimeToLive: 2_000}, true},
+        {ScheduleRequest{SendAfter: 10, TimeToLive: 1_000}, false},
+        {ScheduleRequest{SendAfter: 10, TimeToLive: 500}, false},
+        {ScheduleRequest{SendAfter: 3_000, TimeToLive: 2_000}, false},
+    }
+
+    for i, tt := range tests {
+        if got := Redrivable(tt.req, now); got != tt.ok {
+            t.Errorf("%d expected %v got %v", i, tt.ok, got)
+        }
+    }
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// SubmitRequest is a ScheduleRequest as accepted by submit, time fields can
+// be given as relative durations ("15m", "24h") or RFC 3339 timestamps
+// instead of epoch milliseconds. Payload is a JSON string, any other JSON
+// value which is sent as is, or binary body in PayloadBase64.
+type SubmitRequest struct {
+    ScheduleRequest
+    Payload json.RawMessage `json:"payload"`
+    PayloadBase64 string `json:"payloadBase64"`
+    Delay string `json:"delay"`
+    SendAt string `json:"sendAt"`
+    Ttl string `json:"ttl"`
+    Backoff string `json:"backoff"`
+    MaxBackoff string `json:"maxBackoff"`
+}
+
+// parse decodes, normalises and validates a single submitted request
+func (a *accepter) parse(body []byte) (ScheduleRequest, ValidationErrors) {
+    var sub SubmitRequest
+    if err := json.Unmarshal(body, &sub); err != nil {
+        return ScheduleRequest{}, decodeErrors(err)
+    }
+    return a.prepare(sub)
+}
+
+// prepare normalises and validates sub
+func (a *accepter) prepare(sub SubmitRequest) (ScheduleRequest, ValidationErrors) {
+    req, errs := sub.normalize(a.validator.now())
+    if len(errs) > 0 {
+        return req, errs
+    }
+    return req, a.validator.validate(req)
+}
+
+// normalize resolves human friendly fields into the stored epoch ms fields,
+// requests without any send time are sent right away and ttl is counted
+// from the resolved send time.
+func (s SubmitRequest) normalize(now time.Time) (ScheduleRequest, ValidationErrors) {
+    req := s.ScheduleRequest
+    req.Method = strings.ToUpper(req.Method)
+    var errs ValidationErrors
+    add := func(field, code, message string) {
+        errs = append(errs, FieldError{field, code, message})
+    }
+
+    raw := bytes.TrimSpace(s.Payload)
+    switch {
+    case len(raw) > 0 && string(raw) != "null" && s.PayloadBase64 != "":
+        add("payloadBase64", CodeConflict, "only one of payload and payloadBase64 can be set")
+    case s.PayloadBase64 != "":
+        bs, err := base64.StdEncoding.DecodeString(s.PayloadBase64)
+        if err != nil {
+            add("payloadBase64", CodeInvalid, "payloadBase64 is not valid base64")
+        }
+        req.Payload = string(bs)
+        req.ContentType = defaultContentType(req, "application/octet-stream")
+    case len(raw) > 0 && raw[0] == '"':
+        if err := json.Unmarshal(raw, &req.Payload); err != nil {
+            add("payload", CodeInvalid, "payload is not a valid JSON string")
+        }
+    case len(raw) > 0 && string(raw) != "null":
+        req.Payload = string(raw)
+        req.ContentType = defaultContentType(req, "application/json")
+    }
+
+    switch {
+    case s.Delay != "" && s.SendAt != "":
+        add("delay", CodeConflict, "only one of delay and sendAt can be set")
+    case (s.Delay != "" || s.SendAt != "") && req.SendAfter != 0:
+        add("sendAfter", CodeConflict, "sendAfter cannot be combined with delay or sendAt")
+    case s.Delay != "":
+        if d, ok := parseDuration("delay", s.Delay, &errs); ok {
+            req.SendAfter = uint64(now.Add(d).UnixMilli())
+        }
+    case s.SendAt != "":
+        at, err := time.Parse(time.RFC3339, s.SendAt)
+        if err != nil {
+            add("sendAt", CodeInvalid, "sendAt must be an RFC 3339 timestamp")
+        } else {
+            req.SendAfter = uint64(at.UnixMilli())
+        }
+    case req.SendAfter == 0:
+        req.SendAfter = uint64(now.UnixMilli())
+    }
+
+    if s.Ttl != "" && req.TimeToLive != 0 {
+        add("ttl", CodeConflict, "ttl cannot be combined with TimeToLive")
+    } else if d, ok := parseDuration("ttl", s.Ttl, &errs); ok {
+        req.TimeToLive = uint64(time.UnixMilli(int64(req.SendAfter)).Add(d).UnixMilli())
+    }
+
+    if s.Backoff != "" && req.BackOffMs != 0 {
+        add("backoff", CodeConflict, "backoff cannot be combined with backOffMs")
+    } else if d, ok := parseDuration("backoff", s.Backoff, &errs); ok {
+        req.BackOffMs = uint64(d.Milliseconds())
+    }
+
+    if s.MaxBackoff != "" && req.MaxBackOffMs != 0 {
+        add("maxBackoff", CodeConflict, "maxBackoff cannot be combined with maxBackOffMs")
+    } else if d, ok := parseDuration("maxBackoff", s.MaxBackoff, &errs); ok {
+        req.MaxBackOffMs = uint64(d.Milliseconds())
+    }
+    return req, errs
+}
+
+// defaultContentType returns contentType unless request already sets one
+func defaultContentType(req ScheduleRequest, contentType string) string {
+    if req.ContentType != "" {
+        return req.ContentType
+    }
+
+    for name := range req.Headers {
+        if strings.EqualFold(name, "Content-Type") {
+            return ""
+        }
+    }
+    return contentType
+}
+
+// parseDuration returns false when value is not set or not a valid
+// non-negative duration, the latter is added to errs.
+func parseDuration(field, value string, errs *ValidationErrors) (time.Duration, bool) {
+    if value == "" {
+        return 0, false
+    }
+
+    d, err := time.ParseDuration(value)
+    if err != nil {
+        *errs = append(*errs, FieldError{field, CodeInvalid, field + " must be a duration like 30s, 15m or 24h"})
+        return 0, false
+    }
+
+    if d < 0 {
+        *errs = append(*errs, FieldError{field, CodeNegative, field + " cannot be negative"})
+        return 0, false
+    }
+    return d, true
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+    now := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+    ms := func(t time.Time) uint64 { return uint64(t.UnixMilli()) }
+
+    req, errs := SubmitRequest{Delay: "15m", Ttl: "24h", Backoff: "30s", MaxBackoff: "10m"}.normalize(now)
+    if len(errs) != 0 {
+        t.Fatal(errs)
+    }
+    if req.SendAfter != ms(now.Add(15 * time.Minute)) || req.TimeToLive != ms(now.Add(24 * time.Hour + 15 * time.Minute)) ||
+        req.BackOffMs != 30_000 || req.MaxBackOffMs != 600_000 {
+        t.Errorf("unexpected resolved delay request %+v", req)
+    }
+
+    req, errs = SubmitRequest{SendAt: "2026-11-01T09:00:00Z", Ttl: "1h"}.normalize(now)
+    at := time.Date(2026, 11, 1, 9, 0, 0, 0, time.UTC)
+    if len(errs) != 0 || req.SendAfter != ms(at) || req.TimeToLive != ms(at.Add(time.Hour)) {
+        t.Errorf("unexpected resolved send at request %+v %v", req, errs)
+    }
+
+    req, errs = SubmitRequest{}.normalize(now)
+    if len(errs) != 0 || req.SendAfter != ms(now) {
+        t.Errorf("expected request without send time to be sent now got %+v %v", req, errs)
+    }
+
+    tests := []struct {
+        sub SubmitRequest
+        field string
+        code string
+    }{
+        {SubmitRequest{Delay: "1m", SendAt: "2026-11-01T09:00:00Z"}, "delay", CodeConflict},
+        {SubmitRequest{ScheduleRequest: ScheduleRequest{SendAfter: 1}, Delay: "1m"}, "sendAfter", CodeConflict},
+        {SubmitRequest{ScheduleRequest: ScheduleRequest{TimeToLive: 1}, Ttl: "1m"}, "ttl", CodeConflict},
+        {SubmitRequest{ScheduleRequest: ScheduleRequest{BackOffMs: 1}, Backoff: "1m"}, "backoff", CodeConflict},
+        {SubmitRequest{Delay: "soon"}, "delay", CodeInvalid},
+        {SubmitRequest{Delay: "-1m"}, "delay", CodeNegative},
+        {SubmitRequest{SendAt: "2026-11-01 09:00"}, "sendAt", CodeInvalid},
+        {SubmitRequest{Backoff: "1 minute"}, "backoff", CodeInvalid},
+        {SubmitRequest{ScheduleRequest: ScheduleRequest{MaxBackOffMs: 1}, MaxBackoff: "1m"}, "maxBackoff", CodeConflict},
+    }
+
+    for _, test := range tests {
+        _, errs := test.sub.normalize(now)
+        if len(errs) != 1 || errs[0].Field != test.field || errs[0].Code != test.code {
+            t.Errorf("%+v: expected %s %s got %v", test.sub, test.field, test.code, errs)
+        }
+    }
+}
+
+func TestSubmitRelativeTimes(t *testing.T) {
+    store := &mockStore{}
+    srv := NewAccepter(AccepterCfg{}, store)
+
+    body := `{"endpoint": "http://example.com", "sendAt": "2100-01-01T00:00:00Z", "ttl": "1h", "backoff": "2s"}`
+    rr := httptest.NewRecorder()
+    srv.SubmitHandler(rr, httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(body)))
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+    }
+
+    var resp SubmitResponse
+    if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+        t.Fatal(err)
+    }
+
+    at := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+    if !resp.ScheduledFor.Equal(at) || !resp.ExpiresAt.Equal(at.Add(time.Hour)) {
+        t.Errorf("expected resolved times in response got %+v", resp)
+    }
+
+    if store.item.BackOffMs != 2_000 || store.item.SendAfter != uint64(at.UnixMilli()) {
+        t.Errorf("expected resolved fields to be saved got %+v", store.item)
+    }
+}
+
+func TestNormalizePayload(t *testing.T) {
+    now := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+    tests := []struct {
+        body string
+        payload string
+        contentType string
+    }{
+        {`{"payload": "text"}`, "text", ""},
+        {`{"payload": {"a": [1, 2]}}`, `{"a": [1, 2]}`, "application/json"},
+        {`{"payload": [1], "contentType": "application/x-custom"}`, "[1]", "application/x-custom"},
+        {`{"payloadBase64": "H4sIAAAAAAAA/w=="}`, "\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff", "application/octet-stream"},
+        {`{"payloadBase64": "AAE=", "headers": {"content-type": "application/x-protobuf"}}`, "\x00\x01", ""},
+        {`{"payload": null}`, "", ""},
+    }
+
+    for _, test := range tests {
+        var sub SubmitRequest
+        if err := json.Unmarshal([]byte(test.body), &sub); err != nil {
+            t.Fatal(err)
+        }
+
+        req, errs := sub.normalize(now)
+        if len(errs) != 0 || req.Payload != test.payload || req.ContentType != test.contentType {
+            t.Errorf("%s: expected payload %q %q got %q %q %v", test.body, test.payload, test.contentType, req.Payload, req.ContentType, errs)
+        }
+    }
+
+    for body, field := range map[string]string{
+        `{"payload": "a", "payloadBase64": "AAE="}`: "payloadBase64",
+        `{"payloadBase64": "not base64"}`: "payloadBase64",
+    } {
+        var sub SubmitRequest
+        if err := json.Unmarshal([]byte(body), &sub); err != nil {
+            t.Fatal(err)
+        }
+
+        if _, errs := sub.normalize(now); len(errs) != 1 || errs[0].Field != field {
+            t.Errorf("%s: expected %s error got %v", body, field, errs)
+        }
+    }
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// retry policies of ScheduleRequest, empty is RetryFixed
+const (
+    RetryFixed = "fixed"
+    RetryLinear = "linear"
+    RetryExponential = "exponential"
+    RetryDecorrelatedJitter = "decorrelated_jitter"
+)
+
+var RetryPolicies = []string{RetryFixed, RetryLinear, RetryExponential, RetryDecorrelatedJitter}
+
+// RetryPolicy decides if and when a failed call is sent again
+type RetryPolicy interface {
+    // Retry returns req scheduled for the attempt after the one which
+    // failed at now, false when req is not retried
+    Retry(req ScheduleRequest, now time.Time) (ScheduleRequest, bool)
+}
+
+// backOffPolicy waits next(BackOffMs, LastBackOffMs) after a failed call,
+// capped by MaxBackOffMs, and gives up once MaxRetry is used up or the
+// wait goes past TimeToLive.
+type backOffPolicy struct {
+    next func(base, last uint64) uint64
+}
+
+func (p backOffPolicy) Retry(req ScheduleRequest, now time.Time) (ScheduleRequest, bool) {
+    at := uint64(now.UnixMilli())
+    if req.MaxRetry == 1 || at >= req.TimeToLive {
+        return req, false
+    }
+
+    wait := p.next(req.BackOffMs, req.LastBackOffMs)
+    if req.MaxBackOffMs > 0 && wait > req.MaxBackOffMs {
+        wait = req.MaxBackOffMs
+    }
+
+    if wait > req.TimeToLive - at {
+        return req, false
+    }
+
+    req.SendAfter, req.LastBackOffMs = at + wait, wait
+    req.MaxRetry -= 1
+    return req, true
+}
+
+// newRetryPolicies returns policies by name, decorrelated jitter draws
+// from intn which returns a number in [0, n)
+func newRetryPolicies(intn func(n int64) int64) map[string]RetryPolicy {
+    fixed := backOffPolicy{func(base, last uint64) uint64 {
+        return base
+    }}
+    return map[string]RetryPolicy{
+        "": fixed,
+        RetryFixed: fixed,
+        RetryLinear: backOffPolicy{func(base, last uint64) uint64 {
+            return saturatingAdd(last, base)
+        }},
+        RetryExponential: backOffPolicy{func(base, last uint64) uint64 {
+            if last == 0 {
+                return base
+            }
+            return saturatingAdd(last, last)
+        }},
+        // https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+        RetryDecorrelatedJitter: backOffPolicy{func(base, last uint64) uint64 {
+            if last < base {
+                last = base
+            }
+            hi := saturatingAdd(last, saturatingAdd(last, last))
+            if hi <= base || hi - base >= math.MaxInt64 {
+                return hi
+            }
+            return base + uint64(intn(int64(hi - base) + 1))
+        }},
+    }
+}
+
+var defaultRetryPolicies = newRetryPolicies(rand.Int63n)
+
+// ValidRetryPolicy reports if name is a known retry policy
+func ValidRetryPolicy(name string) bool {
+    _, ok := defaultRetryPolicies[name]
+    return ok
+}
+
+func saturatingAdd(a, b uint64) uint64 {
+    if a > math.MaxUint64 - b {
+        return math.MaxUint64
+    }
+    return a + b
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicies(t *testing.T) {
+    now := time.UnixMilli(1_000_000)
+    at := uint64(now.UnixMilli())
+    policies := newRetryPolicies(func(n int64) int64 { return n - 1 })
+
+    tests := []struct {
+        policy string
+        maxBackOff uint64
+        waits []uint64
+    }{
+        {"", 0, []uint64{100, 100, 100}},
+        {RetryFixed, 0, []uint64{100, 100, 100}},
+        {RetryLinear, 0, []uint64{100, 200, 300, 400}},
+        {RetryLinear, 250, []uint64{100, 200, 250, 250}},
+        {RetryExponential, 0, []uint64{100, 200, 400, 800}},
+        {RetryExponential, 500, []uint64{100, 200, 400, 500, 500}},
+        {RetryDecorrelatedJitter, 0, []uint64{300, 900, 2_700}},
+        {RetryDecorrelatedJitter, 1_000, []uint64{300, 900, 1_000, 1_000}},
+    }
+
+    for _, tt := range tests {
+        req := ScheduleRequest{BackOffMs: 100, MaxBackOffMs: tt.maxBackOff, RetryPolicy: tt.policy, TimeToLive: at + 60_000}
+        // every retry fails right when it is due
+        clock := now
+        for i, want := range tt.waits {
+            next, ok := policies[tt.policy].Retry(req, clock)
+            if !ok {
+                t.Fatalf("%s %d expected retry", tt.policy, i)
+            }
+            if wait := next.SendAfter - uint64(clock.UnixMilli()); wait != want || next.LastBackOffMs != want {
+                t.Errorf("%s %d expected wait %d got %d last %d", tt.policy, i, want, wait, next.LastBackOffMs)
+            }
+            req, clock = next, time.UnixMilli(int64(next.SendAfter))
+        }
+    }
+}
+
+func TestRetryFromAttemptTime(t *testing.T) {
+    now := time.UnixMilli(1_000_000)
+    req := ScheduleRequest{SendAfter: 10, BackOffMs: 100, MaxRetry: 3, TimeToLive: 2_000_000}
+
+    next, ok := newRetryPolicies(nil)[RetryFixed].Retry(req, now)
+    if !ok || next.SendAfter != 1_000_100 || next.MaxRetry != 2 {
+        t.Errorf("expected retry 100ms after failed attempt got %+v %v", next, ok)
+    }
+}
+
+func TestRetryGivesUp(t *testing.T) {
+    now := time.UnixMilli(1_000_000)
+    at := uint64(now.UnixMilli())
+    fixed := newRetryPolicies(nil)[RetryFixed]
+
+    tests := []struct {
+        req ScheduleRequest
+        retry bool
+    }{
+        {ScheduleRequest{MaxRetry: 1, BackOffMs: 10, TimeToLive: at + 1_000}, false},
+        {ScheduleRequest{MaxRetry: 0, BackOffMs: 10, TimeToLive: at + 1_000}, true},
+        {ScheduleRequest{MaxRetry: 2, BackOffMs: 10, TimeToLive: at}, false},
+        {ScheduleRequest{MaxRetry: 2, BackOffMs: 1_000, TimeToLive: at + 1_000}, true},
+        {ScheduleRequest{MaxRetry: 2, BackOffMs: 1_001, TimeToLive: at + 1_000}, false},
+        {ScheduleRequest{MaxRetry: 2, BackOffMs: 5_000, MaxBackOffMs: 500, TimeToLive: at + 1_000}, true},
+    }
+
+    for i, tt := range tests {
+        if _, ok := fixed.Retry(tt.req, now); ok != tt.retry {
+            t.Errorf("%d expected retry %v got %v", i, tt.retry, ok)
+        }
+    }
+}
+
+func TestDecorrelatedJitterRange(t *testing.T) {
+    var got []int64
+    jitter := newRetryPolicies(func(n int64) int64 {
+        got = append(got, n)
+        return 0
+    })[RetryDecorrelatedJitter]
+
+    req := ScheduleRequest{BackOffMs: 100, LastBackOffMs: 400, TimeToLive: 1_000_000}
+    next, _ := jitter.Retry(req, time.UnixMilli(0))
+    if len(got) != 1 || got[0] != 1_101 || next.SendAfter != 100 {
+        t.Errorf("expected wait drawn from [100, 1200] got range %v wait %d", got, next.SendAfter)
+    }
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kucicm/boomerang/src/verify"
+)
+
+// SigningCfg holds secrets callbacks are signed with. Secrets of the
+// destination host win over secrets of the tenant which win over Secrets.
+// Every listed secret signs, so a new one can be added next to the old one
+// while receivers move to it.
+type SigningCfg struct {
+    Secrets []string
+    Tenants map[string][]string
+    Hosts map[string][]string
+}
+
+type signer struct {
+    keys [][]byte
+    tenants map[string][][]byte
+    hosts map[string][][]byte
+}
+
+func newSigner(cfg SigningCfg) *signer {
+    s := &signer{
+        keys: decodeSecrets(cfg.Secrets),
+        tenants: make(map[string][][]byte, len(cfg.Tenants)),
+        hosts: make(map[string][][]byte, len(cfg.Hosts)),
+    }
+    for tenant, secrets := range cfg.Tenants {
+        s.tenants[tenant] = decodeSecrets(secrets)
+    }
+    for host, secrets := range cfg.Hosts {
+        s.hosts[strings.ToLower(host)] = decodeSecrets(secrets)
+    }
+    return s
+}
+
+func decodeSecrets(secrets []string) [][]byte {
+    keys := make([][]byte, 0, len(secrets))
+    for _, secret := range secrets {
+        key, err := verify.DecodeSecret(secret)
+        if err != nil {
+            log.Printf("Skipping signing secret %v\n", err)
+            continue
+        }
+        keys = append(keys, key)
+    }
+    return keys
+}
+
+// keysOf returns keys callbacks of tenant to host are signed with
+func (s *signer) keysOf(tenant, host string) [][]byte {
+    if keys, ok := s.hosts[host]; ok {
+        return keys
+    }
+    if tenant == "" {
+        tenant = DefaultTenant
+    }
+    if keys, ok := s.tenants[tenant]; ok {
+        return keys
+    }
+    return s.keys
+}
+
+// sign adds id, timestamp and signature headers to callback of req,
+// callbacks without keys are sent unsigned
+func (s *signer) sign(httpReq *http.Request, req ScheduleRequest, now time.Time) {
+    keys := s.keysOf(req.Tenant, strings.ToLower(httpReq.URL.Host))
+    if len(keys) == 0 {
+        return
+    }
+
+    timestamp := now.Unix()
+    url := verify.Url(httpReq.URL.Scheme, httpReq.URL.Host, httpReq.URL.RequestURI())
+    body := []byte(callBody(req))
+    signatures := make([]string, len(keys))
+    for i, key := range keys {
+        signatures[i] = verify.Sign(key, timestamp, httpReq.Method, url, body)
+    }
+
+    httpReq.Header.Set(verify.HeaderId, strconv.FormatUint(req.Id, 10))
+    httpReq.Header.Set(verify.HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+    httpReq.Header.Set(verify.HeaderSignature, strings.Join(signatures, " "))
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kucicm/boomerang/src/verify"
+)
+
+func TestSignerKeys(t *testing.T) {
+    s := newSigner(SigningCfg{
+        Secrets: []string{"default"},
+        Tenants: map[string][]string{"acme": {"acme"}, DefaultTenant: {"default-tenant"}},
+        Hosts: map[string][]string{"Hooks.example.com": {"host"}},
+    })
+
+    if keys := s.keysOf("acme", "hooks.example.com"); len(keys) != 1 || string(keys[0]) != "host" {
+        t.Errorf("expected host secret to win got %q", keys)
+    }
+    if keys := s.keysOf("acme", "other.com"); len(keys) != 1 || string(keys[0]) != "acme" {
+        t.Errorf("expected tenant secret got %q", keys)
+    }
+    if keys := s.keysOf("", "other.com"); len(keys) != 1 || string(keys[0]) != "default-tenant" {
+        t.Errorf("expected request without tenant to use default tenant secret got %q", keys)
+    }
+    if keys := s.keysOf("other", "other.com"); len(keys) != 1 || string(keys[0]) != "default" {
+        t.Errorf("expected default secret got %q", keys)
+    }
+}
+
+func TestSignerSign(t *testing.T) {
+    now := time.Unix(1_700_000_000, 0)
+    req := ScheduleRequest{Id: 7, Endpoint: "http://hooks.example.com/done", Query: map[string]string{"b": "2"}, Payload: "payload"}
+    httpReq, err := newCallRequest(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    newSigner(SigningCfg{Secrets: []string{"new", "old"}}).sign(httpReq, req, now)
+    if httpReq.Header.Get(verify.HeaderId) != "7" || httpReq.Header.Get(verify.HeaderTimestamp) != "1700000000" {
+        t.Errorf("unexpected signing headers %v", httpReq.Header)
+    }
+
+    for _, secret := range []string{"new", "old"} {
+        v, _ := verify.NewVerifier(secret)
+        v.Now = func() time.Time { return now }
+        if err := v.Verify(httpReq.Header, http.MethodPost, "http://hooks.example.com/done?b=2", []byte("payload")); err != nil {
+            t.Errorf("expected callback to verify with %s secret got %v", secret, err)
+        }
+    }
+
+    unsigned, _ := newCallRequest(req)
+    newSigner(SigningCfg{}).sign(unsigned, req, now)
+    if unsigned.Header.Get(verify.HeaderSignature) != "" {
+        t.Error("expected callback without secrets to be unsigned")
+    }
+}
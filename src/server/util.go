@@ -1,20 +1,18 @@
 package server
 
-import "time"
-
-
-func isValidForRetry(req ScheduleRequest) bool {
+// deadReason is why a failed req which is not retried is dead
+func deadReason(req ScheduleRequest) string {
     if req.MaxRetry == 1 {
-        return false
-    }
-
-    if time.Now().UnixMilli() >= int64(req.TimeToLive) {
-        return false
+        return DeadReasonExhausted
     }
+    return DeadReasonExpired
+}
 
-    if req.SendAfter + req.BackOffMs > req.TimeToLive {
-        return false
+// remainingRetries is how many more times a failed call is retried, -1 when
+// MaxRetry is not set and the request is retried until it expires.
+func remainingRetries(req ScheduleRequest) int {
+    if req.MaxRetry <= 0 {
+        return -1
     }
-
-    return true
+    return req.MaxRetry - 1
 }
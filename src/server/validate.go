@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// error codes of FieldError
+const (
+    CodeRequired = "required"
+    CodeInvalid = "invalid"
+    CodeInvalidScheme = "invalid_scheme"
+    CodeTooLarge = "too_large"
+    CodeNegative = "negative"
+    CodeOrder = "invalid_order"
+    CodeExpired = "expired"
+    CodeInvalidJSON = "invalid_json"
+    CodeNotAllowed = "not_allowed"
+    CodeConflict = "conflict"
+)
+
+var callMethods = map[string]bool{
+    http.MethodGet: true,
+    http.MethodHead: true,
+    http.MethodPost: true,
+    http.MethodPut: true,
+    http.MethodPatch: true,
+    http.MethodDelete: true,
+}
+
+type FieldError struct {
+    Field string `json:"field"`
+    Code string `json:"code"`
+    Message string `json:"message"`
+}
+
+// ValidationErrors lists every problem found in a request
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+    msgs := make([]string, len(e))
+    for i, fe := range e {
+        msgs[i] = fmt.Sprintf("%s: %s", fe.Field, fe.Message)
+    }
+    return strings.Join(msgs, ", ")
+}
+
+type ValidationResponse struct {
+    Errors ValidationErrors `json:"errors"`
+}
+
+type validator struct {
+    maxPayloadBytes int
+    now func() time.Time
+}
+
+func (v validator) validate(req ScheduleRequest) ValidationErrors {
+    var errs ValidationErrors
+    add := func(field, code, format string, args ...any) {
+        errs = append(errs, FieldError{field, code, fmt.Sprintf(format, args...)})
+    }
+
+    if req.Endpoint == "" {
+        add("endpoint", CodeRequired, "endpoint is required")
+    } else if u, err := url.Parse(req.Endpoint); err != nil {
+        add("endpoint", CodeInvalid, "endpoint is not a valid url")
+    } else if u.Scheme != "http" && u.Scheme != "https" {
+        add("endpoint", CodeInvalidScheme, "endpoint scheme must be http or https")
+    } else if u.Host == "" {
+        add("endpoint", CodeRequired, "endpoint host is required")
+    }
+
+    method := req.CallMethod()
+    if !callMethods[method] {
+        add("method", CodeNotAllowed, "method must be one of GET, HEAD, POST, PUT, PATCH or DELETE")
+    } else if (method == http.MethodGet || method == http.MethodHead) && req.Payload != "" {
+        add("payload", CodeNotAllowed, "payload cannot be sent with %s", method)
+    }
+
+    for name := range req.Query {
+        if name == "" {
+            add("query", CodeInvalid, "query parameter name cannot be empty")
+        }
+    }
+
+    if req.ContentType != "" {
+        if _, _, err := mime.ParseMediaType(req.ContentType); err != nil {
+            add("contentType", CodeInvalid, "contentType is not a valid media type")
+        }
+    }
+
+    for name, value := range req.Headers {
+        if !validHeaderName(name) {
+            add("headers." + name, CodeInvalid, "header name is not a valid token")
+        }
+        if strings.ContainsAny(value, "\r\n\x00") {
+            add("headers." + name, CodeInvalid, "header value contains control characters")
+        }
+        if req.ContentType != "" && strings.EqualFold(name, "Content-Type") {
+            add("headers." + name, CodeConflict, "Content-Type header cannot be combined with contentType")
+        }
+    }
+
+    if v.maxPayloadBytes > 0 && len(req.Payload) > v.maxPayloadBytes {
+        add("payload", CodeTooLarge, "payload is over %d bytes", v.maxPayloadBytes)
+    }
+
+    if req.TimeToLive == 0 {
+        add("TimeToLive", CodeRequired, "TimeToLive is required")
+    } else if req.TimeToLive < uint64(v.now().UnixMilli()) {
+        add("TimeToLive", CodeExpired, "TimeToLive is in the past")
+    } else if req.SendAfter > req.TimeToLive {
+        add("sendAfter", CodeOrder, "sendAfter is after TimeToLive")
+    }
+
+    if req.MaxRetry < 0 {
+        add("maxRetry", CodeNegative, "maxRetry cannot be negative")
+    }
+
+    if !ValidRetryPolicy(req.RetryPolicy) {
+        add("retryPolicy", CodeNotAllowed, "retryPolicy must be one of %s", strings.Join(RetryPolicies, ", "))
+    }
+
+    if req.MaxBackOffMs != 0 && req.MaxBackOffMs < req.BackOffMs {
+        add("maxBackOffMs", CodeOrder, "maxBackOffMs is below backOffMs")
+    }
+    return errs
+}
+
+// validHeaderName reports whether name is a token as defined by RFC 7230
+func validHeaderName(name string) bool {
+    if name == "" {
+        return false
+    }
+
+    for _, c := range name {
+        switch {
+        case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+        case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+        default:
+            return false
+        }
+    }
+    return true
+}
+
+// decodeErrors turns a json decode error into field errors
+func decodeErrors(err error) ValidationErrors {
+    var typeErr *json.UnmarshalTypeError
+    if errors.As(err, &typeErr) {
+        return ValidationErrors{{typeErr.Field, CodeInvalid, fmt.Sprintf("expected %s got %s", typeErr.Type, typeErr.Value)}}
+    }
+    return ValidationErrors{{"", CodeInvalidJSON, err.Error()}}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+    now := time.UnixMilli(1_700_000_000_000)
+    v := validator{maxPayloadBytes: 4, now: func() time.Time { return now }}
+    valid := ScheduleRequest{
+        Endpoint: "https://example.com/hook",
+        Headers: map[string]string{"X-Test": "ok"},
+        Payload: "abc",
+        SendAfter: 1_700_000_001_000,
+        TimeToLive: 1_700_000_002_000,
+    }
+
+    if errs := v.validate(valid); len(errs) != 0 {
+        t.Fatalf("expected valid request got %v", errs)
+    }
+
+    tests := []struct {
+        name string
+        change func(*ScheduleRequest)
+        field string
+        code string
+    }{
+        {"missing endpoint", func(r *ScheduleRequest) { r.Endpoint = "" }, "endpoint", CodeRequired},
+        {"bad scheme", func(r *ScheduleRequest) { r.Endpoint = "ftp://example.com" }, "endpoint", CodeInvalidScheme},
+        {"no scheme", func(r *ScheduleRequest) { r.Endpoint = "example.com/hook" }, "endpoint", CodeInvalidScheme},
+        {"no host", func(r *ScheduleRequest) { r.Endpoint = "http:///hook" }, "endpoint", CodeRequired},
+        {"header name", func(r *ScheduleRequest) { r.Headers = map[string]string{"Bad Header": "x"} }, "headers.Bad Header", CodeInvalid},
+        {"header value", func(r *ScheduleRequest) { r.Headers = map[string]string{"X-Test": "a\r\nb"} }, "headers.X-Test", CodeInvalid},
+        {"payload size", func(r *ScheduleRequest) { r.Payload = "abcde" }, "payload", CodeTooLarge},
+        {"missing ttl", func(r *ScheduleRequest) { r.TimeToLive = 0 }, "TimeToLive", CodeRequired},
+        {"expired ttl", func(r *ScheduleRequest) { r.TimeToLive = 1_699_999_999_000 }, "TimeToLive", CodeExpired},
+        {"send after ttl", func(r *ScheduleRequest) { r.SendAfter = 1_700_000_003_000 }, "sendAfter", CodeOrder},
+        {"negative retry", func(r *ScheduleRequest) { r.MaxRetry = -1 }, "maxRetry", CodeNegative},
+        {"unknown method", func(r *ScheduleRequest) { r.Method = "TRACE" }, "method", CodeNotAllowed},
+        {"get with payload", func(r *ScheduleRequest) { r.Method = "GET" }, "payload", CodeNotAllowed},
+        {"empty query name", func(r *ScheduleRequest) { r.Query = map[string]string{"": "x"} }, "query", CodeInvalid},
+        {"content type", func(r *ScheduleRequest) { r.ContentType = "json;;" }, "contentType", CodeInvalid},
+        {"content type header", func(r *ScheduleRequest) { r.ContentType = "text/plain"; r.Headers = map[string]string{"content-type": "a/b"} }, "headers.content-type", CodeConflict},
+        {"retry policy", func(r *ScheduleRequest) { r.RetryPolicy = "random" }, "retryPolicy", CodeNotAllowed},
+        {"max backoff", func(r *ScheduleRequest) { r.BackOffMs = 10; r.MaxBackOffMs = 5 }, "maxBackOffMs", CodeOrder},
+    }
+
+    for _, test := range tests {
+        req := valid
+        test.change(&req)
+        errs := v.validate(req)
+        if len(errs) != 1 || errs[0].Field != test.field || errs[0].Code != test.code {
+            t.Errorf("%s: expected %s %s got %v", test.name, test.field, test.code, errs)
+        }
+    }
+}
+
+func TestSubmitValidationErrors(t *testing.T) {
+    store := &mockStore{}
+    srv := NewAccepter(AccepterCfg{MaxBodyBytes: 64}, store)
+
+    bodies := map[string]struct {
+        code int
+        field string
+        errCode string
+    }{
+        `{"endpoint": "ftp://example.com", "TimeToLive": 4102444800000}`: {http.StatusBadRequest, "endpoint", CodeInvalidScheme},
+        `{"endpoint": "http://example.com", "maxRetry": "3"}`: {http.StatusBadRequest, "maxRetry", CodeInvalid},
+        `{"endpoint": `: {http.StatusBadRequest, "", CodeInvalidJSON},
+        `{"endpoint": "http://example.com", "payload": "` + strings.Repeat("a", 64) + `"}`: {http.StatusRequestEntityTooLarge, "", CodeTooLarge},
+    }
+
+    for body, expected := range bodies {
+        rr := httptest.NewRecorder()
+        srv.SubmitHandler(rr, httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(body)))
+        if rr.Code != expected.code {
+            t.Errorf("body %s: handler returned wrong status code: got %v want %v", body, rr.Code, expected.code)
+        }
+
+        var resp ValidationResponse
+        if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+            t.Fatal(err)
+        }
+
+        if len(resp.Errors) == 0 || resp.Errors[0].Field != expected.field || resp.Errors[0].Code != expected.errCode {
+            t.Errorf("body %s: expected %s %s got %+v", body, expected.field, expected.errCode, resp.Errors)
+        }
+    }
+
+    if store.called {
+        t.Error("invalid request should not be saved")
+    }
+}
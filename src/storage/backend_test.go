@@ -0,0 +1,779 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kucicm/boomerang/src/server"
+)
+
+// backend is what every storage backend implements, testBackend runs the
+// same cases against each of them.
+type backend interface {
+    Save(server.ScheduleRequest) (uint64, error)
+    SaveBatch([]server.ScheduleRequest) ([]uint64, []error)
+    Load(bs uint) []server.ScheduleRequest
+    Update(req server.ScheduleRequest)
+    Delete(req server.ScheduleRequest)
+    Done(req server.ScheduleRequest)
+    AddAttempt(id uint64, attempt server.Attempt)
+    Get(id uint64) (server.Job, error)
+    Cancel(id uint64) error
+    List(filter server.ListFilter) ([]server.Job, error)
+    Patch(id uint64, version uint64, patch server.JobPatch) (server.Job, error)
+    DeadLetter(req server.ScheduleRequest, reason string)
+    GetDeadLetter(id uint64) (server.DeadLetter, error)
+    ListDeadLetters(filter server.DeadLetterFilter) ([]server.DeadLetter, error)
+    CountDeadLetters() (int, error)
+    Redrive(filter server.RedriveFilter, override server.RedriveOverride, dryRun bool) (server.RedriveResult, error)
+    Purge(before time.Time, limit int) (int, error)
+}
+
+func newTestRequest() server.ScheduleRequest {
+    return server.ScheduleRequest{
+        Endpoint: "Test",
+        Headers: map[string]string{"Ha": "Ha", "He": "He"},
+        Payload: "slkdjf",
+        SendAfter: 328389,
+        MaxRetry: 23,
+        BackOffMs: 12,
+        TimeToLive: uint64(time.Now().UnixMilli()) + 5_000,
+        Method: "PUT",
+        Query: map[string]string{"q": "1"},
+        ContentType: "text/plain",
+        RetryPolicy: server.RetryExponential,
+        MaxBackOffMs: 60_000,
+    }
+}
+
+func TestMemoryBackend(t *testing.T) {
+    testBackend(t, func(t *testing.T) backend {
+        return NewMemoryStorage()
+    })
+}
+
+func TestEmbeddedBackend(t *testing.T) {
+    testBackend(t, func(t *testing.T) backend {
+        storage := newTestEmbeddedStorage(t, t.TempDir())
+        t.Cleanup(func() { storage.Shutdown() })
+        return storage
+    })
+}
+
+// postgres storage is a singleton, every case starts from empty tables
+func TestPostgresBackend(t *testing.T) {
+    testBackend(t, func(t *testing.T) backend {
+        if err := TruncateTables(); err != nil {
+            t.Fatal(err)
+        }
+
+        storage, err := NewStorageService(StorageServiceCfg{DbUrl: os.Getenv("DB_URL"), MigrationPath: "file://../../resources/sql"})
+        if err != nil {
+            t.Fatal(err)
+        }
+        return storage
+    })
+}
+
+func testBackend(t *testing.T, newBackend func(t *testing.T) backend) {
+    tests := []struct {
+        name string
+        run func(*testing.T, backend)
+    }{
+        {"SaveLoad", testSaveLoad},
+        {"LoadNItems", testLoadNItems},
+        {"LoadReady", testLoadReady},
+        {"Update", testUpdate},
+        {"Delete", testDelete},
+        {"JobLifecycle", testJobLifecycle},
+        {"Cancel", testCancel},
+        {"Patch", testPatch},
+        {"AttemptKeepsVersion", testAttemptKeepsVersion},
+        {"IdempotencyKey", testIdempotencyKey},
+        {"SaveBatch", testSaveBatch},
+        {"BinaryPayload", testBinaryPayload},
+        {"List", testList},
+        {"Tenants", testTenants},
+        {"LoadFair", testLoadFair},
+        {"DeadLetters", testDeadLetters},
+        {"Redrive", testRedrive},
+        {"Purge", testPurge},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            test.run(t, newBackend(t))
+        })
+    }
+}
+
+func testSaveLoad(t *testing.T, storage backend) {
+    req := newTestRequest()
+    req.Tenant = "team-a"
+    id, err := storage.Save(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    loaded := storage.Load(10)
+    if len(loaded) != 1 {
+        t.Fatalf("expected loaded size of 1 got %d", len(loaded))
+    }
+
+    it := loaded[0]
+    if it.Id == 0 || it.Id != id {
+        t.Errorf("expected Id %d got %d", id, it.Id)
+    }
+    it.Id = 0
+
+    if !reflect.DeepEqual(it, req) {
+        t.Errorf("expected %+v got %+v", req, it)
+    }
+
+    if loaded = storage.Load(10); len(loaded) != 0 {
+        t.Errorf("expected claimed request not to be loaded again got %+v", loaded)
+    }
+}
+
+func testLoadNItems(t *testing.T, storage backend) {
+    for i := 0; i < 20; i++ {
+        if _, err := storage.Save(newTestRequest()); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    tests := []struct {
+        bs uint
+        expected int
+    }{
+        {10, 10},
+        {7, 7},
+        {10, 3},
+    }
+
+    ids := make(map[uint64]bool)
+    for _, test := range tests {
+        loaded := storage.Load(test.bs)
+        if len(loaded) != test.expected {
+            t.Errorf("expected loaded size of %d got %d", test.expected, len(loaded))
+        }
+        for _, r := range loaded {
+            ids[r.Id] = true
+        }
+    }
+
+    if len(ids) != 20 {
+        t.Errorf("expected all 20 requests loaded once got %d", len(ids))
+    }
+
+    if loaded := storage.Load(10); len(loaded) != 0 {
+        t.Errorf("expected nothing left to load got %d", len(loaded))
+    }
+}
+
+func testLoadReady(t *testing.T, storage backend) {
+    now := uint64(time.Now().UnixMilli())
+    for _, sendAfter := range []uint64{now - 10, now + 60_000, now - 30, now - 20} {
+        req := newTestRequest()
+        req.SendAfter, req.TimeToLive = sendAfter, now + 120_000
+        if _, err := storage.Save(req); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    expired := newTestRequest()
+    expired.TimeToLive = now - 1
+    if _, err := storage.Save(expired); err != nil {
+        t.Fatal(err)
+    }
+
+    loaded := storage.Load(2)
+    sendAfters := map[uint64]bool{}
+    for _, r := range loaded {
+        sendAfters[r.SendAfter] = true
+    }
+    if len(loaded) != 2 || !sendAfters[now - 30] || !sendAfters[now - 20] {
+        t.Errorf("expected two oldest requests got %+v", loaded)
+    }
+
+    loaded = storage.Load(10)
+    if len(loaded) != 1 || loaded[0].SendAfter != now - 10 {
+        t.Errorf("expected only remaining ready request got %+v", loaded)
+    }
+}
+
+func testUpdate(t *testing.T, storage backend) {
+    if _, err := storage.Save(newTestRequest()); err != nil {
+        t.Fatal(err)
+    }
+
+    it := storage.Load(1)[0]
+    it.MaxRetry = 1
+    it.LastBackOffMs = 400
+    storage.Update(it)
+
+    loaded := storage.Load(1)
+    if len(loaded) != 1 {
+        t.Fatalf("expected updated request to be loaded again got %d", len(loaded))
+    }
+
+    if loaded[0].MaxRetry != 1 || loaded[0].LastBackOffMs != 400 {
+        t.Errorf("expected max_retry 1 and last backoff 400 got %d %d", loaded[0].MaxRetry, loaded[0].LastBackOffMs)
+    }
+
+    it = loaded[0]
+    it.SendAfter = uint64(time.Now().UnixMilli()) + 60_000
+    storage.Update(it)
+
+    if loaded := storage.Load(1); len(loaded) != 0 {
+        t.Errorf("expected rescheduled request not to be ready got %+v", loaded)
+    }
+
+    if job, err := storage.Get(it.Id); err != nil || job.Status != server.StatusInitial || job.Request.SendAfter != it.SendAfter {
+        t.Errorf("expected rescheduled job to be pending got %+v %v", job, err)
+    }
+}
+
+func testDelete(t *testing.T, storage backend) {
+    keyed := newTestRequest()
+    keyed.IdempotencyKey = "key-1"
+    keyed.IdempotencyExpiresAt = uint64(time.Now().UnixMilli()) + 60_000
+    ids, errs := storage.SaveBatch([]server.ScheduleRequest{keyed, newTestRequest()})
+    if errs[0] != nil || errs[1] != nil {
+        t.Fatal(errs)
+    }
+
+    loaded := storage.Load(1)
+    storage.Delete(loaded[0])
+    storage.Delete(server.ScheduleRequest{Id: ids[1]})
+
+    for _, id := range ids {
+        if _, err := storage.Get(id); !errors.Is(err, server.ErrJobNotFound) {
+            t.Errorf("expected deleted job %d not to be found got %v", id, err)
+        }
+    }
+
+    if loaded := storage.Load(10); len(loaded) != 0 {
+        t.Errorf("expected deleted jobs not to be loaded got %+v", loaded)
+    }
+
+    if _, err := storage.Save(keyed); err != nil {
+        t.Errorf("expected key of deleted job to be reusable got %v", err)
+    }
+
+    storage.Delete(server.ScheduleRequest{Id: ids[1] + 100})
+}
+
+func testJobLifecycle(t *testing.T, storage backend) {
+    id, err := storage.Save(newTestRequest())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if job, err := storage.Get(id); err != nil || job.Status != server.StatusInitial {
+        t.Errorf("expected initial job got %+v %v", job, err)
+    }
+
+    it := storage.Load(1)[0]
+    if job, _ := storage.Get(id); job.Status != server.StatusRunning {
+        t.Errorf("expected running job got %s", job.Status)
+    }
+
+    storage.AddAttempt(id, server.Attempt{At: time.Now(), StatusCode: 200, LatencyMs: 3})
+    storage.Done(it)
+
+    job, err := storage.Get(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if job.Status != server.StatusDone || len(job.Attempts) != 1 || job.Attempts[0].StatusCode != 200 || job.Attempts[0].LatencyMs != 3 {
+        t.Errorf("expected done job with one attempt got %+v", job)
+    }
+
+    if _, err := storage.Get(id + 1); err != server.ErrJobNotFound {
+        t.Errorf("expected not found got %v", err)
+    }
+}
+
+func testCancel(t *testing.T, storage backend) {
+    pending, err := storage.Save(newTestRequest())
+    if err != nil {
+        t.Fatal(err)
+    }
+    claimed, err := storage.Save(newTestRequest())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if err := storage.Cancel(pending); err != nil {
+        t.Fatal(err)
+    }
+
+    loaded := storage.Load(10)
+    if len(loaded) != 1 || loaded[0].Id != claimed {
+        t.Fatalf("expected cancelled job not to be loaded got %+v", loaded)
+    }
+
+    if err := storage.Cancel(claimed); !errors.Is(err, server.ErrJobNotPending) {
+        t.Errorf("expected claimed job cancel to be rejected got %v", err)
+    }
+
+    if err := storage.Cancel(pending); !errors.Is(err, server.ErrJobNotPending) {
+        t.Errorf("expected cancelled job cancel to be rejected got %v", err)
+    }
+
+    if err := storage.Cancel(claimed + 1); err != server.ErrJobNotFound {
+        t.Errorf("expected not found got %v", err)
+    }
+
+    job, err := storage.Get(pending)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if job.Status != server.StatusCancelled || job.CancelledAt.IsZero() {
+        t.Errorf("expected cancellation to be recorded got %+v", job)
+    }
+}
+
+func testPatch(t *testing.T, storage backend) {
+    id, err := storage.Save(newTestRequest())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    job, err := storage.Get(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    later := uint64(time.Now().UnixMilli()) + 60_000
+    payload := "patched"
+    patched, err := storage.Patch(id, job.Version, server.JobPatch{SendAfter: &later, Payload: &payload})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if patched.Version != job.Version + 1 || patched.Request.SendAfter != later || patched.Request.Payload != payload {
+        t.Errorf("expected patched job with next version got %+v", patched)
+    }
+
+    if patched.Request.MaxRetry != job.Request.MaxRetry || patched.Request.Endpoint != job.Request.Endpoint {
+        t.Errorf("expected not patched fields to stay got %+v", patched.Request)
+    }
+
+    if loaded := storage.Load(10); len(loaded) != 0 {
+        t.Errorf("expected rescheduled job not to be ready got %+v", loaded)
+    }
+
+    if _, err := storage.Patch(id, job.Version, server.JobPatch{Payload: &payload}); !errors.Is(err, server.ErrVersionMismatch) {
+        t.Errorf("expected stale version to be rejected got %v", err)
+    }
+
+    now := uint64(time.Now().UnixMilli()) - 1
+    if _, err := storage.Patch(id, 0, server.JobPatch{SendAfter: &now}); err != nil {
+        t.Fatal(err)
+    }
+
+    if loaded := storage.Load(10); len(loaded) != 1 || loaded[0].Payload != payload {
+        t.Fatalf("expected patched job to be loaded got %+v", loaded)
+    }
+
+    if _, err := storage.Patch(id, 0, server.JobPatch{Payload: &payload}); !errors.Is(err, server.ErrJobNotPending) {
+        t.Errorf("expected claimed job patch to be rejected got %v", err)
+    }
+
+    if _, err := storage.Patch(id + 1, 0, server.JobPatch{Payload: &payload}); err != server.ErrJobNotFound {
+        t.Errorf("expected not found got %v", err)
+    }
+}
+
+// attempts are delivery history, only changes to the request bump the version
+func testAttemptKeepsVersion(t *testing.T, storage backend) {
+    id, err := storage.Save(newTestRequest())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    job, err := storage.Get(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    storage.AddAttempt(id, server.Attempt{At: time.Now(), StatusCode: 500})
+    attempted, err := storage.Get(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if attempted.Version != job.Version || len(attempted.Attempts) != 1 {
+        t.Errorf("expected version %d with one attempt got %d %+v", job.Version, attempted.Version, attempted.Attempts)
+    }
+
+    payload := "patched"
+    if _, err := storage.Patch(id, job.Version, server.JobPatch{Payload: &payload}); err != nil {
+        t.Errorf("expected patch with version read before attempt to succeed got %v", err)
+    }
+}
+
+func testIdempotencyKey(t *testing.T, storage backend) {
+    req := newTestRequest()
+    req.IdempotencyKey = "key-1"
+    req.IdempotencyExpiresAt = uint64(time.Now().UnixMilli()) + 60_000
+    id, err := storage.Save(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if dup, err := storage.Save(req); err != server.ErrDuplicateRequest || dup != id {
+        t.Errorf("expected duplicate of %d got %d %v", id, dup, err)
+    }
+
+    if jobs, _ := storage.List(server.ListFilter{}); len(jobs) != 1 {
+        t.Errorf("expected duplicate not to be stored got %d jobs", len(jobs))
+    }
+
+    if err := storage.Cancel(id); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := storage.Purge(time.Now().Add(time.Second), 0); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := storage.Save(req); err != nil {
+        t.Errorf("expected key of purged job to be reusable got %v", err)
+    }
+
+    req.IdempotencyKey = "key-2"
+    req.IdempotencyExpiresAt = uint64(time.Now().UnixMilli()) - 1
+    if _, err := storage.Save(req); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := storage.Save(req); err != nil {
+        t.Errorf("expected expired key to be reusable got %v", err)
+    }
+}
+
+func testSaveBatch(t *testing.T, storage backend) {
+    keyed := newTestRequest()
+    keyed.IdempotencyKey = "key-1"
+    keyed.IdempotencyExpiresAt = uint64(time.Now().UnixMilli()) + 60_000
+    ids, errs := storage.SaveBatch([]server.ScheduleRequest{keyed, newTestRequest(), keyed})
+
+    if errs[0] != nil || errs[1] != nil || ids[0] == ids[1] {
+        t.Errorf("expected two saved requests got %v %v", ids, errs)
+    }
+
+    if errs[2] != server.ErrDuplicateRequest || ids[2] != ids[0] {
+        t.Errorf("expected duplicate of first request got %d %v", ids[2], errs[2])
+    }
+
+    if dup, err := storage.Save(keyed); err != server.ErrDuplicateRequest || dup != ids[0] {
+        t.Errorf("expected duplicate of %d got %d %v", ids[0], dup, err)
+    }
+
+    if jobs, _ := storage.List(server.ListFilter{}); len(jobs) != 2 {
+        t.Errorf("expected 2 stored jobs got %d", len(jobs))
+    }
+}
+
+func testBinaryPayload(t *testing.T, storage backend) {
+    req := newTestRequest()
+    req.Payload = "\x1f\x8b\x08\x00\xff\x00"
+    id, err := storage.Save(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    job, err := storage.Get(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if job.Request.Payload != req.Payload || !reflect.DeepEqual(job.Request.Headers, req.Headers) {
+        t.Errorf("expected exact payload bytes and headers got %q %+v", job.Request.Payload, job.Request.Headers)
+    }
+}
+
+func testList(t *testing.T, storage backend) {
+    var ids []uint64
+    for i := 0; i < 3; i++ {
+        id, err := storage.Save(newTestRequest())
+        if err != nil {
+            t.Fatal(err)
+        }
+        ids = append(ids, id)
+    }
+    if err := storage.Cancel(ids[1]); err != nil {
+        t.Fatal(err)
+    }
+
+    jobs, err := storage.List(server.ListFilter{Status: server.StatusInitial, Limit: 10})
+    if err != nil || len(jobs) != 2 || jobs[0].Request.Id != ids[0] || jobs[1].Request.Id != ids[2] {
+        t.Errorf("expected initial jobs got %+v %v", jobs, err)
+    }
+
+    jobs, err = storage.List(server.ListFilter{Status: server.StatusCancelled})
+    if err != nil || len(jobs) != 1 || jobs[0].Request.Id != ids[1] || jobs[0].CancelledAt.IsZero() {
+        t.Errorf("expected cancelled job got %+v %v", jobs, err)
+    }
+
+    jobs, err = storage.List(server.ListFilter{AfterId: ids[0], Limit: 1})
+    if err != nil || len(jobs) != 1 || jobs[0].Request.Id != ids[1] {
+        t.Errorf("expected page with second job got %+v %v", jobs, err)
+    }
+}
+
+func testTenants(t *testing.T, storage backend) {
+    a, b := newTestRequest(), newTestRequest()
+    a.Tenant, b.Tenant = "team-a", "team-b"
+    a.IdempotencyKey, b.IdempotencyKey = "key-1", "key-1"
+    a.IdempotencyExpiresAt = uint64(time.Now().UnixMilli()) + 60_000
+    b.IdempotencyExpiresAt = a.IdempotencyExpiresAt
+
+    ids, errs := storage.SaveBatch([]server.ScheduleRequest{a, b, b})
+    if errs[0] != nil || errs[1] != nil || ids[0] == ids[1] {
+        t.Errorf("expected same key of different tenants to be saved got %v %v", ids, errs)
+    }
+    if !errors.Is(errs[2], server.ErrDuplicateRequest) || ids[2] != ids[1] {
+        t.Errorf("expected duplicate within tenant got %d %v", ids[2], errs[2])
+    }
+
+    jobs, err := storage.List(server.ListFilter{Tenant: "team-b"})
+    if err != nil || len(jobs) != 1 || jobs[0].Request.Id != ids[1] || jobs[0].Request.Tenant != "team-b" {
+        t.Errorf("expected only team-b job got %+v %v", jobs, err)
+    }
+
+    job, err := storage.Get(ids[0])
+    if err != nil || job.Request.Tenant != "team-a" {
+        t.Errorf("expected tenant on job got %+v %v", job, err)
+    }
+}
+
+func testLoadFair(t *testing.T, storage backend) {
+    // noisy neighbour schedules a big backlog for the same millisecond
+    noisy := make([]server.ScheduleRequest, 1_000)
+    for i := range noisy {
+        noisy[i] = newTestRequest()
+        noisy[i].Tenant, noisy[i].Endpoint, noisy[i].SendAfter = "noisy", "http://a.com/hook", 1
+    }
+    if _, errs := storage.SaveBatch(noisy); errs[0] != nil {
+        t.Fatal(errs[0])
+    }
+
+    quiet := newTestRequest()
+    quiet.Tenant, quiet.Endpoint, quiet.SendAfter = "quiet", "http://b.com/hook", 2
+    quietId, err := storage.Save(quiet)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    otherHost := newTestRequest()
+    otherHost.Tenant, otherHost.Endpoint, otherHost.SendAfter = "noisy", "https://C.com:8443/hook", 3
+    otherHostId, err := storage.Save(otherHost)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    loaded := make(map[uint64]bool)
+    for _, r := range storage.Load(4) {
+        loaded[r.Id] = true
+    }
+
+    if len(loaded) != 4 || !loaded[quietId] || !loaded[otherHostId] {
+        t.Errorf("expected quiet tenant and other host in batch got %v", loaded)
+    }
+}
+
+func testDeadLetters(t *testing.T, storage backend) {
+    failed, expired := newTestRequest(), newTestRequest()
+    failed.SendAfter, failed.Tenant = 1, "team-a"
+    expired.TimeToLive = uint64(time.Now().UnixMilli()) - 1
+    idFailed, err := storage.Save(failed)
+    if err != nil {
+        t.Fatal(err)
+    }
+    idExpired, err := storage.Save(expired)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    loaded := storage.Load(10)
+    if len(loaded) != 1 || loaded[0].Id != idFailed {
+        t.Fatalf("expected only job which did not expire to be loaded got %+v", loaded)
+    }
+
+    storage.AddAttempt(idFailed, server.Attempt{At: time.Now(), StatusCode: 500})
+    storage.AddAttempt(idFailed, server.Attempt{At: time.Now(), StatusCode: 503, Error: "unavailable"})
+    storage.DeadLetter(loaded[0], server.DeadReasonExhausted)
+
+    if _, err := storage.Get(idFailed); !errors.Is(err, server.ErrJobNotFound) {
+        t.Errorf("expected dead lettered job to leave the queue got %v", err)
+    }
+
+    dl, err := storage.GetDeadLetter(idFailed)
+    if err != nil || dl.Reason != server.DeadReasonExhausted || dl.Attempts != 2 || dl.LastStatusCode != 503 ||
+        dl.LastError != "unavailable" || dl.Request.Payload != failed.Payload || dl.Request.Tenant != "team-a" || dl.DeadAt.IsZero() {
+        t.Errorf("unexpected dead letter %+v %v", dl, err)
+    }
+
+    dl, err = storage.GetDeadLetter(idExpired)
+    if err != nil || dl.Reason != server.DeadReasonExpired || dl.Attempts != 0 {
+        t.Errorf("expected expired job to be dead lettered got %+v %v", dl, err)
+    }
+
+    dls, err := storage.ListDeadLetters(server.DeadLetterFilter{Tenant: "team-a"})
+    if err != nil || len(dls) != 1 || dls[0].Request.Id != idFailed {
+        t.Errorf("expected only team-a dead letter got %+v %v", dls, err)
+    }
+
+    if n, err := storage.CountDeadLetters(); err != nil || n != 2 {
+        t.Errorf("expected 2 dead letters got %d %v", n, err)
+    }
+
+    if jobs, _ := storage.List(server.ListFilter{}); len(jobs) != 0 {
+        t.Errorf("expected no jobs left got %+v", jobs)
+    }
+
+    if _, err := storage.GetDeadLetter(idExpired + 1); !errors.Is(err, server.ErrDeadLetterNotFound) {
+        t.Errorf("expected not found got %v", err)
+    }
+}
+
+func testRedrive(t *testing.T, storage backend) {
+    a, b := newTestRequest(), newTestRequest()
+    a.SendAfter, a.Tenant, a.Endpoint = 1, "team-a", "http://a.com/x"
+    a.IdempotencyKey, a.IdempotencyExpiresAt = "key-a", uint64(time.Now().UnixMilli()) + 60_000
+    b.SendAfter, b.Endpoint = 1, "http://b.com/x"
+    ids, errs := storage.SaveBatch([]server.ScheduleRequest{a, b})
+    if errs[0] != nil || errs[1] != nil {
+        t.Fatal(errs)
+    }
+
+    // version a client may hold from before the job died
+    payload := "patched"
+    if _, err := storage.Patch(ids[0], 1, server.JobPatch{Payload: &payload}); err != nil {
+        t.Fatal(err)
+    }
+    for _, req := range storage.Load(10) {
+        storage.AddAttempt(req.Id, server.Attempt{At: time.Now(), StatusCode: 502, LatencyMs: 7})
+        storage.AddAttempt(req.Id, server.Attempt{At: time.Now(), StatusCode: 500, Error: "down"})
+        storage.DeadLetter(req, server.DeadReasonExhausted)
+    }
+
+    expired := newTestRequest()
+    expired.Endpoint, expired.TimeToLive = "http://a.com/y", uint64(time.Now().UnixMilli()) - 1
+    idExpired, err := storage.Save(expired)
+    if err != nil {
+        t.Fatal(err)
+    }
+    storage.Load(10)
+
+    filter := server.RedriveFilter{Host: "A.com", DeadAfter: time.Now().Add(-time.Hour)}
+    if res, err := storage.Redrive(filter, server.RedriveOverride{}, true); err != nil || res != (server.RedriveResult{Redriven: 1, Skipped: 1}) {
+        t.Errorf("expected dry run to count 1 and skip expired got %+v %v", res, err)
+    }
+    if n, _ := storage.CountDeadLetters(); n != 3 {
+        t.Errorf("expected dry run to keep dead letters got %d", n)
+    }
+
+    sendAfter, maxRetry := uint64(2), 3
+    res, err := storage.Redrive(filter, server.RedriveOverride{SendAfter: &sendAfter, MaxRetry: &maxRetry}, false)
+    if err != nil || res != (server.RedriveResult{Redriven: 1, Skipped: 1}) {
+        t.Errorf("expected 1 redriven and expired skipped got %+v %v", res, err)
+    }
+    if _, err := storage.GetDeadLetter(idExpired); err != nil {
+        t.Errorf("expected expired dead letter to stay got %v", err)
+    }
+
+    job, err := storage.Get(ids[0])
+    if err != nil || job.Status != server.StatusInitial || job.Request.SendAfter != 2 || job.Request.MaxRetry != 3 ||
+        job.Request.Tenant != "team-a" || job.Request.Payload != payload || job.Version != 1 {
+        t.Errorf("unexpected redriven job %+v %v", job, err)
+    }
+    if len(job.Attempts) != 2 || job.Attempts[0].StatusCode != 502 || job.Attempts[0].LatencyMs != 7 ||
+        job.Attempts[1].StatusCode != 500 || job.Attempts[1].Error != "down" {
+        t.Errorf("expected redriven job to keep its attempts got %+v", job.Attempts)
+    }
+    if dup, err := storage.Save(a); !errors.Is(err, server.ErrDuplicateRequest) || dup != ids[0] {
+        t.Errorf("expected redriven job to keep its idempotency key got %d %v", dup, err)
+    }
+    if _, err := storage.GetDeadLetter(ids[0]); !errors.Is(err, server.ErrDeadLetterNotFound) {
+        t.Errorf("expected redriven dead letter to be gone got %v", err)
+    }
+    if _, err := storage.GetDeadLetter(ids[1]); err != nil {
+        t.Errorf("expected other dead letter to stay got %v", err)
+    }
+
+    // a new time to live brings the expired one back
+    ttl := uint64(time.Now().UnixMilli()) + 60_000
+    res, err = storage.Redrive(server.RedriveFilter{Ids: []uint64{idExpired}}, server.RedriveOverride{TimeToLive: &ttl}, false)
+    if err != nil || res != (server.RedriveResult{Redriven: 1}) {
+        t.Errorf("expected expired dead letter to be redriven with new ttl got %+v %v", res, err)
+    }
+    if job, err := storage.Get(idExpired); err != nil || job.Request.TimeToLive != ttl {
+        t.Errorf("expected redriven job with new ttl got %+v %v", job, err)
+    }
+
+    loaded := make(map[uint64]bool)
+    for _, r := range storage.Load(10) {
+        loaded[r.Id] = true
+    }
+    if len(loaded) != 2 || !loaded[ids[0]] || !loaded[idExpired] {
+        t.Errorf("expected redriven jobs to be loaded got %v", loaded)
+    }
+}
+
+func testPurge(t *testing.T, storage backend) {
+    ids := make([]uint64, 4)
+    for i := range ids {
+        req := newTestRequest()
+        req.IdempotencyKey = fmt.Sprintf("key-%d", i)
+        req.IdempotencyExpiresAt = uint64(time.Now().Add(time.Hour).UnixMilli())
+        id, err := storage.Save(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        ids[i] = id
+    }
+
+    if err := storage.Cancel(ids[3]); err != nil {
+        t.Fatal(err)
+    }
+    loaded := storage.Load(2)
+    for _, r := range loaded {
+        if r.Id == ids[0] {
+            storage.Done(r)
+        }
+    }
+
+    if n, err := storage.Purge(time.Now().Add(-time.Hour), 0); err != nil || n != 0 {
+        t.Errorf("expected no job finished an hour ago got %d %v", n, err)
+    }
+
+    if n, err := storage.Purge(time.Now().Add(time.Second), 1); err != nil || n != 1 {
+        t.Errorf("expected purge limited to 1 job got %d %v", n, err)
+    }
+
+    if n, err := storage.Purge(time.Now().Add(time.Second), 0); err != nil || n != 1 {
+        t.Errorf("expected last finished job to be purged got %d %v", n, err)
+    }
+
+    for i, id := range ids {
+        _, err := storage.Get(id)
+        if purged := i == 0 || i == 3; purged != errors.Is(err, server.ErrJobNotFound) {
+            t.Errorf("job %d expected purged %t got %v", id, purged, err)
+        }
+    }
+
+    req := newTestRequest()
+    req.IdempotencyKey = "key-0"
+    req.IdempotencyExpiresAt = uint64(time.Now().Add(time.Hour).UnixMilli())
+    if _, err := storage.Save(req); err != nil {
+        t.Errorf("expected key of purged job to be free got %v", err)
+    }
+}
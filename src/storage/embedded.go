@@ -0,0 +1,972 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	srv "github.com/kucicm/boomerang/src/server"
+)
+
+const (
+    logFileName = "queue.log"
+    indexFileName = "queue.idx"
+    indexMagic = "BIDX6"
+
+    frameHeaderSize = 8
+    minCompactionSize = 1 << 20
+)
+
+const (
+    opPut byte = iota + 1
+    opDelete
+    opMeta
+)
+
+type EmbeddedStorageCfg struct {
+    Dir string
+    SyncWrites bool
+}
+
+type logRecord struct {
+    Op byte
+    Req srv.ScheduleRequest
+    Status int
+    Attempts []srv.Attempt
+    CancelledAt int64
+    FinishedAt int64
+    Version uint64
+    DeadReason string
+    DeadAt int64
+}
+
+// EmbeddedStorage keeps schedule requests in an append-only log and
+// an in-memory time index which is persisted on compaction and shutdown.
+// Claims (status running) are not logged, after a restart every request
+// which was not deleted or done is ready to be loaded again. Dead letters
+// stay in the log with status dead and are kept apart from entries.
+type EmbeddedStorage struct {
+    mu sync.Mutex
+    cfg EmbeddedStorageCfg
+    log *os.File
+    logSize int64
+    liveSize int64
+    nextId uint64
+    entries map[uint64]*queueEntry
+    dead map[uint64]*queueEntry
+    ready fairQueue
+    keys map[string]idempotencyKey
+}
+
+func NewEmbeddedStorage(cfg EmbeddedStorageCfg) (*EmbeddedStorage, error) {
+    if cfg.Dir == "" {
+        return nil, errors.New("embedded storage directory not set")
+    }
+
+    if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+        return nil, fmt.Errorf("cannot create embedded storage directory %v", err)
+    }
+
+    f, err := os.OpenFile(filepath.Join(cfg.Dir, logFileName), os.O_RDWR|os.O_CREATE, 0o644)
+    if err != nil {
+        return nil, fmt.Errorf("cannot open embedded storage log %v", err)
+    }
+
+    s := &EmbeddedStorage{
+        cfg: cfg,
+        log: f,
+        entries: make(map[uint64]*queueEntry),
+        dead: make(map[uint64]*queueEntry),
+        keys: make(map[string]idempotencyKey),
+    }
+
+    if err := s.open(); err != nil {
+        f.Close()
+        return nil, err
+    }
+
+    log.Printf("Embedded storage opened with %d requests and %d dead letters\n", len(s.entries), len(s.dead))
+    return s, nil
+}
+
+func (s *EmbeddedStorage) Save(r srv.ScheduleRequest) (uint64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.save(r)
+}
+
+func (s *EmbeddedStorage) SaveBatch(reqs []srv.ScheduleRequest) ([]uint64, []error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ids, errs := make([]uint64, len(reqs)), make([]error, len(reqs))
+    for i, r := range reqs {
+        ids[i], errs[i] = s.save(r)
+    }
+    return ids, errs
+}
+
+func (s *EmbeddedStorage) save(r srv.ScheduleRequest) (uint64, error) {
+    if k, ok := s.keys[keyOf(r)]; ok && !k.expired(uint64(time.Now().UnixMilli())) {
+        if _, ok := s.entries[k.id]; ok {
+            return k.id, srv.ErrDuplicateRequest
+        }
+    }
+
+    r.Id = s.nextId + 1
+    offset, size, err := s.append(logRecord{Op: opPut, Req: r, Version: 1})
+    if err != nil {
+        log.Printf("Error saving to embedded storage %s\n", err)
+        return 0, err
+    }
+    s.nextId = r.Id
+    s.addKey(r)
+
+    s.add(&queueEntry{
+        id: r.Id,
+        sendAfter: r.SendAfter,
+        timeToLive: r.TimeToLive,
+        offset: offset,
+        size: size,
+        status: statusInitial,
+        tenant: tenantOf(r),
+        host: srv.HostOf(r.Endpoint),
+    })
+    return r.Id, nil
+}
+
+func (s *EmbeddedStorage) Load(bs uint) []srv.ScheduleRequest {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ready, expired := s.ready.pop(bs, uint64(time.Now().UnixMilli()))
+    for _, e := range expired {
+        if err := s.kill(e, srv.DeadReasonExpired); err != nil {
+            log.Printf("error moving expired task with id %d to dead letters, err: %s\n", e.id, err)
+        }
+    }
+
+    out := make([]srv.ScheduleRequest, 0, bs)
+    for _, e := range ready {
+        rec, err := s.read(e.offset, e.size)
+        if err != nil {
+            log.Printf("Error loading schedule request %d from embedded storage %s\n", e.id, err)
+            continue
+        }
+        e.status = statusRunning
+        out = append(out, rec.Req)
+    }
+    return out
+}
+
+func (s *EmbeddedStorage) Update(task srv.ScheduleRequest) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    e, ok := s.entries[task.Id]
+    if !ok {
+        log.Printf("update of id %d caused 0 updates\n", task.Id)
+        return
+    }
+
+    err := s.rewrite(e, statusInitial, func(rec *logRecord) error {
+        rec.Req.SendAfter = task.SendAfter
+        rec.Req.MaxRetry = task.MaxRetry
+        rec.Req.LastBackOffMs = task.LastBackOffMs
+        rec.Version++
+        return nil
+    })
+    if err != nil {
+        log.Printf("error on update of task with id %d, err: %s\n", task.Id, err)
+    }
+}
+
+func (s *EmbeddedStorage) Done(task srv.ScheduleRequest) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    e, ok := s.entries[task.Id]
+    if !ok {
+        return
+    }
+
+    err := s.rewrite(e, statusDone, func(rec *logRecord) error {
+        rec.FinishedAt = time.Now().UnixMilli()
+        rec.Version++
+        return nil
+    })
+    if err != nil {
+        log.Printf("error marking task with id %d done, err: %s\n", task.Id, err)
+    }
+}
+
+func (s *EmbeddedStorage) AddAttempt(id uint64, attempt srv.Attempt) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    e, ok := s.entries[id]
+    if !ok {
+        return
+    }
+
+    err := s.rewrite(e, e.status, func(rec *logRecord) error {
+        rec.Attempts = append(rec.Attempts, attempt)
+        return nil
+    })
+    if err != nil {
+        log.Printf("error saving attempt of task with id %d, err: %s\n", id, err)
+    }
+}
+
+func (s *EmbeddedStorage) Get(id uint64) (srv.Job, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    e, ok := s.entries[id]
+    if !ok {
+        return srv.Job{}, srv.ErrJobNotFound
+    }
+
+    rec, err := s.read(e.offset, e.size)
+    if err != nil {
+        return srv.Job{}, err
+    }
+    return recordJob(rec, e.status), nil
+}
+
+func recordJob(rec logRecord, status int) srv.Job {
+    job := srv.Job{Request: rec.Req, Status: statusName(status), Attempts: rec.Attempts, Version: rec.Version}
+    if rec.CancelledAt != 0 {
+        job.CancelledAt = time.UnixMilli(rec.CancelledAt).UTC()
+    }
+    return job
+}
+
+func (s *EmbeddedStorage) List(filter srv.ListFilter) ([]srv.Job, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ids := make([]uint64, 0)
+    for id, e := range s.entries {
+        if id > filter.AfterId && matches(filter, e.tenant, e.status) {
+            ids = append(ids, id)
+        }
+    }
+    ids = firstIds(ids, filter.Limit)
+
+    out := make([]srv.Job, len(ids))
+    for i, id := range ids {
+        e := s.entries[id]
+        rec, err := s.read(e.offset, e.size)
+        if err != nil {
+            return nil, err
+        }
+        out[i] = recordJob(rec, e.status)
+        out[i].Attempts = nil
+    }
+    return out, nil
+}
+
+func (s *EmbeddedStorage) Cancel(id uint64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    e, ok := s.entries[id]
+    if !ok {
+        return srv.ErrJobNotFound
+    }
+
+    if e.status != statusInitial {
+        return fmt.Errorf("%w: job is %s", srv.ErrJobNotPending, statusName(e.status))
+    }
+
+    return s.rewrite(e, statusCancelled, func(rec *logRecord) error {
+        rec.CancelledAt = time.Now().UnixMilli()
+        rec.FinishedAt = rec.CancelledAt
+        rec.Version++
+        return nil
+    })
+}
+
+func (s *EmbeddedStorage) Delete(task srv.ScheduleRequest) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    e, ok := s.entries[task.Id]
+    if !ok {
+        return
+    }
+
+    if err := s.delete(e); err != nil {
+        log.Printf("failed to delete task with id %d error: %s\n", task.Id, err)
+        return
+    }
+    s.maybeCompact()
+}
+
+// Purge deletes at most limit (zero for all) done and cancelled jobs finished before
+func (s *EmbeddedStorage) Purge(before time.Time, limit int) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ids := make([]uint64, 0)
+    for id, e := range s.entries {
+        if e.purgeable(before.UnixMilli()) {
+            ids = append(ids, id)
+        }
+    }
+
+    ids = firstIds(ids, limit)
+    for i, id := range ids {
+        if err := s.delete(s.entries[id]); err != nil {
+            return i, fmt.Errorf("cannot purge job %d %v", id, err)
+        }
+    }
+    s.maybeCompact()
+    return len(ids), nil
+}
+
+func (s *EmbeddedStorage) delete(e *queueEntry) error {
+    if _, _, err := s.append(logRecord{Op: opDelete, Req: srv.ScheduleRequest{Id: e.id}}); err != nil {
+        return err
+    }
+    s.remove(e)
+    return nil
+}
+
+func (s *EmbeddedStorage) DeadLetter(task srv.ScheduleRequest, reason string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    e, ok := s.entries[task.Id]
+    if !ok {
+        return
+    }
+
+    if err := s.kill(e, reason); err != nil {
+        log.Printf("error moving task with id %d to dead letters, err: %s\n", task.Id, err)
+    }
+}
+
+func (s *EmbeddedStorage) GetDeadLetter(id uint64) (srv.DeadLetter, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    e, ok := s.dead[id]
+    if !ok {
+        return srv.DeadLetter{}, srv.ErrDeadLetterNotFound
+    }
+
+    rec, err := s.read(e.offset, e.size)
+    if err != nil {
+        return srv.DeadLetter{}, err
+    }
+    return recordDeadLetter(rec), nil
+}
+
+func (s *EmbeddedStorage) ListDeadLetters(filter srv.DeadLetterFilter) ([]srv.DeadLetter, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ids := make([]uint64, 0)
+    for id, e := range s.dead {
+        if id > filter.AfterId && (filter.Tenant == "" || e.tenant == filter.Tenant) {
+            ids = append(ids, id)
+        }
+    }
+    ids = firstIds(ids, filter.Limit)
+
+    out := make([]srv.DeadLetter, len(ids))
+    for i, id := range ids {
+        e := s.dead[id]
+        rec, err := s.read(e.offset, e.size)
+        if err != nil {
+            return nil, err
+        }
+        out[i] = recordDeadLetter(rec)
+    }
+    return out, nil
+}
+
+func (s *EmbeddedStorage) CountDeadLetters() (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.dead), nil
+}
+
+func recordDeadLetter(rec logRecord) srv.DeadLetter {
+    return newDeadLetter(rec.Req, rec.Attempts, rec.DeadReason, time.UnixMilli(rec.DeadAt))
+}
+
+func (s *EmbeddedStorage) Redrive(filter srv.RedriveFilter, override srv.RedriveOverride, dryRun bool) (srv.RedriveResult, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ids := make([]uint64, 0, len(s.dead))
+    for id := range s.dead {
+        ids = append(ids, id)
+    }
+
+    var res srv.RedriveResult
+    now := uint64(time.Now().UnixMilli())
+    for _, id := range ids {
+        e := s.dead[id]
+        rec, err := s.read(e.offset, e.size)
+        if err != nil {
+            return res, err
+        }
+
+        if !filter.Matches(recordDeadLetter(rec)) {
+            continue
+        }
+
+        req := rec.Req
+        override.Apply(&req)
+        if !srv.Redrivable(req, now) {
+            res.Skipped++
+            continue
+        }
+
+        if !dryRun {
+            err := s.rewrite(e, statusInitial, func(rec *logRecord) error {
+                override.Apply(&rec.Req)
+                rec.Req.LastBackOffMs = 0
+                rec.DeadReason, rec.DeadAt = "", 0
+                rec.Version = 1
+                return nil
+            })
+            if err != nil {
+                return res, err
+            }
+        }
+        res.Redriven++
+    }
+    return res, nil
+}
+
+// kill moves entry to dead letters
+func (s *EmbeddedStorage) kill(e *queueEntry, reason string) error {
+    return s.rewrite(e, statusDead, func(rec *logRecord) error {
+        rec.DeadReason, rec.DeadAt = reason, time.Now().UnixMilli()
+        rec.Version++
+        return nil
+    })
+}
+
+func (s *EmbeddedStorage) Patch(id uint64, version uint64, patch srv.JobPatch) (srv.Job, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    e, ok := s.entries[id]
+    if !ok {
+        return srv.Job{}, srv.ErrJobNotFound
+    }
+
+    if e.status != statusInitial {
+        return srv.Job{}, fmt.Errorf("%w: job is %s", srv.ErrJobNotPending, statusName(e.status))
+    }
+
+    err := s.rewrite(e, statusInitial, func(rec *logRecord) error {
+        if version != 0 && version != rec.Version {
+            return fmt.Errorf("%w: job is at version %d", srv.ErrVersionMismatch, rec.Version)
+        }
+        patch.Apply(&rec.Req)
+        rec.Version++
+        return nil
+    })
+    if err != nil {
+        return srv.Job{}, err
+    }
+
+    e = s.entries[id]
+    rec, err := s.read(e.offset, e.size)
+    if err != nil {
+        return srv.Job{}, err
+    }
+    return recordJob(rec, e.status), nil
+}
+
+func (s *EmbeddedStorage) Shutdown() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := s.log.Sync(); err != nil {
+        return fmt.Errorf("cannot sync embedded storage log %v", err)
+    }
+
+    if err := s.writeIndex(); err != nil {
+        return err
+    }
+    return s.log.Close()
+}
+
+func (s *EmbeddedStorage) add(e *queueEntry) {
+    if e.status == statusDead {
+        s.dead[e.id] = e
+    } else {
+        s.entries[e.id] = e
+    }
+    s.liveSize += int64(e.size) + frameHeaderSize
+    e.heapIdx = -1
+    if e.status == statusInitial {
+        s.ready.push(e)
+    }
+}
+
+// addKey maps request idempotency key to its id, a key is owned by the
+// newest request which used it.
+func (s *EmbeddedStorage) addKey(r srv.ScheduleRequest) {
+    if r.IdempotencyKey == "" {
+        return
+    }
+
+    if k, ok := s.keys[keyOf(r)]; ok && k.id > r.Id {
+        return
+    }
+    s.keys[keyOf(r)] = idempotencyKey{r.Id, r.IdempotencyExpiresAt}
+}
+
+// stored returns entry or dead letter with id
+func (s *EmbeddedStorage) stored(id uint64) (*queueEntry, bool) {
+    if e, ok := s.entries[id]; ok {
+        return e, true
+    }
+    e, ok := s.dead[id]
+    return e, ok
+}
+
+// all returns entries and dead letters by id
+func (s *EmbeddedStorage) all() map[uint64]*queueEntry {
+    out := make(map[uint64]*queueEntry, len(s.entries) + len(s.dead))
+    for id, e := range s.entries {
+        out[id] = e
+    }
+    for id, e := range s.dead {
+        out[id] = e
+    }
+    return out
+}
+
+func (s *EmbeddedStorage) remove(e *queueEntry) {
+    delete(s.entries, e.id)
+    delete(s.dead, e.id)
+    s.liveSize -= int64(e.size) + frameHeaderSize
+    s.ready.remove(e)
+}
+
+// rewrite appends a modified copy of entry record and moves entry to status,
+// running is logged as initial since claims do not survive a restart. fn bumps
+// the version when it changes the job, attempts alone do not.
+func (s *EmbeddedStorage) rewrite(e *queueEntry, status int, fn func(*logRecord) error) error {
+    rec, err := s.read(e.offset, e.size)
+    if err != nil {
+        return err
+    }
+
+    if err := fn(&rec); err != nil {
+        return err
+    }
+    rec.Op, rec.Status = opPut, persistedStatus(status)
+
+    offset, size, err := s.append(rec)
+    if err != nil {
+        return err
+    }
+
+    s.remove(e)
+    s.add(&queueEntry{
+        id: e.id,
+        sendAfter: rec.Req.SendAfter,
+        timeToLive: rec.Req.TimeToLive,
+        offset: offset,
+        size: size,
+        status: status,
+        finishedAt: rec.FinishedAt,
+        tenant: tenantOf(rec.Req),
+        host: srv.HostOf(rec.Req.Endpoint),
+    })
+    s.maybeCompact()
+    return nil
+}
+
+func (s *EmbeddedStorage) append(rec logRecord) (int64, uint32, error) {
+    var buf bytes.Buffer
+    buf.Write(make([]byte, frameHeaderSize))
+    if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+        return 0, 0, fmt.Errorf("cannot encode log record %v", err)
+    }
+
+    frame := buf.Bytes()
+    size := uint32(len(frame) - frameHeaderSize)
+    binary.LittleEndian.PutUint32(frame[0:4], size)
+    binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(frame[frameHeaderSize:]))
+
+    offset := s.logSize
+    if _, err := s.log.WriteAt(frame, offset); err != nil {
+        return 0, 0, fmt.Errorf("cannot write log record %v", err)
+    }
+
+    if s.cfg.SyncWrites {
+        if err := s.log.Sync(); err != nil {
+            return 0, 0, fmt.Errorf("cannot sync log %v", err)
+        }
+    }
+
+    s.logSize += int64(len(frame))
+    return offset, size, nil
+}
+
+func (s *EmbeddedStorage) read(offset int64, size uint32) (logRecord, error) {
+    var rec logRecord
+    frame := make([]byte, frameHeaderSize + int(size))
+    if _, err := s.log.ReadAt(frame, offset); err != nil {
+        return rec, fmt.Errorf("cannot read log record at %d %v", offset, err)
+    }
+    return decodeFrame(frame)
+}
+
+func decodeFrame(frame []byte) (logRecord, error) {
+    var rec logRecord
+    size := binary.LittleEndian.Uint32(frame[0:4])
+    if int(size) != len(frame) - frameHeaderSize {
+        return rec, errors.New("log record size mismatch")
+    }
+
+    if crc32.ChecksumIEEE(frame[frameHeaderSize:]) != binary.LittleEndian.Uint32(frame[4:8]) {
+        return rec, errors.New("log record checksum mismatch")
+    }
+
+    if err := gob.NewDecoder(bytes.NewReader(frame[frameHeaderSize:])).Decode(&rec); err != nil {
+        return rec, fmt.Errorf("cannot decode log record %v", err)
+    }
+    return rec, nil
+}
+
+func (s *EmbeddedStorage) open() error {
+    stat, err := s.log.Stat()
+    if err != nil {
+        return fmt.Errorf("cannot stat embedded storage log %v", err)
+    }
+    s.logSize = stat.Size()
+
+    ok, err := s.readIndex()
+    if err != nil {
+        log.Printf("Cannot use embedded storage index, replaying log %s\n", err)
+    }
+
+    if !ok {
+        s.entries = make(map[uint64]*queueEntry)
+        s.dead = make(map[uint64]*queueEntry)
+        s.keys = make(map[string]idempotencyKey)
+        s.ready = fairQueue{}
+        s.liveSize, s.nextId = 0, 0
+        if err := s.replay(); err != nil {
+            return err
+        }
+    }
+
+    // index is only valid for the log it was written with
+    if err := os.Remove(filepath.Join(s.cfg.Dir, indexFileName)); err != nil && !os.IsNotExist(err) {
+        return fmt.Errorf("cannot remove embedded storage index %v", err)
+    }
+    return nil
+}
+
+func (s *EmbeddedStorage) replay() error {
+    r := bufio.NewReader(io.NewSectionReader(s.log, 0, s.logSize))
+    var offset int64
+    header := make([]byte, frameHeaderSize)
+    for {
+        if _, err := io.ReadFull(r, header); err != nil {
+            if err != io.EOF {
+                log.Printf("Torn log record header at %d, truncating\n", offset)
+            }
+            break
+        }
+
+        size := binary.LittleEndian.Uint32(header[0:4])
+        frame := make([]byte, frameHeaderSize + int(size))
+        copy(frame, header)
+        if _, err := io.ReadFull(r, frame[frameHeaderSize:]); err != nil {
+            log.Printf("Torn log record at %d, truncating\n", offset)
+            break
+        }
+
+        rec, err := decodeFrame(frame)
+        if err != nil {
+            log.Printf("Corrupted log record at %d, truncating %s\n", offset, err)
+            break
+        }
+
+        if rec.Req.Id > s.nextId {
+            s.nextId = rec.Req.Id
+        }
+
+        switch rec.Op {
+        case opPut:
+            if e, ok := s.stored(rec.Req.Id); ok {
+                s.remove(e)
+            }
+            s.add(&queueEntry{
+                id: rec.Req.Id,
+                sendAfter: rec.Req.SendAfter,
+                timeToLive: rec.Req.TimeToLive,
+                offset: offset,
+                size: size,
+                status: rec.Status,
+                finishedAt: rec.FinishedAt,
+                tenant: tenantOf(rec.Req),
+                host: srv.HostOf(rec.Req.Endpoint),
+            })
+            s.addKey(rec.Req)
+        case opDelete:
+            if e, ok := s.stored(rec.Req.Id); ok {
+                s.remove(e)
+            }
+        }
+        offset += int64(len(frame))
+    }
+
+    if offset != s.logSize {
+        if err := s.log.Truncate(offset); err != nil {
+            return fmt.Errorf("cannot truncate embedded storage log %v", err)
+        }
+        s.logSize = offset
+    }
+    return nil
+}
+
+func (s *EmbeddedStorage) maybeCompact() {
+    if s.logSize < minCompactionSize || s.logSize < 2 * s.liveSize {
+        return
+    }
+
+    if err := s.compact(); err != nil {
+        log.Printf("Embedded storage compaction failed %s\n", err)
+    }
+}
+
+// compact rewrites the log with only live records, the meta record keeps
+// the id sequence so ids of deleted requests are never reused.
+func (s *EmbeddedStorage) compact() error {
+    start := time.Now()
+    tmpPath := filepath.Join(s.cfg.Dir, logFileName + ".tmp")
+    tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+    if err != nil {
+        return fmt.Errorf("cannot create compacted log %v", err)
+    }
+
+    old, oldSize := s.log, s.logSize
+    s.log, s.logSize = tmp, 0
+
+    rollback := func(err error) error {
+        tmp.Close()
+        os.Remove(tmpPath)
+        s.log, s.logSize = old, oldSize
+        return err
+    }
+
+    if _, _, err := s.append(logRecord{Op: opMeta, Req: srv.ScheduleRequest{Id: s.nextId}}); err != nil {
+        return rollback(err)
+    }
+
+    offsets := make(map[uint64]int64, len(s.entries) + len(s.dead))
+    for id, e := range s.all() {
+        frame := make([]byte, frameHeaderSize + int(e.size))
+        if _, err := old.ReadAt(frame, e.offset); err != nil {
+            return rollback(fmt.Errorf("cannot read log record at %d %v", e.offset, err))
+        }
+
+        offset := s.logSize
+        if _, err := tmp.WriteAt(frame, offset); err != nil {
+            return rollback(fmt.Errorf("cannot write compacted log %v", err))
+        }
+        s.logSize += int64(len(frame))
+        offsets[id] = offset
+    }
+
+    if err := tmp.Sync(); err != nil {
+        return rollback(fmt.Errorf("cannot sync compacted log %v", err))
+    }
+
+    if err := os.Rename(tmpPath, filepath.Join(s.cfg.Dir, logFileName)); err != nil {
+        return rollback(fmt.Errorf("cannot replace log with compacted log %v", err))
+    }
+    old.Close()
+
+    all := s.all()
+    for id, o := range offsets {
+        all[id].offset = o
+    }
+    s.pruneKeys()
+    s.liveSize = s.logSize
+
+    if err := s.writeIndex(); err != nil {
+        log.Printf("Cannot write embedded storage index %s\n", err)
+    }
+
+    log.Printf("Embedded storage compacted %d -> %d bytes in %s\n", oldSize, s.logSize, time.Since(start))
+    return nil
+}
+
+// pruneKeys drops keys which expired or whose request was deleted, keys of
+// dead letters are kept for redrive
+func (s *EmbeddedStorage) pruneKeys() {
+    now := uint64(time.Now().UnixMilli())
+    for key, k := range s.keys {
+        if _, ok := s.stored(k.id); !ok || k.expired(now) {
+            delete(s.keys, key)
+        }
+    }
+}
+
+// index file layout (little endian):
+//   magic | log size | next id | count | count * (id, send after, time to live, offset, size, status,
+//   finished at, tenant length u16, tenant, host length u16, host)
+//   | key count | key count * (key length u16, key, id, expires at)
+func (s *EmbeddedStorage) writeIndex() error {
+    path := filepath.Join(s.cfg.Dir, indexFileName)
+    f, err := os.Create(path + ".tmp")
+    if err != nil {
+        return fmt.Errorf("cannot create embedded storage index %v", err)
+    }
+    defer f.Close()
+
+    w := bufio.NewWriter(f)
+    w.WriteString(indexMagic)
+    binary.Write(w, binary.LittleEndian, s.logSize)
+    binary.Write(w, binary.LittleEndian, s.nextId)
+    binary.Write(w, binary.LittleEndian, uint64(len(s.entries) + len(s.dead)))
+
+    // sorted by send after so index is readable as a time index
+    sorted := make(timeIndex, 0, len(s.entries) + len(s.dead))
+    for _, e := range s.all() {
+        sorted = append(sorted, e)
+    }
+    sortTimeIndex(sorted)
+
+    for _, e := range sorted {
+        binary.Write(w, binary.LittleEndian, e.id)
+        binary.Write(w, binary.LittleEndian, e.sendAfter)
+        binary.Write(w, binary.LittleEndian, e.timeToLive)
+        binary.Write(w, binary.LittleEndian, e.offset)
+        binary.Write(w, binary.LittleEndian, e.size)
+        binary.Write(w, binary.LittleEndian, uint8(persistedStatus(e.status)))
+        binary.Write(w, binary.LittleEndian, e.finishedAt)
+        for _, v := range []string{e.tenant, e.host} {
+            binary.Write(w, binary.LittleEndian, uint16(len(v)))
+            w.WriteString(v)
+        }
+    }
+
+    s.pruneKeys()
+    binary.Write(w, binary.LittleEndian, uint64(len(s.keys)))
+    for key, k := range s.keys {
+        binary.Write(w, binary.LittleEndian, uint16(len(key)))
+        w.WriteString(key)
+        binary.Write(w, binary.LittleEndian, k.id)
+        binary.Write(w, binary.LittleEndian, k.expiresAt)
+    }
+
+    if err := w.Flush(); err != nil {
+        return fmt.Errorf("cannot write embedded storage index %v", err)
+    }
+
+    if err := f.Sync(); err != nil {
+        return fmt.Errorf("cannot sync embedded storage index %v", err)
+    }
+    return os.Rename(path + ".tmp", path)
+}
+
+func (s *EmbeddedStorage) readIndex() (bool, error) {
+    f, err := os.Open(filepath.Join(s.cfg.Dir, indexFileName))
+    if os.IsNotExist(err) {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    defer f.Close()
+
+    r := bufio.NewReader(f)
+    magic := make([]byte, len(indexMagic))
+    if _, err := io.ReadFull(r, magic); err != nil || string(magic) != indexMagic {
+        return false, errors.New("invalid index header")
+    }
+
+    var logSize int64
+    var nextId, count uint64
+    if err := binary.Read(r, binary.LittleEndian, &logSize); err != nil {
+        return false, err
+    }
+    if logSize != s.logSize {
+        return false, fmt.Errorf("index written for log size %d, log size is %d", logSize, s.logSize)
+    }
+    if err := binary.Read(r, binary.LittleEndian, &nextId); err != nil {
+        return false, err
+    }
+    if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+        return false, err
+    }
+
+    for i := uint64(0); i < count; i++ {
+        e := &queueEntry{}
+        var status uint8
+        fields := []any{&e.id, &e.sendAfter, &e.timeToLive, &e.offset, &e.size, &status, &e.finishedAt}
+        for _, field := range fields {
+            if err := binary.Read(r, binary.LittleEndian, field); err != nil {
+                return false, err
+            }
+        }
+        e.status = int(status)
+
+        for _, v := range []*string{&e.tenant, &e.host} {
+            var size uint16
+            if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+                return false, err
+            }
+            bs := make([]byte, size)
+            if _, err := io.ReadFull(r, bs); err != nil {
+                return false, err
+            }
+            *v = string(bs)
+        }
+        s.add(e)
+    }
+
+    if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+        return false, err
+    }
+    for i := uint64(0); i < count; i++ {
+        var size uint16
+        if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+            return false, err
+        }
+
+        key := make([]byte, size)
+        if _, err := io.ReadFull(r, key); err != nil {
+            return false, err
+        }
+
+        var k idempotencyKey
+        if err := binary.Read(r, binary.LittleEndian, &k.id); err != nil {
+            return false, err
+        }
+        if err := binary.Read(r, binary.LittleEndian, &k.expiresAt); err != nil {
+            return false, err
+        }
+        s.keys[string(key)] = k
+    }
+    s.nextId = nextId
+    return true, nil
+}
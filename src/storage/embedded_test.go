@@ -0,0 +1,442 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kucicm/boomerang/src/server"
+)
+
+func newTestEmbeddedStorage(t *testing.T, dir string) *EmbeddedStorage {
+    storage, err := NewEmbeddedStorage(EmbeddedStorageCfg{Dir: dir})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return storage
+}
+
+func TestEmbeddedReopen(t *testing.T) {
+    for _, withIndex := range []bool{true, false} {
+        dir := t.TempDir()
+        storage := newTestEmbeddedStorage(t, dir)
+
+        for i := 0; i < 3; i++ {
+            if _, err := storage.Save(newTestRequest()); err != nil {
+                t.Error(err)
+            }
+        }
+        if err := storage.delete(storage.entries[2]); err != nil {
+            t.Fatal(err)
+        }
+
+        if withIndex {
+            if err := storage.Shutdown(); err != nil {
+                t.Fatal(err)
+            }
+        } else {
+            storage.log.Close()
+        }
+
+        storage = newTestEmbeddedStorage(t, dir)
+        loaded := storage.Load(10)
+        if len(loaded) != 2 || loaded[0].Id != 1 || loaded[1].Id != 3 {
+            t.Errorf("with index %t expected ids 1 and 3 got %+v", withIndex, loaded)
+        }
+
+        if _, err := storage.Save(newTestRequest()); err != nil {
+            t.Error(err)
+        }
+
+        if storage.nextId != 4 {
+            t.Errorf("with index %t expected next id 4 got %d", withIndex, storage.nextId)
+        }
+        storage.Shutdown()
+    }
+}
+
+func TestEmbeddedTornWrite(t *testing.T) {
+    dir := t.TempDir()
+    storage := newTestEmbeddedStorage(t, dir)
+
+    for i := 0; i < 2; i++ {
+        if _, err := storage.Save(newTestRequest()); err != nil {
+            t.Error(err)
+        }
+    }
+    storage.log.Close()
+
+    path := filepath.Join(dir, logFileName)
+    stat, err := os.Stat(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if err := os.Truncate(path, stat.Size() - 3); err != nil {
+        t.Fatal(err)
+    }
+
+    storage = newTestEmbeddedStorage(t, dir)
+    defer storage.Shutdown()
+
+    loaded := storage.Load(10)
+    if len(loaded) != 1 || loaded[0].Id != 1 {
+        t.Errorf("expected only first request to survive got %+v", loaded)
+    }
+}
+
+func TestEmbeddedCompaction(t *testing.T) {
+    dir := t.TempDir()
+    storage := newTestEmbeddedStorage(t, dir)
+
+    for i := 0; i < 10; i++ {
+        if _, err := storage.Save(newTestRequest()); err != nil {
+            t.Error(err)
+        }
+    }
+
+    for i := uint64(1); i < 10; i++ {
+        if err := storage.delete(storage.entries[i]); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    if err := storage.compact(); err != nil {
+        t.Fatal(err)
+    }
+    storage.log.Close()
+
+    storage = newTestEmbeddedStorage(t, dir)
+    defer storage.Shutdown()
+
+    loaded := storage.Load(10)
+    if len(loaded) != 1 || loaded[0].Id != 10 {
+        t.Errorf("expected only last request to survive compaction got %+v", loaded)
+    }
+
+    if storage.nextId != 10 {
+        t.Errorf("expected next id to survive compaction got %d", storage.nextId)
+    }
+}
+
+func TestEmbeddedJobLifecycle(t *testing.T) {
+    dir := t.TempDir()
+    storage := newTestEmbeddedStorage(t, dir)
+
+    first, err := storage.Save(newTestRequest())
+    if err != nil {
+        t.Fatal(err)
+    }
+    second, err := storage.Save(newTestRequest())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    loaded := storage.Load(2)
+    if job, _ := storage.Get(first); job.Status != server.StatusRunning {
+        t.Errorf("expected running job got %s", job.Status)
+    }
+
+    storage.AddAttempt(first, server.Attempt{StatusCode: 200, LatencyMs: 3})
+    storage.Done(loaded[0])
+    storage.AddAttempt(second, server.Attempt{StatusCode: 500, Error: "ups"})
+
+    for _, reopen := range []bool{false, true} {
+        if reopen {
+            storage.log.Close()
+            storage = newTestEmbeddedStorage(t, dir)
+        }
+
+        job, err := storage.Get(first)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if job.Status != server.StatusDone || len(job.Attempts) != 1 || job.Attempts[0].LatencyMs != 3 {
+            t.Errorf("reopen %t expected done job with one attempt got %+v", reopen, job)
+        }
+
+        job, err = storage.Get(second)
+        if err != nil {
+            t.Fatal(err)
+        }
+        expected := server.StatusRunning
+        if reopen {
+            expected = server.StatusInitial
+        }
+        if job.Status != expected || len(job.Attempts) != 1 || job.Attempts[0].Error != "ups" {
+            t.Errorf("reopen %t expected %s job with failed attempt got %+v", reopen, expected, job)
+        }
+    }
+
+    if loaded := storage.Load(10); len(loaded) != 1 || loaded[0].Id != second {
+        t.Errorf("expected only unfinished job to be loaded got %+v", loaded)
+    }
+    storage.Shutdown()
+}
+
+func TestEmbeddedIdempotencyKey(t *testing.T) {
+    for _, withIndex := range []bool{true, false} {
+        dir := t.TempDir()
+        storage := newTestEmbeddedStorage(t, dir)
+
+        req := newTestRequest()
+        req.IdempotencyKey = "key-1"
+        req.IdempotencyExpiresAt = uint64(time.Now().UnixMilli()) + 60_000
+        id, err := storage.Save(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        expired := newTestRequest()
+        expired.IdempotencyKey = "key-2"
+        expired.IdempotencyExpiresAt = uint64(time.Now().UnixMilli()) - 1
+        if _, err := storage.Save(expired); err != nil {
+            t.Fatal(err)
+        }
+
+        if withIndex {
+            if err := storage.Shutdown(); err != nil {
+                t.Fatal(err)
+            }
+        } else {
+            storage.log.Close()
+        }
+
+        storage = newTestEmbeddedStorage(t, dir)
+        if dup, err := storage.Save(req); err != server.ErrDuplicateRequest || dup != id {
+            t.Errorf("expected duplicate of %d after reopen got %d %v", id, dup, err)
+        }
+
+        if _, err := storage.Save(expired); err != nil {
+            t.Errorf("expected expired key to be reusable got %v", err)
+        }
+
+        if err := storage.Cancel(id); err != nil {
+            t.Fatal(err)
+        }
+        if _, err := storage.Purge(time.Now().Add(time.Second), 0); err != nil {
+            t.Fatal(err)
+        }
+        if _, err := storage.Save(req); err != nil {
+            t.Errorf("expected key of purged job to be reusable got %v", err)
+        }
+        storage.Shutdown()
+    }
+}
+
+func TestEmbeddedTenants(t *testing.T) {
+    dir := t.TempDir()
+    storage := newTestEmbeddedStorage(t, dir)
+
+    a, b := newTestRequest(), newTestRequest()
+    a.Tenant, b.Tenant = "team-a", "team-b"
+    a.IdempotencyKey, b.IdempotencyKey = "key-1", "key-1"
+    a.IdempotencyExpiresAt = uint64(time.Now().UnixMilli()) + 60_000
+    b.IdempotencyExpiresAt = a.IdempotencyExpiresAt
+
+    if _, err := storage.Save(a); err != nil {
+        t.Fatal(err)
+    }
+    idB, err := storage.Save(b)
+    if err != nil {
+        t.Errorf("expected same key of other tenant to be saved got %v", err)
+    }
+
+    // tenants survive reopen from index
+    if err := storage.Shutdown(); err != nil {
+        t.Fatal(err)
+    }
+    storage = newTestEmbeddedStorage(t, dir)
+    defer storage.Shutdown()
+
+    jobs, err := storage.List(server.ListFilter{Tenant: "team-b"})
+    if err != nil || len(jobs) != 1 || jobs[0].Request.Id != idB {
+        t.Errorf("expected only team-b job got %+v %v", jobs, err)
+    }
+
+    if dup, err := storage.Save(b); err != server.ErrDuplicateRequest || dup != idB {
+        t.Errorf("expected duplicate of %d got %d %v", idB, dup, err)
+    }
+}
+
+func TestEmbeddedDeadLetters(t *testing.T) {
+    dir := t.TempDir()
+    storage := newTestEmbeddedStorage(t, dir)
+
+    failed, expired := newTestRequest(), newTestRequest()
+    failed.Tenant = "team-a"
+    expired.TimeToLive = uint64(time.Now().UnixMilli()) - 1
+    idFailed, _ := storage.Save(failed)
+    idExpired, _ := storage.Save(expired)
+
+    loaded := storage.Load(10)
+    if len(loaded) != 1 || loaded[0].Id != idFailed {
+        t.Fatalf("expected only job which did not expire to be loaded got %+v", loaded)
+    }
+
+    storage.AddAttempt(idFailed, server.Attempt{StatusCode: 502})
+    storage.DeadLetter(loaded[0], server.DeadReasonExhausted)
+
+    check := func() {
+        if _, err := storage.Get(idFailed); !errors.Is(err, server.ErrJobNotFound) {
+            t.Errorf("expected dead lettered job to leave the queue got %v", err)
+        }
+
+        dl, err := storage.GetDeadLetter(idFailed)
+        if err != nil || dl.Reason != server.DeadReasonExhausted || dl.Attempts != 1 || dl.LastStatusCode != 502 ||
+            dl.Request.Payload != failed.Payload || dl.DeadAt.IsZero() {
+            t.Errorf("unexpected dead letter %+v %v", dl, err)
+        }
+
+        dls, err := storage.ListDeadLetters(server.DeadLetterFilter{})
+        if err != nil || len(dls) != 2 || dls[1].Request.Id != idExpired || dls[1].Reason != server.DeadReasonExpired {
+            t.Errorf("expected both dead letters got %+v %v", dls, err)
+        }
+
+        if jobs, _ := storage.List(server.ListFilter{}); len(jobs) != 0 {
+            t.Errorf("expected no jobs left got %+v", jobs)
+        }
+    }
+    check()
+
+    // from index
+    if err := storage.Shutdown(); err != nil {
+        t.Fatal(err)
+    }
+    storage = newTestEmbeddedStorage(t, dir)
+    check()
+
+    // from log
+    storage.log.Close()
+    storage = newTestEmbeddedStorage(t, dir)
+    defer storage.Shutdown()
+    check()
+
+    if err := storage.compact(); err != nil {
+        t.Fatal(err)
+    }
+    check()
+}
+
+func TestEmbeddedRedrive(t *testing.T) {
+    dir := t.TempDir()
+    storage := newTestEmbeddedStorage(t, dir)
+
+    a, b := newTestRequest(), newTestRequest()
+    a.SendAfter, a.Tenant = 1, "team-a"
+    a.IdempotencyKey, a.IdempotencyExpiresAt = "key-a", uint64(time.Now().UnixMilli()) + 60_000
+    b.SendAfter = 1
+    idA, _ := storage.Save(a)
+    idB, _ := storage.Save(b)
+    for _, req := range storage.Load(10) {
+        storage.AddAttempt(req.Id, server.Attempt{StatusCode: 500})
+        storage.DeadLetter(req, server.DeadReasonExhausted)
+    }
+
+    expired := newTestRequest()
+    expired.Tenant, expired.TimeToLive = "team-a", uint64(time.Now().UnixMilli()) - 1
+    idExpired, _ := storage.Save(expired)
+    storage.Load(10)
+
+    // key of a dead letter survives compaction
+    if err := storage.compact(); err != nil {
+        t.Fatal(err)
+    }
+
+    filter := server.RedriveFilter{Tenant: "team-a"}
+    if res, err := storage.Redrive(filter, server.RedriveOverride{}, true); err != nil || res != (server.RedriveResult{Redriven: 1, Skipped: 1}) {
+        t.Errorf("expected dry run to count 1 and skip expired got %+v %v", res, err)
+    }
+
+    // a new time to live brings the expired one back too
+    ttl := uint64(time.Now().UnixMilli()) + 60_000
+    if res, err := storage.Redrive(filter, server.RedriveOverride{TimeToLive: &ttl}, false); err != nil || res != (server.RedriveResult{Redriven: 2}) {
+        t.Errorf("expected 2 redriven got %+v %v", res, err)
+    }
+    if job, err := storage.Get(idExpired); err != nil || job.Request.TimeToLive != ttl {
+        t.Errorf("expected expired dead letter to be redriven with new ttl got %+v %v", job, err)
+    }
+
+    if dup, err := storage.Save(a); !errors.Is(err, server.ErrDuplicateRequest) || dup != idA {
+        t.Errorf("expected redriven job to keep its idempotency key got %d %v", dup, err)
+    }
+
+    check := func() {
+        job, err := storage.Get(idA)
+        if err != nil || job.Status != server.StatusInitial || job.Request.TimeToLive != ttl ||
+            len(job.Attempts) != 1 || job.Attempts[0].StatusCode != 500 {
+            t.Errorf("unexpected redriven job %+v %v", job, err)
+        }
+        if _, err := storage.GetDeadLetter(idA); !errors.Is(err, server.ErrDeadLetterNotFound) {
+            t.Errorf("expected redriven dead letter to be gone got %v", err)
+        }
+        if n, _ := storage.CountDeadLetters(); n != 1 {
+            t.Errorf("expected 1 dead letter left got %d", n)
+        }
+    }
+    check()
+
+    // from log
+    storage.log.Close()
+    storage = newTestEmbeddedStorage(t, dir)
+    defer storage.Shutdown()
+    check()
+
+    if loaded := storage.Load(10); len(loaded) != 2 || loaded[0].Id != idA {
+        t.Errorf("expected redriven jobs to be loaded got %+v", loaded)
+    }
+    if _, err := storage.GetDeadLetter(idB); err != nil {
+        t.Errorf("expected other dead letter to stay got %v", err)
+    }
+}
+
+func TestEmbeddedPurge(t *testing.T) {
+    for _, withIndex := range []bool{true, false} {
+        dir := t.TempDir()
+        storage := newTestEmbeddedStorage(t, dir)
+
+        ids := make([]uint64, 3)
+        for i := range ids {
+            id, err := storage.Save(newTestRequest())
+            if err != nil {
+                t.Fatal(err)
+            }
+            ids[i] = id
+        }
+
+        if err := storage.Cancel(ids[2]); err != nil {
+            t.Fatal(err)
+        }
+        storage.Done(storage.Load(1)[0])
+
+        // finish time survives restart
+        if withIndex {
+            if err := storage.Shutdown(); err != nil {
+                t.Fatal(err)
+            }
+        } else {
+            storage.log.Close()
+        }
+        storage = newTestEmbeddedStorage(t, dir)
+
+        if n, err := storage.Purge(time.Now().Add(-time.Hour), 0); err != nil || n != 0 {
+            t.Errorf("with index %t expected no job finished an hour ago got %d %v", withIndex, n, err)
+        }
+
+        if n, err := storage.Purge(time.Now().Add(time.Second), 0); err != nil || n != 2 {
+            t.Errorf("with index %t expected 2 finished jobs purged got %d %v", withIndex, n, err)
+        }
+
+        storage.Shutdown()
+        storage = newTestEmbeddedStorage(t, dir)
+        for i, id := range ids {
+            _, err := storage.Get(id)
+            if purged := i != 1; purged != errors.Is(err, server.ErrJobNotFound) {
+                t.Errorf("with index %t job %d expected purged %t got %v", withIndex, id, purged, err)
+            }
+        }
+        storage.Shutdown()
+    }
+}
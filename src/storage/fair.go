@@ -0,0 +1,129 @@
+package storage
+
+import "container/heap"
+
+// fairQueue keeps a time index per tenant and destination host so one
+// tenant (or one host of a tenant) with a big backlog cannot take every
+// slot of a load.
+type fairQueue struct {
+    tenants map[string]map[string]*timeIndex
+}
+
+func (q *fairQueue) push(e *queueEntry) {
+    if q.tenants == nil {
+        q.tenants = make(map[string]map[string]*timeIndex)
+    }
+
+    hosts, ok := q.tenants[e.tenant]
+    if !ok {
+        hosts = make(map[string]*timeIndex)
+        q.tenants[e.tenant] = hosts
+    }
+
+    index, ok := hosts[e.host]
+    if !ok {
+        index = &timeIndex{}
+        hosts[e.host] = index
+    }
+    heap.Push(index, e)
+}
+
+func (q *fairQueue) remove(e *queueEntry) {
+    if e.heapIdx < 0 {
+        return
+    }
+
+    index := q.tenants[e.tenant][e.host]
+    heap.Remove(index, e.heapIdx)
+    if index.Len() == 0 {
+        q.drop(e.tenant, e.host)
+    }
+}
+
+func (q *fairQueue) Len() int {
+    n := 0
+    for _, hosts := range q.tenants {
+        for _, index := range hosts {
+            n += index.Len()
+        }
+    }
+    return n
+}
+
+func (q *fairQueue) drop(tenant, host string) {
+    delete(q.tenants[tenant], host)
+    if len(q.tenants[tenant]) == 0 {
+        delete(q.tenants, tenant)
+    }
+}
+
+// pop takes up to n entries ready at now. Tenants take turns, within a
+// tenant its hosts take turns and whoever has the oldest overdue entry goes
+// first in a turn. Expired entries met on the way are taken out and
+// returned apart.
+func (q *fairQueue) pop(n uint, now uint64) ([]*queueEntry, []*queueEntry) {
+    out := make([]*queueEntry, 0, n)
+    var expired []*queueEntry
+    tenantTurns := make(map[string]int)
+    hostTurns := make(map[*timeIndex]int)
+    for uint(len(out)) < n {
+        var next *timeIndex
+        var nextTenant string
+        for tenant := range q.tenants {
+            index := q.nextHost(tenant, hostTurns, now, &expired)
+            if index == nil {
+                continue
+            }
+
+            if next == nil || tenantTurns[tenant] < tenantTurns[nextTenant] ||
+                tenantTurns[tenant] == tenantTurns[nextTenant] && older((*index)[0], (*next)[0]) {
+                next, nextTenant = index, tenant
+            }
+        }
+
+        if next == nil {
+            break
+        }
+
+        e := heap.Pop(next).(*queueEntry)
+        out = append(out, e)
+        tenantTurns[nextTenant]++
+        hostTurns[next]++
+        if next.Len() == 0 {
+            q.drop(e.tenant, e.host)
+        }
+    }
+    return out, expired
+}
+
+// nextHost returns time index of tenant host whose turn it is, nil when
+// tenant has nothing ready. Expired heads are moved to expired.
+func (q *fairQueue) nextHost(tenant string, turns map[*timeIndex]int, now uint64, expired *[]*queueEntry) *timeIndex {
+    var next *timeIndex
+    for host, index := range q.tenants[tenant] {
+        for index.Len() > 0 && (*index)[0].sendAfter <= now && (*index)[0].timeToLive < now {
+            *expired = append(*expired, heap.Pop(index).(*queueEntry))
+        }
+
+        if index.Len() == 0 {
+            q.drop(tenant, host)
+            continue
+        }
+
+        if (*index)[0].sendAfter > now {
+            continue
+        }
+
+        if next == nil || turns[index] < turns[next] || turns[index] == turns[next] && older((*index)[0], (*next)[0]) {
+            next = index
+        }
+    }
+    return next
+}
+
+func older(a, b *queueEntry) bool {
+    if a.sendAfter == b.sendAfter {
+        return a.id < b.id
+    }
+    return a.sendAfter < b.sendAfter
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFairQueueTenants(t *testing.T) {
+    var q fairQueue
+    now := uint64(10_000)
+
+    // noisy tenant has a big backlog which is older than anything else
+    for i := uint64(1); i <= 100; i++ {
+        q.push(&queueEntry{id: i, sendAfter: 1_000, timeToLive: 20_000, tenant: "noisy", host: "a.com"})
+    }
+    q.push(&queueEntry{id: 101, sendAfter: 5_000, timeToLive: 20_000, tenant: "quiet", host: "b.com"})
+    q.push(&queueEntry{id: 102, sendAfter: 6_000, timeToLive: 20_000, tenant: "quiet", host: "b.com"})
+    q.push(&queueEntry{id: 103, sendAfter: 7_000, timeToLive: 20_000, tenant: "other", host: "c.com"})
+
+    var ids []uint64
+    ready, _ := q.pop(6, now)
+    for _, e := range ready {
+        ids = append(ids, e.id)
+    }
+
+    // oldest overdue goes first in every turn
+    expected := []uint64{1, 101, 103, 2, 102, 3}
+    if fmt.Sprint(ids) != fmt.Sprint(expected) {
+        t.Errorf("expected %v got %v", expected, ids)
+    }
+
+    if q.Len() != 97 {
+        t.Errorf("expected 97 entries left got %d", q.Len())
+    }
+}
+
+func TestFairQueueHosts(t *testing.T) {
+    var q fairQueue
+    now := uint64(10_000)
+
+    for i := uint64(1); i <= 50; i++ {
+        q.push(&queueEntry{id: i, sendAfter: 1_000, timeToLive: 20_000, tenant: "t", host: "slow.com"})
+    }
+    q.push(&queueEntry{id: 51, sendAfter: 2_000, timeToLive: 20_000, tenant: "t", host: "fast.com"})
+    q.push(&queueEntry{id: 52, sendAfter: 3_000, timeToLive: 20_000, tenant: "t", host: "fast.com"})
+
+    var ids []uint64
+    ready, _ := q.pop(4, now)
+    for _, e := range ready {
+        ids = append(ids, e.id)
+    }
+
+    expected := []uint64{1, 51, 2, 52}
+    if fmt.Sprint(ids) != fmt.Sprint(expected) {
+        t.Errorf("expected hosts of a tenant to take turns %v got %v", expected, ids)
+    }
+}
+
+func TestFairQueueSkipsNotReady(t *testing.T) {
+    var q fairQueue
+    now := uint64(10_000)
+
+    expired := &queueEntry{id: 1, sendAfter: 1_000, timeToLive: 2_000, tenant: "a"}
+    later := &queueEntry{id: 2, sendAfter: 20_000, timeToLive: 30_000, tenant: "a"}
+    removed := &queueEntry{id: 3, sendAfter: 1_000, timeToLive: 30_000, tenant: "b"}
+    q.push(expired)
+    q.push(later)
+    q.push(removed)
+    q.remove(removed)
+
+    out, dropped := q.pop(10, now)
+    if len(out) != 0 {
+        t.Errorf("expected nothing ready got %d entries", len(out))
+    }
+
+    if len(dropped) != 1 || dropped[0] != expired || expired.heapIdx >= 0 {
+        t.Errorf("expected expired entry to be returned apart got %v", dropped)
+    }
+
+    if q.Len() != 1 || later.heapIdx < 0 {
+        t.Errorf("expected only future entry to stay got %d", q.Len())
+    }
+}
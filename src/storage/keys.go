@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	srv "github.com/kucicm/boomerang/src/server"
+)
+
+// FileKeyStore keeps api keys in a json file for backends without a
+// database. The file is read again when it changes, so keys created or
+// revoked by the admin command apply to a running server.
+type FileKeyStore struct {
+    mu sync.Mutex
+    path string
+    keys []srv.ApiKey
+    modTime time.Time
+    size int64
+}
+
+func NewFileKeyStore(path string) (*FileKeyStore, error) {
+    if path == "" {
+        return nil, errors.New("api keys file not set")
+    }
+
+    s := &FileKeyStore{path: path}
+    if err := s.reload(); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+func (s *FileKeyStore) CreateKey(key srv.ApiKey) (uint64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := s.reload(); err != nil {
+        return 0, err
+    }
+
+    key.Id = 1
+    for _, k := range s.keys {
+        if k.Hash == key.Hash {
+            return 0, fmt.Errorf("cannot create api key, hash already exists")
+        }
+        if k.Id >= key.Id {
+            key.Id = k.Id + 1
+        }
+    }
+
+    if err := s.write(append(s.keys, key)); err != nil {
+        return 0, err
+    }
+    return key.Id, nil
+}
+
+func (s *FileKeyStore) FindKey(hash string) (srv.ApiKey, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := s.reload(); err != nil {
+        return srv.ApiKey{}, err
+    }
+
+    for _, k := range s.keys {
+        if k.Hash == hash {
+            return k, nil
+        }
+    }
+    return srv.ApiKey{}, srv.ErrKeyNotFound
+}
+
+func (s *FileKeyStore) RevokeKey(id uint64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := s.reload(); err != nil {
+        return err
+    }
+
+    keys := append([]srv.ApiKey(nil), s.keys...)
+    for i := range keys {
+        if keys[i].Id != id {
+            continue
+        }
+        if !keys[i].Revoked() {
+            keys[i].RevokedAt = time.Now().UTC()
+        }
+        return s.write(keys)
+    }
+    return srv.ErrKeyNotFound
+}
+
+func (s *FileKeyStore) ListKeys() ([]srv.ApiKey, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if err := s.reload(); err != nil {
+        return nil, err
+    }
+    return append([]srv.ApiKey{}, s.keys...), nil
+}
+
+// reload reads the file if it changed since last read, missing file has
+// no keys.
+func (s *FileKeyStore) reload() error {
+    info, err := os.Stat(s.path)
+    if errors.Is(err, os.ErrNotExist) {
+        s.keys, s.modTime, s.size = nil, time.Time{}, 0
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("cannot read api keys %v", err)
+    }
+
+    if info.ModTime().Equal(s.modTime) && info.Size() == s.size && s.keys != nil {
+        return nil
+    }
+
+    bs, err := os.ReadFile(s.path)
+    if err != nil {
+        return fmt.Errorf("cannot read api keys %v", err)
+    }
+
+    keys := make([]srv.ApiKey, 0)
+    if err := json.Unmarshal(bs, &keys); err != nil {
+        return fmt.Errorf("cannot parse api keys %s %v", s.path, err)
+    }
+    s.keys, s.modTime, s.size = keys, info.ModTime(), info.Size()
+    return nil
+}
+
+// write replaces the file with keys through a temp file, so the server
+// never reads a partly written file.
+func (s *FileKeyStore) write(keys []srv.ApiKey) error {
+    bs, err := json.MarshalIndent(keys, "", "  ")
+    if err != nil {
+        return fmt.Errorf("cannot convert api keys %v", err)
+    }
+
+    if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+        return fmt.Errorf("cannot create api keys dir %v", err)
+    }
+
+    tmp := s.path + ".tmp"
+    if err := os.WriteFile(tmp, bs, 0o600); err != nil {
+        return fmt.Errorf("cannot write api keys %v", err)
+    }
+
+    if err := os.Rename(tmp, s.path); err != nil {
+        return fmt.Errorf("cannot write api keys %v", err)
+    }
+
+    s.keys, s.modTime, s.size = nil, time.Time{}, 0
+    return s.reload()
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	srv "github.com/kucicm/boomerang/src/server"
+)
+
+func TestFileKeyStore(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "keys", "api_keys.json")
+    store, err := NewFileKeyStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if _, err := store.FindKey("missing"); !errors.Is(err, srv.ErrKeyNotFound) {
+        t.Errorf("expected not found in empty store got %v", err)
+    }
+
+    first, err := store.CreateKey(srv.ApiKey{Name: "ci", Hash: "h1", Scopes: []string{srv.ScopeJobsWrite}, CreatedAt: time.Now()})
+    if err != nil {
+        t.Fatal(err)
+    }
+    second, err := store.CreateKey(srv.ApiKey{Name: "ro", Hash: "h2", Scopes: []string{srv.ScopeJobsRead}, CreatedAt: time.Now()})
+    if err != nil || first != 1 || second != 2 {
+        t.Errorf("expected ids 1 and 2 got %d %d %v", first, second, err)
+    }
+
+    if _, err := store.CreateKey(srv.ApiKey{Name: "dup", Hash: "h1"}); err == nil {
+        t.Error("expected error on duplicate hash")
+    }
+
+    // another process (admin command) changes the same file
+    other, err := NewFileKeyStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := other.RevokeKey(first); err != nil {
+        t.Fatal(err)
+    }
+    if err := other.RevokeKey(42); !errors.Is(err, srv.ErrKeyNotFound) {
+        t.Errorf("expected not found on revoke got %v", err)
+    }
+
+    key, err := store.FindKey("h1")
+    if err != nil || key.Name != "ci" || !key.Revoked() {
+        t.Errorf("expected revoked key from file got %+v %v", key, err)
+    }
+
+    key, err = store.FindKey("h2")
+    if err != nil || key.Revoked() || !key.Allows(srv.ScopeJobsRead) || key.Allows(srv.ScopeJobsWrite) {
+        t.Errorf("expected active read key got %+v %v", key, err)
+    }
+
+    keys, err := store.ListKeys()
+    if err != nil || len(keys) != 2 {
+        t.Errorf("expected 2 keys got %+v %v", keys, err)
+    }
+}
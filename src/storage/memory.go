@@ -0,0 +1,408 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	srv "github.com/kucicm/boomerang/src/server"
+)
+
+type memoryJob struct {
+    queueEntry
+    req srv.ScheduleRequest
+    attempts []srv.Attempt
+    cancelledAt time.Time
+    version uint64
+}
+
+// MemoryStorage keeps schedule requests in process memory, ordered by
+// send after. Nothing survives a restart, use it for tests and throwaway
+// environments.
+type MemoryStorage struct {
+    mu sync.Mutex
+    nextId uint64
+    jobs map[uint64]*memoryJob
+    ready fairQueue
+    keys map[string]idempotencyKey
+    dead map[uint64]srv.DeadLetter
+    deadAttempts map[uint64][]srv.Attempt
+}
+
+func NewMemoryStorage() *MemoryStorage {
+    return &MemoryStorage{
+        jobs: make(map[uint64]*memoryJob),
+        keys: make(map[string]idempotencyKey),
+        dead: make(map[uint64]srv.DeadLetter),
+        deadAttempts: make(map[uint64][]srv.Attempt),
+    }
+}
+
+func (s *MemoryStorage) Save(r srv.ScheduleRequest) (uint64, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.save(r)
+}
+
+func (s *MemoryStorage) SaveBatch(reqs []srv.ScheduleRequest) ([]uint64, []error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ids, errs := make([]uint64, len(reqs)), make([]error, len(reqs))
+    for i, r := range reqs {
+        ids[i], errs[i] = s.save(r)
+    }
+    return ids, errs
+}
+
+func (s *MemoryStorage) save(r srv.ScheduleRequest) (uint64, error) {
+    if id, ok := s.duplicate(r); ok {
+        return id, srv.ErrDuplicateRequest
+    }
+
+    s.nextId++
+    r.Id = s.nextId
+    if r.IdempotencyKey != "" {
+        s.keys[keyOf(r)] = idempotencyKey{r.Id, r.IdempotencyExpiresAt}
+    }
+    s.insert(r)
+    return r.Id, nil
+}
+
+// insert adds r with its id to the queue
+func (s *MemoryStorage) insert(r srv.ScheduleRequest) {
+    r.Headers, r.Query = copyMap(r.Headers), copyMap(r.Query)
+    job := &memoryJob{
+        queueEntry: queueEntry{
+            id: r.Id,
+            sendAfter: r.SendAfter,
+            timeToLive: r.TimeToLive,
+            status: statusInitial,
+            tenant: tenantOf(r),
+            host: srv.HostOf(r.Endpoint),
+        },
+        req: r,
+        version: 1,
+    }
+    s.jobs[r.Id] = job
+    s.ready.push(&job.queueEntry)
+}
+
+func (s *MemoryStorage) Load(bs uint) []srv.ScheduleRequest {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ready, expired := s.ready.pop(bs, uint64(time.Now().UnixMilli()))
+    for _, e := range expired {
+        s.kill(s.jobs[e.id], srv.DeadReasonExpired)
+    }
+
+    out := make([]srv.ScheduleRequest, 0, bs)
+    for _, e := range ready {
+        job := s.jobs[e.id]
+        job.status = statusRunning
+        req := job.req
+        req.Headers, req.Query = copyMap(req.Headers), copyMap(req.Query)
+        out = append(out, req)
+    }
+    return out
+}
+
+func (s *MemoryStorage) Update(task srv.ScheduleRequest) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    job, ok := s.jobs[task.Id]
+    if !ok {
+        log.Printf("update of id %d caused 0 updates\n", task.Id)
+        return
+    }
+
+    job.req.SendAfter = task.SendAfter
+    job.req.MaxRetry = task.MaxRetry
+    job.req.LastBackOffMs = task.LastBackOffMs
+    s.reschedule(job, statusInitial)
+}
+
+func (s *MemoryStorage) Delete(task srv.ScheduleRequest) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if job, ok := s.jobs[task.Id]; ok {
+        s.drop(job)
+    }
+}
+
+// Purge deletes at most limit (zero for all) done and cancelled jobs finished before
+func (s *MemoryStorage) Purge(before time.Time, limit int) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ids := make([]uint64, 0)
+    for id, job := range s.jobs {
+        if job.purgeable(before.UnixMilli()) {
+            ids = append(ids, id)
+        }
+    }
+
+    ids = firstIds(ids, limit)
+    for _, id := range ids {
+        s.drop(s.jobs[id])
+    }
+    return len(ids), nil
+}
+
+func (s *MemoryStorage) DeadLetter(task srv.ScheduleRequest, reason string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if job, ok := s.jobs[task.Id]; ok {
+        s.kill(job, reason)
+    }
+}
+
+func (s *MemoryStorage) GetDeadLetter(id uint64) (srv.DeadLetter, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    dl, ok := s.dead[id]
+    if !ok {
+        return dl, srv.ErrDeadLetterNotFound
+    }
+    dl.Request.Headers, dl.Request.Query = copyMap(dl.Request.Headers), copyMap(dl.Request.Query)
+    return dl, nil
+}
+
+func (s *MemoryStorage) ListDeadLetters(filter srv.DeadLetterFilter) ([]srv.DeadLetter, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    out := firstDeadLetters(s.dead, filter)
+    for i := range out {
+        out[i].Request.Headers, out[i].Request.Query = copyMap(out[i].Request.Headers), copyMap(out[i].Request.Query)
+    }
+    return out, nil
+}
+
+func (s *MemoryStorage) CountDeadLetters() (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.dead), nil
+}
+
+func (s *MemoryStorage) Done(task srv.ScheduleRequest) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if job, ok := s.jobs[task.Id]; ok {
+        s.reschedule(job, statusDone)
+    }
+}
+
+func (s *MemoryStorage) AddAttempt(id uint64, attempt srv.Attempt) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if job, ok := s.jobs[id]; ok {
+        job.attempts = append(job.attempts, attempt)
+    }
+}
+
+func (s *MemoryStorage) Get(id uint64) (srv.Job, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    job, ok := s.jobs[id]
+    if !ok {
+        return srv.Job{}, srv.ErrJobNotFound
+    }
+    return job.view(), nil
+}
+
+func (s *MemoryStorage) List(filter srv.ListFilter) ([]srv.Job, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    ids := make([]uint64, 0)
+    for id, job := range s.jobs {
+        if id > filter.AfterId && matches(filter, job.tenant, job.status) {
+            ids = append(ids, id)
+        }
+    }
+    ids = firstIds(ids, filter.Limit)
+
+    out := make([]srv.Job, len(ids))
+    for i, id := range ids {
+        out[i] = s.jobs[id].view()
+        out[i].Attempts = nil
+    }
+    return out, nil
+}
+
+func (s *MemoryStorage) Cancel(id uint64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    job, ok := s.jobs[id]
+    if !ok {
+        return srv.ErrJobNotFound
+    }
+
+    if job.status != statusInitial {
+        return fmt.Errorf("%w: job is %s", srv.ErrJobNotPending, statusName(job.status))
+    }
+
+    job.cancelledAt = time.Now().UTC()
+    s.reschedule(job, statusCancelled)
+    return nil
+}
+
+func (s *MemoryStorage) Patch(id uint64, version uint64, patch srv.JobPatch) (srv.Job, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    job, ok := s.jobs[id]
+    if !ok {
+        return srv.Job{}, srv.ErrJobNotFound
+    }
+
+    if job.status != statusInitial {
+        return srv.Job{}, fmt.Errorf("%w: job is %s", srv.ErrJobNotPending, statusName(job.status))
+    }
+
+    if version != 0 && version != job.version {
+        return srv.Job{}, fmt.Errorf("%w: job is at version %d", srv.ErrVersionMismatch, job.version)
+    }
+
+    patch.Apply(&job.req)
+    job.req.Headers = copyMap(job.req.Headers)
+    s.reschedule(job, statusInitial)
+    return job.view(), nil
+}
+
+func (s *MemoryStorage) Redrive(filter srv.RedriveFilter, override srv.RedriveOverride, dryRun bool) (srv.RedriveResult, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var res srv.RedriveResult
+    now := uint64(time.Now().UnixMilli())
+    for id, dl := range s.dead {
+        if !filter.Matches(dl) {
+            continue
+        }
+
+        req := dl.Request
+        override.Apply(&req)
+        if !srv.Redrivable(req, now) {
+            res.Skipped++
+            continue
+        }
+
+        res.Redriven++
+        if !dryRun {
+            req.LastBackOffMs = 0
+            delete(s.dead, id)
+            s.insert(req)
+            s.jobs[id].attempts = s.deadAttempts[id]
+            delete(s.deadAttempts, id)
+        }
+    }
+    return res, nil
+}
+
+func (s *MemoryStorage) Shutdown() error {
+    return nil
+}
+
+// duplicate returns id of a stored job saved with the same unexpired key
+func (s *MemoryStorage) duplicate(r srv.ScheduleRequest) (uint64, bool) {
+    if r.IdempotencyKey == "" {
+        return 0, false
+    }
+
+    k, ok := s.keys[keyOf(r)]
+    if !ok || k.expired(uint64(time.Now().UnixMilli())) {
+        return 0, false
+    }
+
+    _, ok = s.jobs[k.id]
+    return k.id, ok
+}
+
+// drop forgets job and its idempotency key
+func (s *MemoryStorage) drop(job *memoryJob) {
+    s.ready.remove(&job.queueEntry)
+    delete(s.jobs, job.id)
+    if k, ok := s.keys[keyOf(job.req)]; ok && k.id == job.id {
+        delete(s.keys, keyOf(job.req))
+    }
+}
+
+// kill moves job to dead letters with its attempts, its idempotency key is
+// kept for redrive but does not match while the job is dead
+func (s *MemoryStorage) kill(job *memoryJob, reason string) {
+    s.ready.remove(&job.queueEntry)
+    delete(s.jobs, job.id)
+    s.dead[job.id] = newDeadLetter(job.req, job.attempts, reason, time.Now())
+    s.deadAttempts[job.id] = job.attempts
+}
+
+// firstDeadLetters sorts dead letters selected by filter by id and returns
+// at most limit of them
+func firstDeadLetters(dls map[uint64]srv.DeadLetter, filter srv.DeadLetterFilter) []srv.DeadLetter {
+    ids := make([]uint64, 0)
+    for id, dl := range dls {
+        if id > filter.AfterId && (filter.Tenant == "" || dl.TenantId() == filter.Tenant) {
+            ids = append(ids, id)
+        }
+    }
+
+    ids = firstIds(ids, filter.Limit)
+    out := make([]srv.DeadLetter, len(ids))
+    for i, id := range ids {
+        out[i] = dls[id]
+    }
+    return out
+}
+
+// reschedule moves job to status after its request changed, only initial
+// jobs are put back to the time index.
+func (s *MemoryStorage) reschedule(job *memoryJob, status int) {
+    s.ready.remove(&job.queueEntry)
+
+    job.sendAfter = job.req.SendAfter
+    job.timeToLive = job.req.TimeToLive
+    job.status = status
+    job.version++
+    if status == statusDone || status == statusCancelled {
+        job.finishedAt = time.Now().UnixMilli()
+    }
+    if status == statusInitial {
+        s.ready.push(&job.queueEntry)
+    }
+}
+
+func (j *memoryJob) view() srv.Job {
+    req := j.req
+    req.Headers, req.Query = copyMap(req.Headers), copyMap(req.Query)
+    return srv.Job{
+        Request: req,
+        Status: statusName(j.status),
+        Attempts: append([]srv.Attempt(nil), j.attempts...),
+        CancelledAt: j.cancelledAt,
+        Version: j.version,
+    }
+}
+
+func copyMap(m map[string]string) map[string]string {
+    if m == nil {
+        return nil
+    }
+
+    out := make(map[string]string, len(m))
+    for k, v := range m {
+        out[k] = v
+    }
+    return out
+}
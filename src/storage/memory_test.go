@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kucicm/boomerang/src/server"
+)
+
+func TestMemoryAcceptDispatchLoop(t *testing.T) {
+    var calls int32
+    done := make(chan struct{})
+    target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+        if atomic.AddInt32(&calls, 1) == 1 {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        close(done)
+    }))
+    defer target.Close()
+
+    storage := NewMemoryStorage()
+    accepter := server.NewAccepter(server.AccepterCfg{}, storage)
+    dispatcher := server.NewDispatcher(server.DispatcherCfg{LoadBatchSize: 10, MaxConcurrency: 1}, storage)
+    dispatcher.Start()
+    defer dispatcher.Shutdown()
+
+    now := uint64(time.Now().UnixMilli())
+    bs, err := json.Marshal(server.ScheduleRequest{
+        Endpoint: target.URL,
+        Payload: "loop",
+        SendAfter: now + 200,
+        MaxRetry: 3,
+        BackOffMs: 100,
+        TimeToLive: now + 60_000,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    rr := httptest.NewRecorder()
+    accepter.SubmitHandler(rr, httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(string(bs))))
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+    }
+
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("timeout, endpoint not called successfully in 5 seconds")
+    }
+
+    if uint64(time.Now().UnixMilli()) < now + 300 {
+        t.Error("endpoint called before send after and back off")
+    }
+
+    // finalize runs after the call returns
+    time.Sleep(100 * time.Millisecond)
+    var resp server.SubmitResponse
+    if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+        t.Fatal(err)
+    }
+
+    job, err := storage.Get(resp.Id)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if job.Status != server.StatusDone {
+        t.Errorf("expected delivered job to be done got %s", job.Status)
+    }
+
+    if len(job.Attempts) != 2 || job.Attempts[0].StatusCode != http.StatusServiceUnavailable || job.Attempts[1].StatusCode != http.StatusOK {
+        t.Errorf("expected failed and successful attempt got %+v", job.Attempts)
+    }
+}
+
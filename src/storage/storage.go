@@ -4,27 +4,32 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"math"
 	"sync"
+	"time"
 
 	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/pgx"
+	migratepgx "github.com/golang-migrate/migrate/v4/database/pgx"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	srv "github.com/kucicm/boomerang/src/server"
     _ "github.com/golang-migrate/migrate/v4/source/file"
 )
 
 type StorageServiceCfg struct {
-    saveQueueSize int
-    saveBatchSize int
-    maxWaitMs int
-    migrationPath string
+    DbUrl string
+    SaveQueueSize int
+    SaveBatchSize int
+    MaxWaitMs int
+    MigrationPath string
 }
 
 type StorageService struct {
     dbClient *pgxpool.Pool
+    saver *BulkProcessor[srv.ScheduleRequest, uint64]
 }
 
 var once sync.Once
@@ -33,7 +38,7 @@ var createError error
 
 func NewStorageService(cfg StorageServiceCfg) (*StorageService, error) {
     once.Do(func() {
-        dbpool, err := pgxpool.New(context.Background(), os.Getenv("DB_URL"))
+        dbpool, err := pgxpool.New(context.Background(), cfg.DbUrl)
         if err != nil {
             createError = fmt.Errorf("cannot open database %v", err)
             return
@@ -46,7 +51,7 @@ func NewStorageService(cfg StorageServiceCfg) (*StorageService, error) {
 
         log.Println("Connected to database")
 
-        if err := runDatabaseMigration(cfg.migrationPath); err != nil {
+        if err := runDatabaseMigration(cfg.DbUrl, cfg.MigrationPath); err != nil {
             createError = err
             return
         }
@@ -54,53 +59,300 @@ func NewStorageService(cfg StorageServiceCfg) (*StorageService, error) {
         singletone = &StorageService{
             dbClient: dbpool,
         }
+
+        batchSize, maxWaitMs := cfg.SaveBatchSize, cfg.MaxWaitMs
+        if batchSize <= 0 {
+            batchSize = 1
+        }
+        if maxWaitMs <= 0 {
+            maxWaitMs = 1
+        }
+        singletone.saver = NewBulkProcessor(
+            cfg.SaveQueueSize,
+            batchSize,
+            time.Duration(maxWaitMs) * time.Millisecond,
+            singletone.saveBatch,
+        )
     })
     return singletone, createError
 }
 
-func (s *StorageService) Save(r srv.ScheduleRequest) error {
-    query := `INSERT INTO schedule.primary_queue
-        (endpoint, headers, payload, send_after, max_retry, back_off_ms, time_to_live)
-        VALUES ($1, $2, $3, $4, $5, $6, $7)`
+func (s *StorageService) Save(r srv.ScheduleRequest) (uint64, error) {
+    return s.saver.Add(r)
+}
+
+// SaveBatch saves reqs right away in one transaction, it does not go
+// through the bulk processor since reqs are already a batch.
+func (s *StorageService) SaveBatch(reqs []srv.ScheduleRequest) ([]uint64, []error) {
+    return s.saveBatch(reqs)
+}
+
+// saveBatch inserts whole batch with one statement, if that fails rows
+// are inserted one by one so only the offending request gets an error.
+func (s *StorageService) saveBatch(batch []srv.ScheduleRequest) ([]uint64, []error) {
+    ids := make([]uint64, len(batch))
+    errs := make([]error, len(batch))
+    rows := make([]int, 0, len(batch))
+    headers, queries := make([]string, len(batch)), make([]string, len(batch))
+    for i, r := range batch {
+        bs, err := json.Marshal(r.Headers)
+        if err != nil {
+            errs[i] = fmt.Errorf("failed to convert headers to string %s", err)
+            continue
+        }
+        headers[i] = string(bs)
+
+        if bs, err = json.Marshal(r.Query); err != nil {
+            errs[i] = fmt.Errorf("failed to convert query to string %s", err)
+            continue
+        }
+        queries[i] = string(bs)
+        rows = append(rows, i)
+    }
 
-    headers, err := json.Marshal(r.Headers)
+    if err := s.insert(batch, headers, queries, rows, ids, errs); err != nil {
+        log.Printf("Error saving batch of %d to primary queue, saving one by one %s\n", len(rows), err)
+        for _, i := range rows {
+            if err := s.insert(batch, headers, queries, []int{i}, ids, errs); err != nil {
+                errs[i] = err
+                log.Printf("Error saving to primary queue %s\n", errs[i])
+            }
+        }
+    }
+    return ids, errs
+}
+
+// insert saves batch rows and writes generated ids into ids, ids are taken
+// from the sequence upfront since RETURNING does not guarantee row order.
+// Rows with an idempotency key which is already taken get id of the
+// existing job and ErrDuplicateRequest instead.
+func (s *StorageService) insert(batch []srv.ScheduleRequest, headers, queries []string, rows []int, ids []uint64, errs []error) error {
+    if len(rows) == 0 {
+        return nil
+    }
+
+    ctx := context.Background()
+    tx, err := s.dbClient.Begin(ctx)
     if err != nil {
-        return fmt.Errorf("failed to convert headers to string %s", err)
+        return err
     }
+    defer tx.Rollback(ctx)
 
-    _, err = s.dbClient.Exec(context.Background(), query, 
-        r.Endpoint, headers, r.Payload, r.SendAfter, r.MaxRetry, r.BackOffMs, r.TimeToLive)
+    seq, err := tx.Query(ctx,
+        `SELECT nextval('schedule.primary_queue_id_seq') FROM generate_series(1, $1)`, len(rows))
     if err != nil {
-        log.Printf("Error saving to primary queue %s\n", err)
         return err
     }
+    newIds, err := pgx.CollectRows(seq, pgx.RowTo[int64])
+    if err != nil {
+        return err
+    }
+
+    dups, err := claimKeys(ctx, tx, batch, rows, newIds)
+    if err != nil {
+        return err
+    }
+
+    query := `INSERT INTO schedule.primary_queue
+        (id, endpoint, headers, payload, send_after, max_retry, back_off_ms, time_to_live, method, query, content_type, tenant,
+            retry_policy, max_back_off_ms)
+        SELECT u.id, u.endpoint, u.headers::jsonb, u.payload, u.send_after, u.max_retry, u.back_off_ms, u.time_to_live,
+            u.method, u.query::jsonb, u.content_type, u.tenant, u.retry_policy, u.max_back_off_ms
+        FROM unnest($1::int[], $2::varchar[], $3::text[], $4::bytea[], $5::bigint[], $6::int[], $7::int[], $8::bigint[],
+            $9::varchar[], $10::text[], $11::text[], $12::text[], $13::text[], $14::bigint[])
+            AS u(id, endpoint, headers, payload, send_after, max_retry, back_off_ms, time_to_live, method, query, content_type, tenant,
+                retry_policy, max_back_off_ms)`
+
+    n := len(rows)
+    insertIds := make([]int64, 0, n)
+    endpoints, hs, payloads := make([]string, 0, n), make([]string, 0, n), make([][]byte, 0, n)
+    sendAfters, maxRetries, backOffs, ttls := make([]int64, 0, n), make([]int64, 0, n), make([]int64, 0, n), make([]int64, 0, n)
+    methods, qs, contentTypes := make([]string, 0, n), make([]string, 0, n), make([]string, 0, n)
+    tenants, policies, maxBackOffs := make([]string, 0, n), make([]string, 0, n), make([]int64, 0, n)
+    for j, i := range rows {
+        if _, ok := dups[j]; ok {
+            continue
+        }
+        r := batch[i]
+        insertIds = append(insertIds, newIds[j])
+        endpoints, hs, payloads = append(endpoints, r.Endpoint), append(hs, headers[i]), append(payloads, []byte(r.Payload))
+        sendAfters, maxRetries = append(sendAfters, int64(r.SendAfter)), append(maxRetries, int64(r.MaxRetry))
+        backOffs, ttls = append(backOffs, int64(r.BackOffMs)), append(ttls, int64(r.TimeToLive))
+        methods, qs, contentTypes = append(methods, r.CallMethod()), append(qs, queries[i]), append(contentTypes, r.ContentType)
+        tenants = append(tenants, tenantOf(r))
+        policies, maxBackOffs = append(policies, r.RetryPolicy), append(maxBackOffs, int64(r.MaxBackOffMs))
+    }
+
+    _, err = tx.Exec(ctx, query,
+        insertIds, endpoints, hs, payloads, sendAfters, maxRetries, backOffs, ttls, methods, qs, contentTypes, tenants,
+        policies, maxBackOffs)
+    if err != nil {
+        return err
+    }
+
+    if err := tx.Commit(ctx); err != nil {
+        return err
+    }
+
+    for j, i := range rows {
+        if id, ok := dups[j]; ok {
+            ids[i], errs[i] = id, srv.ErrDuplicateRequest
+            continue
+        }
+        ids[i] = uint64(newIds[j])
+    }
     return nil
 }
 
+// claimKeys takes idempotency keys of rows for their new ids, a key can be
+// taken over only once it expired. Returns existing job id by row position
+// for rows whose key is still held by another job.
+func claimKeys(ctx context.Context, tx pgx.Tx, batch []srv.ScheduleRequest, rows []int, newIds []int64) (map[int]uint64, error) {
+    dups := make(map[int]uint64)
+    first := make(map[string]int)
+    var tenants, keys []string
+    var keyIds, expiresAt []int64
+    for j, i := range rows {
+        if batch[i].IdempotencyKey == "" {
+            continue
+        }
+
+        key := keyOf(batch[i])
+        if f, ok := first[key]; ok {
+            dups[j] = uint64(newIds[f])
+            continue
+        }
+        first[key] = j
+        tenants = append(tenants, tenantOf(batch[i]))
+        keys = append(keys, batch[i].IdempotencyKey)
+        keyIds = append(keyIds, newIds[j])
+        expiresAt = append(expiresAt, int64(batch[i].IdempotencyExpiresAt))
+    }
+
+    if len(keys) == 0 {
+        return dups, nil
+    }
+
+    query := `INSERT INTO schedule.idempotency_key (tenant, key, job_id, expires_at)
+        SELECT * FROM unnest($1::text[], $2::text[], $3::int[], $4::bigint[])
+        ON CONFLICT (tenant, key) DO UPDATE
+            SET job_id = EXCLUDED.job_id, expires_at = EXCLUDED.expires_at
+            WHERE schedule.idempotency_key.expires_at < $5
+        RETURNING tenant || chr(0) || key`
+    claimed, err := tx.Query(ctx, query, tenants, keys, keyIds, expiresAt, time.Now().UnixMilli())
+    if err != nil {
+        return nil, err
+    }
+    taken, err := pgx.CollectRows(claimed, pgx.RowTo[string])
+    if err != nil {
+        return nil, err
+    }
+    if len(taken) == len(keys) {
+        return dups, nil
+    }
+
+    for _, key := range taken {
+        delete(first, key)
+    }
+
+    existing, err := tx.Query(ctx, `SELECT k.tenant || chr(0) || k.key, k.job_id
+        FROM schedule.idempotency_key k
+        JOIN unnest($1::text[], $2::text[]) AS u(tenant, key) ON u.tenant = k.tenant AND u.key = k.key`, tenants, keys)
+    if err != nil {
+        return nil, err
+    }
+    defer existing.Close()
+
+    held := make(map[string]uint64)
+    for existing.Next() {
+        var key string
+        var id uint64
+        if err := existing.Scan(&key, &id); err != nil {
+            return nil, err
+        }
+        held[key] = id
+    }
+    if err := existing.Err(); err != nil {
+        return nil, err
+    }
+
+    for key, j := range first {
+        dups[j] = held[key]
+    }
+
+    // duplicates within batch follow their first row
+    for j, i := range rows {
+        if batch[i].IdempotencyKey == "" {
+            continue
+        }
+        if f, ok := first[keyOf(batch[i])]; ok && f != j {
+            dups[j] = held[keyOf(batch[i])]
+        }
+    }
+    return dups, nil
+}
+
 func (s *StorageService) Load(bs uint) []srv.ScheduleRequest {
-    // todo fair queue
+    s.expire(bs)
+
+    // Tenants take turns and within a tenant its hosts take turns, the
+    // oldest overdue job goes first in a turn. parts walks the index over
+    // (tenant, host) one pair at a time and every pair gives at most $1
+    // candidates, so a big backlog of one tenant is not scanned.
     query := `
-    WITH ready AS (
-        SELECT *
-        FROM schedule.primary_queue
-        WHERE
-            STATUS = 0
-            AND send_after <= EXTRACT(epoch FROM CURRENT_TIMESTAMP) * 1000
-            AND time_to_live >= EXTRACT(epoch FROM CURRENT_TIMESTAMP) * 1000
-        LIMIT $1
+    WITH RECURSIVE parts AS (
+        (SELECT tenant, host FROM schedule.primary_queue WHERE status = 0 ORDER BY tenant, host LIMIT 1)
+        UNION ALL
+        SELECT n.tenant, n.host
+        FROM parts p, LATERAL (
+            SELECT tenant, host
+            FROM schedule.primary_queue
+            WHERE status = 0 AND (tenant, host) > (p.tenant, p.host)
+            ORDER BY tenant, host
+            LIMIT 1
+        ) n
+    ), candidates AS (
+        SELECT c.id, c.tenant, c.send_after,
+            row_number() OVER (PARTITION BY c.tenant, c.host ORDER BY c.send_after, c.id) AS host_turn
+        FROM parts p, LATERAL (
+            SELECT id, tenant, host, send_after
+            FROM schedule.primary_queue
+            WHERE
+                status = 0
+                AND tenant = p.tenant
+                AND host = p.host
+                AND send_after <= EXTRACT(epoch FROM CURRENT_TIMESTAMP) * 1000
+                AND time_to_live >= EXTRACT(epoch FROM CURRENT_TIMESTAMP) * 1000
+            ORDER BY send_after, id
+            LIMIT $1
+        ) c
+    ), turns AS (
+        SELECT id, send_after,
+            row_number() OVER (PARTITION BY tenant ORDER BY host_turn, send_after, id) AS tenant_turn
+        FROM candidates
+    ), ready AS (
+        SELECT id FROM turns ORDER BY tenant_turn, send_after, id LIMIT $1
     )
     UPDATE schedule.primary_queue
     SET status = 1
     FROM ready
     WHERE schedule.primary_queue.id = ready.id
-    RETURNING ready.id
-            , ready.endpoint
-            , ready.headers
-            , ready.payload
-            , ready.send_after
-            , ready.max_retry
-            , ready.back_off_ms
-            , ready.time_to_live;
+        AND schedule.primary_queue.status = 0
+    RETURNING schedule.primary_queue.id
+            , schedule.primary_queue.endpoint
+            , schedule.primary_queue.headers
+            , schedule.primary_queue.payload
+            , schedule.primary_queue.send_after
+            , schedule.primary_queue.max_retry
+            , schedule.primary_queue.back_off_ms
+            , schedule.primary_queue.time_to_live
+            , schedule.primary_queue.method
+            , schedule.primary_queue.query
+            , schedule.primary_queue.content_type
+            , schedule.primary_queue.tenant
+            , schedule.primary_queue.retry_policy
+            , schedule.primary_queue.max_back_off_ms
+            , schedule.primary_queue.last_back_off_ms;
     `
 
     rows, err := s.dbClient.Query(context.Background(), query, bs)
@@ -112,16 +364,23 @@ func (s *StorageService) Load(bs uint) []srv.ScheduleRequest {
     out := make([]srv.ScheduleRequest, 0, bs)
     for rows.Next() {
         var it srv.ScheduleRequest
-        var headers string
-        err := rows.Scan(&it.Id, &it.Endpoint, &headers, &it.Payload, &it.SendAfter, &it.MaxRetry, &it.BackOffMs, &it.TimeToLive)
+        var headers, query string
+        var payload []byte
+        err := rows.Scan(&it.Id, &it.Endpoint, &headers, &payload, &it.SendAfter, &it.MaxRetry, &it.BackOffMs, &it.TimeToLive,
+            &it.Method, &query, &it.ContentType, &it.Tenant, &it.RetryPolicy, &it.MaxBackOffMs, &it.LastBackOffMs)
         if err != nil {
             log.Printf("Error converting database row to struct %s\n", err)
             continue
         }
+        it.Payload = string(payload)
         if err = json.Unmarshal([]byte(headers), &it.Headers); err != nil {
             log.Printf("Error converting database headers to struct %s\n", err)
             continue
         }
+        if err = json.Unmarshal([]byte(query), &it.Query); err != nil {
+            log.Printf("Error converting database query to struct %s\n", err)
+            continue
+        }
         out = append(out, it)
     }
     return out
@@ -132,9 +391,12 @@ func (s *StorageService) Update(task srv.ScheduleRequest) {
         SET 
             send_after = $2
             , max_retry = $3
+            , last_back_off_ms = $4
+            , status = 0
+            , version = version + 1
         WHERE Id = $1
     `
-    tag, err := s.dbClient.Exec(context.Background(), query, task.Id, task.SendAfter, task.MaxRetry)
+    tag, err := s.dbClient.Exec(context.Background(), query, task.Id, task.SendAfter, task.MaxRetry, task.LastBackOffMs)
     if err != nil {
         log.Printf("error on update of task with id %d, err: %s\n", task.Id, err)
         return
@@ -152,20 +414,516 @@ func (s *StorageService) Delete(task srv.ScheduleRequest) {
     }
 }
 
+// Purge deletes at most limit (zero for all) done and cancelled jobs finished before,
+// their attempts and idempotency keys go with them.
+func (s *StorageService) Purge(before time.Time, limit int) (int, error) {
+    query := `DELETE FROM schedule.primary_queue
+        WHERE id IN (
+            SELECT id FROM schedule.primary_queue
+            WHERE status IN (2, 3) AND finished_at < $1
+            ORDER BY id
+            LIMIT NULLIF($2::int, 0)
+        )`
+    tag, err := s.dbClient.Exec(context.Background(), query, before.UnixMilli(), limit)
+    if err != nil {
+        return 0, fmt.Errorf("cannot purge jobs %v", err)
+    }
+    return int(tag.RowsAffected()), nil
+}
+
+func (s *StorageService) Done(task srv.ScheduleRequest) {
+    query := `UPDATE schedule.primary_queue SET status = 2, finished_at = $2, version = version + 1 WHERE id = $1;`
+    if _, err := s.dbClient.Exec(context.Background(), query, task.Id, time.Now().UnixMilli()); err != nil {
+        log.Printf("failed to mark task with id %d done error: %s\n", task.Id, err)
+    }
+}
+
+func (s *StorageService) AddAttempt(id uint64, attempt srv.Attempt) {
+    query := `INSERT INTO schedule.attempt
+        (job_id, started_at, status_code, latency_ms, error)
+        VALUES ($1, $2, $3, $4, $5)`
+    _, err := s.dbClient.Exec(context.Background(), query,
+        id, attempt.At.UnixMilli(), attempt.StatusCode, attempt.LatencyMs, attempt.Error)
+    if err != nil {
+        log.Printf("failed to save attempt of task with id %d error: %s\n", id, err)
+    }
+}
+
+// moveToDeadLetter inserts rows deleted by the moved CTE to dead letters
+// with their attempts and idempotency key, which are still visible since every
+// part of the statement sees the same snapshot, so redrive can put them back.
+// $2 is the reason, $3 time of death.
+const moveToDeadLetter = `
+    INSERT INTO schedule.dead_letter
+        (id, endpoint, headers, payload, send_after, max_retry, back_off_ms, time_to_live, method, query, content_type,
+        tenant, retry_policy, max_back_off_ms, reason, last_error, last_status_code, attempts, dead_at,
+        attempt_log, idempotency_key, idempotency_expires_at)
+    SELECT m.id, m.endpoint, m.headers, m.payload, m.send_after, m.max_retry, m.back_off_ms, m.time_to_live, m.method,
+        m.query, m.content_type, m.tenant, m.retry_policy, m.max_back_off_ms, $2, COALESCE(a.error, ''), COALESCE(a.status_code, 0),
+        (SELECT count(*) FROM schedule.attempt WHERE job_id = m.id), $3,
+        (SELECT COALESCE(jsonb_agg(jsonb_build_object('started_at', started_at, 'status_code', status_code,
+            'latency_ms', latency_ms, 'error', error) ORDER BY id), '[]') FROM schedule.attempt WHERE job_id = m.id),
+        COALESCE(k.key, ''), COALESCE(k.expires_at, 0)
+    FROM moved m
+    LEFT JOIN LATERAL (
+        SELECT error, status_code FROM schedule.attempt WHERE job_id = m.id ORDER BY id DESC LIMIT 1
+    ) a ON true
+    LEFT JOIN schedule.idempotency_key k ON k.job_id = m.id`
+
+func (s *StorageService) DeadLetter(task srv.ScheduleRequest, reason string) {
+    query := `WITH moved AS (DELETE FROM schedule.primary_queue WHERE id = $1 RETURNING *)` + moveToDeadLetter
+    _, err := s.dbClient.Exec(context.Background(), query, task.Id, reason, time.Now().UnixMilli())
+    if err != nil {
+        log.Printf("failed to move task with id %d to dead letters error: %s\n", task.Id, err)
+    }
+}
+
+// expire moves up to bs pending jobs which expired before they were sent
+// to dead letters
+func (s *StorageService) expire(bs uint) {
+    query := `WITH moved AS (
+        DELETE FROM schedule.primary_queue
+        WHERE id IN (
+            SELECT id FROM schedule.primary_queue
+            WHERE status = 0 AND time_to_live < EXTRACT(epoch FROM CURRENT_TIMESTAMP) * 1000
+            ORDER BY time_to_live
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING *
+    )` + moveToDeadLetter
+    _, err := s.dbClient.Exec(context.Background(), query, bs, srv.DeadReasonExpired, time.Now().UnixMilli())
+    if err != nil {
+        log.Printf("Error moving expired schedule requests to dead letters %s\n", err)
+    }
+}
+
+const deadLetterColumns = `id, endpoint, headers, payload, send_after, max_retry, back_off_ms, time_to_live,
+            method, query, content_type, tenant, retry_policy, max_back_off_ms, reason, last_error, last_status_code,
+            attempts, dead_at
+        FROM schedule.dead_letter`
+
+func scanDeadLetter(row pgx.Row) (srv.DeadLetter, error) {
+    var dl srv.DeadLetter
+    var headers, callQuery string
+    var payload []byte
+    var deadAt int64
+    it := &dl.Request
+    err := row.Scan(
+        &it.Id, &it.Endpoint, &headers, &payload, &it.SendAfter, &it.MaxRetry, &it.BackOffMs, &it.TimeToLive,
+        &it.Method, &callQuery, &it.ContentType, &it.Tenant, &it.RetryPolicy, &it.MaxBackOffMs, &dl.Reason, &dl.LastError,
+        &dl.LastStatusCode, &dl.Attempts, &deadAt)
+    if err != nil {
+        return dl, err
+    }
+    it.Payload = string(payload)
+    dl.DeadAt = time.UnixMilli(deadAt).UTC()
+
+    if err = json.Unmarshal([]byte(headers), &it.Headers); err != nil {
+        return dl, fmt.Errorf("cannot convert dead letter %d headers %v", it.Id, err)
+    }
+
+    if err = json.Unmarshal([]byte(callQuery), &it.Query); err != nil {
+        return dl, fmt.Errorf("cannot convert dead letter %d query %v", it.Id, err)
+    }
+    return dl, nil
+}
+
+func (s *StorageService) GetDeadLetter(id uint64) (srv.DeadLetter, error) {
+    dl, err := scanDeadLetter(s.dbClient.QueryRow(context.Background(), `SELECT ` + deadLetterColumns + ` WHERE id = $1`, id))
+    if errors.Is(err, pgx.ErrNoRows) {
+        return dl, srv.ErrDeadLetterNotFound
+    }
+    if err != nil {
+        return dl, fmt.Errorf("cannot load dead letter %d %v", id, err)
+    }
+    return dl, nil
+}
+
+func (s *StorageService) ListDeadLetters(filter srv.DeadLetterFilter) ([]srv.DeadLetter, error) {
+    limit := filter.Limit
+    if limit <= 0 {
+        limit = math.MaxInt32
+    }
+
+    rows, err := s.dbClient.Query(context.Background(), `SELECT ` + deadLetterColumns + `
+        WHERE id > $1 AND ($2 = '' OR tenant = $2)
+        ORDER BY id
+        LIMIT $3`, filter.AfterId, filter.Tenant, limit)
+    if err != nil {
+        return nil, fmt.Errorf("cannot list dead letters %v", err)
+    }
+    defer rows.Close()
+
+    out := make([]srv.DeadLetter, 0)
+    for rows.Next() {
+        dl, err := scanDeadLetter(rows)
+        if err != nil {
+            return nil, fmt.Errorf("cannot list dead letters %v", err)
+        }
+        out = append(out, dl)
+    }
+    return out, rows.Err()
+}
+
+func (s *StorageService) CountDeadLetters() (int, error) {
+    var n int
+    if err := s.dbClient.QueryRow(context.Background(), `SELECT count(*) FROM schedule.dead_letter`).Scan(&n); err != nil {
+        return 0, fmt.Errorf("cannot count dead letters %v", err)
+    }
+    return n, nil
+}
+
+// redriveWhere selects dead letters of a redrive filter, $1 ids, $2 tenant,
+// $3 host, $4 and $5 dead at range
+const redriveWhere = `
+    WHERE (cardinality($1::bigint[]) = 0 OR id = ANY($1::bigint[]))
+        AND ($2 = '' OR tenant = $2)
+        AND ($3 = '' OR host = lower($3))
+        AND ($4::bigint = 0 OR dead_at >= $4)
+        AND ($5::bigint = 0 OR dead_at < $5)`
+
+// redrivable is server.Redrivable of a dead letter with $6 send after and
+// $7 time to live overrides at $8
+const redrivable = `
+    COALESCE($7::bigint, time_to_live) > $8::bigint
+    AND COALESCE($6::bigint, send_after) <= COALESCE($7::bigint, time_to_live)`
+
+func (s *StorageService) Redrive(filter srv.RedriveFilter, override srv.RedriveOverride, dryRun bool) (srv.RedriveResult, error) {
+    var deadAfter, deadBefore int64
+    if !filter.DeadAfter.IsZero() {
+        deadAfter = filter.DeadAfter.UnixMilli()
+    }
+    if !filter.DeadBefore.IsZero() {
+        deadBefore = filter.DeadBefore.UnixMilli()
+    }
+    ids := make([]int64, len(filter.Ids))
+    for i, id := range filter.Ids {
+        ids[i] = int64(id)
+    }
+    args := []any{ids, filter.Tenant, filter.Host, deadAfter, deadBefore,
+        optionalInt(override.SendAfter), optionalInt(override.TimeToLive), time.Now().UnixMilli()}
+
+    var res srv.RedriveResult
+    if dryRun {
+        query := `SELECT count(*) FILTER (WHERE ` + redrivable + `), count(*) FILTER (WHERE NOT (` + redrivable + `))
+            FROM schedule.dead_letter` + redriveWhere
+        if err := s.dbClient.QueryRow(context.Background(), query, args...).Scan(&res.Redriven, &res.Skipped); err != nil {
+            return res, fmt.Errorf("cannot count dead letters to redrive %v", err)
+        }
+        return res, nil
+    }
+
+    // skipped rows are counted from the snapshot before the move, they are
+    // not moved so the count is the same after it. Attempts come back with
+    // the job, its idempotency key too unless a newer job took it.
+    query := `WITH moved AS (
+        DELETE FROM schedule.dead_letter` + redriveWhere + ` AND ` + redrivable + `
+        RETURNING *
+    ), inserted AS (
+        INSERT INTO schedule.primary_queue
+            (id, endpoint, headers, payload, send_after, max_retry, back_off_ms, time_to_live, method, query, content_type, tenant,
+                retry_policy, max_back_off_ms)
+        SELECT id, endpoint, headers, payload, COALESCE($6::bigint, send_after), COALESCE($9::int, max_retry), back_off_ms,
+            COALESCE($7::bigint, time_to_live), method, query, content_type, tenant, retry_policy, max_back_off_ms
+        FROM moved
+        RETURNING id
+    ), attempts AS (
+        INSERT INTO schedule.attempt (job_id, started_at, status_code, latency_ms, error)
+        SELECT m.id, (a.value->>'started_at')::bigint, (a.value->>'status_code')::int, (a.value->>'latency_ms')::bigint,
+            a.value->>'error'
+        FROM moved m, jsonb_array_elements(m.attempt_log) WITH ORDINALITY AS a(value, n)
+        ORDER BY m.id, a.n
+    ), keys AS (
+        INSERT INTO schedule.idempotency_key (tenant, key, job_id, expires_at)
+        SELECT DISTINCT ON (tenant, idempotency_key) tenant, idempotency_key, id, idempotency_expires_at
+        FROM moved WHERE idempotency_key <> ''
+        ORDER BY tenant, idempotency_key, id DESC
+        ON CONFLICT (tenant, key) DO UPDATE
+            SET job_id = EXCLUDED.job_id, expires_at = EXCLUDED.expires_at
+            WHERE schedule.idempotency_key.expires_at < $8
+    )
+    SELECT (SELECT count(*) FROM inserted),
+        (SELECT count(*) FROM schedule.dead_letter` + redriveWhere + ` AND NOT (` + redrivable + `))`
+    args = append(args, override.MaxRetry)
+    if err := s.dbClient.QueryRow(context.Background(), query, args...).Scan(&res.Redriven, &res.Skipped); err != nil {
+        return res, fmt.Errorf("cannot redrive dead letters %v", err)
+    }
+    return res, nil
+}
+
+func optionalInt(v *uint64) *int64 {
+    if v == nil {
+        return nil
+    }
+    n := int64(*v)
+    return &n
+}
+
+const jobColumns = `q.id, q.endpoint, q.headers, q.payload, q.send_after, q.max_retry, q.back_off_ms, q.time_to_live,
+            q.method, q.query, q.content_type, q.tenant, q.retry_policy, q.max_back_off_ms, q.last_back_off_ms, s.name,
+            q.cancelled_at, q.version
+        FROM schedule.primary_queue q
+        JOIN schedule.status s ON s.id = q.status`
+
+// scanJob reads a row selected with jobColumns, attempts are not included
+func scanJob(row pgx.Row) (srv.Job, error) {
+    var job srv.Job
+    var headers, callQuery string
+    var payload []byte
+    var cancelledAt *int64
+    it := &job.Request
+    err := row.Scan(
+        &it.Id, &it.Endpoint, &headers, &payload, &it.SendAfter, &it.MaxRetry, &it.BackOffMs, &it.TimeToLive,
+        &it.Method, &callQuery, &it.ContentType, &it.Tenant, &it.RetryPolicy, &it.MaxBackOffMs, &it.LastBackOffMs,
+        &job.Status, &cancelledAt, &job.Version)
+    if err != nil {
+        return job, err
+    }
+    it.Payload = string(payload)
+
+    if err = json.Unmarshal([]byte(headers), &it.Headers); err != nil {
+        return job, fmt.Errorf("cannot convert job %d headers %v", it.Id, err)
+    }
+
+    if err = json.Unmarshal([]byte(callQuery), &it.Query); err != nil {
+        return job, fmt.Errorf("cannot convert job %d query %v", it.Id, err)
+    }
+
+    if cancelledAt != nil {
+        job.CancelledAt = time.UnixMilli(*cancelledAt).UTC()
+    }
+    return job, nil
+}
+
+func (s *StorageService) Get(id uint64) (srv.Job, error) {
+    job, err := scanJob(s.dbClient.QueryRow(context.Background(), `SELECT ` + jobColumns + ` WHERE q.id = $1`, id))
+    if errors.Is(err, pgx.ErrNoRows) {
+        return job, srv.ErrJobNotFound
+    }
+    if err != nil {
+        return job, fmt.Errorf("cannot load job %d %v", id, err)
+    }
+
+    rows, err := s.dbClient.Query(context.Background(),
+        `SELECT started_at, status_code, latency_ms, error FROM schedule.attempt WHERE job_id = $1 ORDER BY id`, id)
+    if err != nil {
+        return job, fmt.Errorf("cannot load job %d attempts %v", id, err)
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var a srv.Attempt
+        var startedAt int64
+        if err := rows.Scan(&startedAt, &a.StatusCode, &a.LatencyMs, &a.Error); err != nil {
+            return job, fmt.Errorf("cannot convert job %d attempt %v", id, err)
+        }
+        a.At = time.UnixMilli(startedAt).UTC()
+        job.Attempts = append(job.Attempts, a)
+    }
+    return job, rows.Err()
+}
+
+func (s *StorageService) List(filter srv.ListFilter) ([]srv.Job, error) {
+    limit := filter.Limit
+    if limit <= 0 {
+        limit = math.MaxInt32
+    }
+
+    rows, err := s.dbClient.Query(context.Background(), `SELECT ` + jobColumns + `
+        WHERE q.id > $1 AND ($2 = '' OR s.name = $2) AND ($4 = '' OR q.tenant = $4)
+        ORDER BY q.id
+        LIMIT $3`, filter.AfterId, filter.Status, limit, filter.Tenant)
+    if err != nil {
+        return nil, fmt.Errorf("cannot list jobs %v", err)
+    }
+    defer rows.Close()
+
+    out := make([]srv.Job, 0)
+    for rows.Next() {
+        job, err := scanJob(rows)
+        if err != nil {
+            return nil, fmt.Errorf("cannot list jobs %v", err)
+        }
+        out = append(out, job)
+    }
+    return out, rows.Err()
+}
+
+// Cancel moves a pending job to cancelled, claimed or finished jobs
+// are left as they are.
+func (s *StorageService) Cancel(id uint64) error {
+    query := `UPDATE schedule.primary_queue
+        SET status = 3, cancelled_at = $2, finished_at = $2, version = version + 1
+        WHERE id = $1 AND status = 0`
+    tag, err := s.dbClient.Exec(context.Background(), query, id, time.Now().UnixMilli())
+    if err != nil {
+        return fmt.Errorf("cannot cancel job %d %v", id, err)
+    }
+
+    if tag.RowsAffected() == 1 {
+        return nil
+    }
+
+    var status string
+    err = s.dbClient.QueryRow(context.Background(),
+        `SELECT s.name FROM schedule.primary_queue q JOIN schedule.status s ON s.id = q.status WHERE q.id = $1`, id).Scan(&status)
+    if errors.Is(err, pgx.ErrNoRows) {
+        return srv.ErrJobNotFound
+    }
+    if err != nil {
+        return fmt.Errorf("cannot cancel job %d %v", id, err)
+    }
+    return fmt.Errorf("%w: job is %s", srv.ErrJobNotPending, status)
+}
+
+func (s *StorageService) CreateKey(key srv.ApiKey) (uint64, error) {
+    var id uint64
+    err := s.dbClient.QueryRow(context.Background(),
+        `INSERT INTO schedule.api_key (name, tenant, key_hash, scopes, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+        key.Name, key.TenantId(), key.Hash, key.Scopes, key.CreatedAt.UnixMilli()).Scan(&id)
+    if err != nil {
+        return 0, fmt.Errorf("cannot create api key %v", err)
+    }
+    return id, nil
+}
+
+func scanKey(row pgx.Row) (srv.ApiKey, error) {
+    var key srv.ApiKey
+    var createdAt int64
+    var revokedAt *int64
+    if err := row.Scan(&key.Id, &key.Name, &key.Tenant, &key.Hash, &key.Scopes, &createdAt, &revokedAt); err != nil {
+        return key, err
+    }
+
+    key.CreatedAt = time.UnixMilli(createdAt).UTC()
+    if revokedAt != nil {
+        key.RevokedAt = time.UnixMilli(*revokedAt).UTC()
+    }
+    return key, nil
+}
+
+func (s *StorageService) FindKey(hash string) (srv.ApiKey, error) {
+    key, err := scanKey(s.dbClient.QueryRow(context.Background(),
+        `SELECT id, name, tenant, key_hash, scopes, created_at, revoked_at FROM schedule.api_key WHERE key_hash = $1`, hash))
+    if errors.Is(err, pgx.ErrNoRows) {
+        return key, srv.ErrKeyNotFound
+    }
+    if err != nil {
+        return key, fmt.Errorf("cannot load api key %v", err)
+    }
+    return key, nil
+}
+
+// RevokeKey keeps the key so it shows up in ListKeys, revoking it again
+// keeps the first revoke time.
+func (s *StorageService) RevokeKey(id uint64) error {
+    tag, err := s.dbClient.Exec(context.Background(),
+        `UPDATE schedule.api_key SET revoked_at = COALESCE(revoked_at, $2) WHERE id = $1`, id, time.Now().UnixMilli())
+    if err != nil {
+        return fmt.Errorf("cannot revoke api key %d %v", id, err)
+    }
+
+    if tag.RowsAffected() == 0 {
+        return srv.ErrKeyNotFound
+    }
+    return nil
+}
+
+func (s *StorageService) ListKeys() ([]srv.ApiKey, error) {
+    rows, err := s.dbClient.Query(context.Background(),
+        `SELECT id, name, tenant, key_hash, scopes, created_at, revoked_at FROM schedule.api_key ORDER BY id`)
+    if err != nil {
+        return nil, fmt.Errorf("cannot list api keys %v", err)
+    }
+    defer rows.Close()
+
+    out := make([]srv.ApiKey, 0)
+    for rows.Next() {
+        key, err := scanKey(rows)
+        if err != nil {
+            return nil, fmt.Errorf("cannot list api keys %v", err)
+        }
+        out = append(out, key)
+    }
+    return out, rows.Err()
+}
+
+// Patch locks the row so a concurrent Load cannot claim it while the
+// patched request is written.
+func (s *StorageService) Patch(id uint64, version uint64, patch srv.JobPatch) (srv.Job, error) {
+    ctx := context.Background()
+    tx, err := s.dbClient.Begin(ctx)
+    if err != nil {
+        return srv.Job{}, fmt.Errorf("cannot patch job %d %v", id, err)
+    }
+    defer tx.Rollback(ctx)
+
+    var req srv.ScheduleRequest
+    var headers string
+    var payload []byte
+    var status int
+    var current uint64
+    err = tx.QueryRow(ctx, `SELECT id, endpoint, headers, payload, send_after, max_retry, back_off_ms, time_to_live, status, version
+        FROM schedule.primary_queue WHERE id = $1 FOR UPDATE`, id).Scan(
+        &req.Id, &req.Endpoint, &headers, &payload, &req.SendAfter, &req.MaxRetry, &req.BackOffMs, &req.TimeToLive, &status, &current)
+    if errors.Is(err, pgx.ErrNoRows) {
+        return srv.Job{}, srv.ErrJobNotFound
+    }
+    if err != nil {
+        return srv.Job{}, fmt.Errorf("cannot patch job %d %v", id, err)
+    }
+
+    if status != statusInitial {
+        return srv.Job{}, fmt.Errorf("%w: job is %s", srv.ErrJobNotPending, statusName(status))
+    }
+
+    if version != 0 && version != current {
+        return srv.Job{}, fmt.Errorf("%w: job is at version %d", srv.ErrVersionMismatch, current)
+    }
+
+    if err = json.Unmarshal([]byte(headers), &req.Headers); err != nil {
+        return srv.Job{}, fmt.Errorf("cannot convert job %d headers %v", id, err)
+    }
+    req.Payload = string(payload)
+    patch.Apply(&req)
+
+    bs, err := json.Marshal(req.Headers)
+    if err != nil {
+        return srv.Job{}, fmt.Errorf("failed to convert headers to string %s", err)
+    }
+
+    _, err = tx.Exec(ctx, `UPDATE schedule.primary_queue
+        SET headers = $2::jsonb, payload = $3, send_after = $4, max_retry = $5, back_off_ms = $6, time_to_live = $7, version = version + 1
+        WHERE id = $1`,
+        id, string(bs), []byte(req.Payload), req.SendAfter, req.MaxRetry, req.BackOffMs, req.TimeToLive)
+    if err != nil {
+        return srv.Job{}, fmt.Errorf("cannot patch job %d %v", id, err)
+    }
+
+    if err = tx.Commit(ctx); err != nil {
+        return srv.Job{}, fmt.Errorf("cannot patch job %d %v", id, err)
+    }
+    return s.Get(id)
+}
+
 func (s *StorageService) Shutdown() error {
+    if err := s.saver.Shutdown(); err != nil {
+        return err
+    }
     s.dbClient.Close()
     return nil
 }
 
-func runDatabaseMigration(migrationPath string) error {
+func runDatabaseMigration(dbUrl, migrationPath string) error {
     log.Println("running migration")
-    db, err := sql.Open("pgx", os.Getenv("DB_URL"))
+    db, err := sql.Open("pgx", dbUrl)
     if err != nil {
         return fmt.Errorf("error openning connection to dababase %s", err)
     }
     defer db.Close()
 
-    driver, err := pgx.WithInstance(db, &pgx.Config{})
+    driver, err := migratepgx.WithInstance(db, &migratepgx.Config{})
     if err != nil {
         return fmt.Errorf("error getting a driver %v", err)
     }
@@ -4,9 +4,11 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"os"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -17,12 +19,6 @@ import (
 	"github.com/testcontainers/testcontainers-go/wait"
 )
 
-func init() {
-    if err := StartTestDatabase(); err != nil {
-        panic(err)
-    }
-}
-
 func StartTestDatabase() error {
     ctx := context.Background()
     cont, err := postgres.RunContainer(ctx,
@@ -51,6 +47,9 @@ var testDb *sql.DB
 var testDbErr error
 func GetTestDatabase() (*sql.DB, error) {
     onceStartDb.Do(func() {
+        if testDbErr = StartTestDatabase(); testDbErr != nil {
+            return
+        }
         testDb, testDbErr = sql.Open("pgx", os.Getenv("DB_URL"))
     })
     return testDb, testDbErr
@@ -64,7 +63,13 @@ func TruncateTables() error {
     query := `DO $$ 
     BEGIN 
         IF EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'primary_queue' AND table_schema = 'schedule') THEN
-            EXECUTE 'TRUNCATE TABLE schedule.primary_queue';
+            EXECUTE 'TRUNCATE TABLE schedule.primary_queue CASCADE';
+        END IF;
+        IF EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'api_key' AND table_schema = 'schedule') THEN
+            EXECUTE 'TRUNCATE TABLE schedule.api_key';
+        END IF;
+        IF EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'dead_letter' AND table_schema = 'schedule') THEN
+            EXECUTE 'TRUNCATE TABLE schedule.dead_letter';
         END IF;
     END $$;`
     if _, err = db.Exec(query); err != nil {
@@ -75,12 +80,12 @@ func TruncateTables() error {
 
 func TestSave(t *testing.T) {
     if err := TruncateTables(); err != nil {
-        t.Error(err)
+        t.Fatal(err)
     }
 
-    storage, err := NewStorageService(StorageServiceCfg{migrationPath: "file://../../resources/sql"})
+    storage, err := NewStorageService(StorageServiceCfg{DbUrl: os.Getenv("DB_URL"), MigrationPath: "file://../../resources/sql"})
     if err != nil {
-        t.Error(err)
+        t.Fatal(err)
     }
 
     req := server.ScheduleRequest{
@@ -93,7 +98,7 @@ func TestSave(t *testing.T) {
     	TimeToLive: 91909129,
     }
 
-    err = storage.Save(req)
+    _, err = storage.Save(req)
     if err != nil {
         t.Error(err)
     }
@@ -106,7 +111,7 @@ func TestSave(t *testing.T) {
     var headers string
     var got server.ScheduleRequest
     var status int
-    err = db.QueryRow("SELECT * FROM schedule.primary_queue LIMIT 1;").Scan(
+    err = db.QueryRow("SELECT id, endpoint, headers, payload, send_after, max_retry, back_off_ms, time_to_live, status FROM schedule.primary_queue LIMIT 1;").Scan(
         &got.Id,
         &got.Endpoint,
         &headers,
@@ -139,169 +144,194 @@ func TestSave(t *testing.T) {
     }
 }
 
-func TestSaveLoad(t *testing.T) {
+func TestUpdate(t *testing.T) {
     if err := TruncateTables(); err != nil {
+        t.Fatal(err)
+    }
+    db, err := GetTestDatabase()
+    if err != nil {
         t.Error(err)
     }
 
-    storage, err := NewStorageService(StorageServiceCfg{migrationPath: "file://../../resources/sql"})
+    storage, err := NewStorageService(StorageServiceCfg{DbUrl: os.Getenv("DB_URL"), MigrationPath: "file://../../resources/sql"})
     if err != nil {
-        t.Error(err)
+        t.Fatal(err)
     }
 
     req := server.ScheduleRequest{
-    	Endpoint:   "Test",
+        Endpoint:   "Test",
         Headers:    map[string]string{"Ha": "Ha", "He": "He"},
-    	Payload:    "slkdjf",
-    	SendAfter:  328389,
-    	MaxRetry:   23,
-    	BackOffMs:  12,
-    	TimeToLive: uint64(time.Now().UnixMilli()) + 5_000,
+        Payload:    "slkdjf",
+        SendAfter:  328389,
+        MaxRetry:   23,
+        BackOffMs:  12,
+        TimeToLive: uint64(time.Now().UnixMilli()) + 5_000,
     }
 
-    if err = storage.Save(req); err != nil {
+    if _, err = storage.Save(req); err != nil {
         t.Error(err)
     }
 
-    loaded := storage.Load(10)
-    if len(loaded) != 1 {
-        t.Errorf("expected loaded size of 1 got %d", len(loaded))
-    }
+    it := storage.Load(1)[0]
+    it.MaxRetry = 1
+    it.LastBackOffMs = 400
+
+    storage.Update(it)
 
-    it := loaded[0]
-    if it.Id == 0 {
-        t.Errorf("Id was not set")
+
+    var retry int
+    var lastBackOff uint64
+    err = db.QueryRow("SELECT max_retry, last_back_off_ms FROM schedule.primary_queue WHERE id = $1;", it.Id).Scan(&retry, &lastBackOff)
+    if err != nil {
+        t.Error(err)
     }
-    it.Id = 0
 
-    if !reflect.DeepEqual(it, req) {
-        t.Errorf("expected %+v got %+v", req, it)
+    if retry != 1 || lastBackOff != 400 {
+        t.Errorf("expected max_retry 1 and last backoff 400 got %d %d\n", retry, lastBackOff)
     }
+
 }
 
-func TestLoadNItems(t *testing.T) {
+func TestSaveBatchPerRowError(t *testing.T) {
     if err := TruncateTables(); err != nil {
-        t.Error(err)
+        t.Fatal(err)
     }
 
-    storage, err := NewStorageService(StorageServiceCfg{migrationPath: "file://../../resources/sql"})
+    storage, err := NewStorageService(StorageServiceCfg{DbUrl: os.Getenv("DB_URL"), MigrationPath: "file://../../resources/sql"})
     if err != nil {
-        t.Error(err)
+        t.Fatal(err)
+    }
+
+    // batch the whole loop into one insert, endpoint column is varchar(1024)
+    storage.saver = NewBulkProcessor(100, 10, 100 * time.Millisecond, storage.saveBatch)
+    var wg sync.WaitGroup
+    errs := make([]error, 10)
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            req := newTestRequest()
+            if i == 3 {
+                req.Endpoint = strings.Repeat("a", 2000)
+            }
+            _, errs[i] = storage.Save(req)
+        }(i)
+    }
+    wg.Wait()
+
+    for i, err := range errs {
+        if (i == 3) != (err != nil) {
+            t.Errorf("request %d got unexpected error %v", i, err)
+        }
     }
 
-    for i := 0; i < 20; i++ {
-        req := server.ScheduleRequest{
-            Endpoint:   "Test",
-            Headers:    map[string]string{"Ha": "Ha", "He": "He"},
-            Payload:    "slkdjf",
-            SendAfter:  328389,
-            MaxRetry:   23,
-            BackOffMs:  12,
-            TimeToLive: uint64(time.Now().UnixMilli()) + 5_000,
-        }
+    db, err := GetTestDatabase()
+    if err != nil {
+        t.Fatal(err)
+    }
 
-        if err = storage.Save(req); err != nil {
-            t.Error(err)
-        }
+    var count int
+    if err = db.QueryRow("SELECT COUNT(1) FROM schedule.primary_queue;").Scan(&count); err != nil {
+        t.Error(err)
     }
 
-    loaded := storage.Load(10)
-    if len(loaded) != 10 {
-        t.Errorf("expected loaded size of 10 got %d", len(loaded))
+    if count != 9 {
+        t.Errorf("expected 9 saved rows got %d", count)
     }
 }
 
-func TestDeleteTask(t *testing.T) {
+func BenchmarkSave(b *testing.B) {
     if err := TruncateTables(); err != nil {
-        t.Error(err)
+        b.Fatal(err)
     }
 
-    db, err := GetTestDatabase()
+    storage, err := NewStorageService(StorageServiceCfg{DbUrl: os.Getenv("DB_URL"), MigrationPath: "file://../../resources/sql"})
     if err != nil {
-        t.Error(err)
+        b.Fatal(err)
+    }
+    storage.saver = NewBulkProcessor(10_000, 1_000, 10 * time.Millisecond, storage.saveBatch)
+
+    req := newTestRequest()
+    b.SetParallelism(1_000)
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            if _, err := storage.Save(req); err != nil {
+                b.Error(err)
+            }
+        }
+    })
+    b.ReportMetric(float64(b.N) / b.Elapsed().Seconds(), "inserts/s")
+}
+
+func TestApiKeys(t *testing.T) {
+    if err := TruncateTables(); err != nil {
+        t.Fatal(err)
     }
 
-    storage, err := NewStorageService(StorageServiceCfg{migrationPath: "file://../../resources/sql"})
+    storage, err := NewStorageService(StorageServiceCfg{DbUrl: os.Getenv("DB_URL"), MigrationPath: "file://../../resources/sql"})
     if err != nil {
-        t.Error(err)
+        t.Fatal(err)
     }
 
-    req := server.ScheduleRequest{
-        Endpoint:   "Test",
-        Headers:    map[string]string{"Ha": "Ha", "He": "He"},
-        Payload:    "slkdjf",
-        SendAfter:  328389,
-        MaxRetry:   23,
-        BackOffMs:  12,
-        TimeToLive: uint64(time.Now().UnixMilli()) + 5_000,
+    id, err := storage.CreateKey(server.ApiKey{Name: "ci", Hash: "hash", Scopes: []string{server.ScopeJobsWrite}, CreatedAt: time.Now()})
+    if err != nil {
+        t.Fatal(err)
     }
 
-    if err = storage.Save(req); err != nil {
-        t.Error(err)
+    key, err := storage.FindKey("hash")
+    if err != nil || key.Id != id || key.Name != "ci" || !key.Allows(server.ScopeJobsWrite) || key.Revoked() {
+        t.Errorf("unexpected key %+v %v", key, err)
     }
 
-    loaded := storage.Load(10)
-    if len(loaded) != 1 {
-        t.Errorf("expected loaded size of 1 got %d", len(loaded))
+    if err := storage.RevokeKey(id); err != nil {
+        t.Fatal(err)
+    }
+    if err := storage.RevokeKey(id + 1); !errors.Is(err, server.ErrKeyNotFound) {
+        t.Errorf("expected not found on revoke got %v", err)
     }
 
-    it := loaded[0]
-    storage.Delete(it)
-
-
-    var count int
-    err = db.QueryRow("SELECT COUNT(1) FROM schedule.primary_queue WHERE id = $1;", it.Id).Scan(&count)
-    if err != nil {
-        t.Error(err)
+    keys, err := storage.ListKeys()
+    if err != nil || len(keys) != 1 || !keys[0].Revoked() {
+        t.Errorf("expected revoked key in list got %+v %v", keys, err)
     }
 
-    if count != 0 {
-        t.Errorf("expected no rows to be found with id %d\n", it.Id)
+    if _, err := storage.FindKey("other"); !errors.Is(err, server.ErrKeyNotFound) {
+        t.Errorf("expected not found got %v", err)
     }
 }
 
-func TestUpdate(t *testing.T) {
+
+func TestPurgeDeletesAttempts(t *testing.T) {
     if err := TruncateTables(); err != nil {
-        t.Error(err)
-    }
-    db, err := GetTestDatabase()
-    if err != nil {
-        t.Error(err)
+        t.Fatal(err)
     }
 
-    storage, err := NewStorageService(StorageServiceCfg{migrationPath: "file://../../resources/sql"})
+    storage, err := NewStorageService(StorageServiceCfg{DbUrl: os.Getenv("DB_URL"), MigrationPath: "file://../../resources/sql"})
     if err != nil {
-        t.Error(err)
+        t.Fatal(err)
     }
 
-    req := server.ScheduleRequest{
-        Endpoint:   "Test",
-        Headers:    map[string]string{"Ha": "Ha", "He": "He"},
-        Payload:    "slkdjf",
-        SendAfter:  328389,
-        MaxRetry:   23,
-        BackOffMs:  12,
-        TimeToLive: uint64(time.Now().UnixMilli()) + 5_000,
+    id, err := storage.Save(newTestRequest())
+    if err != nil {
+        t.Fatal(err)
     }
+    storage.AddAttempt(id, server.Attempt{At: time.Now(), StatusCode: 200})
+    storage.Done(storage.Load(1)[0])
 
-    if err = storage.Save(req); err != nil {
-        t.Error(err)
+    if n, err := storage.Purge(time.Now().Add(time.Second), 0); err != nil || n != 1 {
+        t.Errorf("expected finished job to be purged got %d %v", n, err)
     }
 
-    it := storage.Load(1)[0]
-    it.MaxRetry = 1
-
-    storage.Update(it)
-
-
-    var retry int
-    err = db.QueryRow("SELECT max_retry FROM schedule.primary_queue WHERE id = $1;", it.Id).Scan(&retry)
+    db, err := GetTestDatabase()
     if err != nil {
-        t.Error(err)
+        t.Fatal(err)
     }
-
-    if retry != 1 {
-        t.Errorf("expected max_retry to be 1 got %d\n", retry)
+    var attempts int
+    if err := db.QueryRow(`SELECT count(*) FROM schedule.attempt WHERE job_id = $1`, id).Scan(&attempts); err != nil {
+        t.Fatal(err)
+    }
+    if attempts != 0 {
+        t.Errorf("expected attempts of purged job to be deleted got %d", attempts)
     }
-
 }
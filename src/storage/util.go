@@ -1,33 +1,46 @@
 package storage
 
 import (
+	"errors"
+	"sort"
 	"sync/atomic"
 	"time"
+
+	srv "github.com/kucicm/boomerang/src/server"
 )
 
-type task [T any] struct {
+type result [R any] struct {
+    value R
+    err error
+}
+
+type task [T, R any] struct {
     item T
-    err chan error
+    res chan result[R]
 }
 
-type BulkProcessor [T any] struct {
-    queue chan task[T]
+// BulkProcessor groups items added by concurrent callers into batches of
+// up to maxBatchSize (or whatever arrived within maxWait) and hands them to
+// batchFn, which returns one value and one error per item so each caller
+// gets its own.
+type BulkProcessor [T, R any] struct {
+    queue chan task[T, R]
     maxBatchSize int
     maxWait time.Duration
-    fn func([]T) error
+    fn func([]T) ([]R, []error)
 
     statusId int32
     done chan struct{}
 }
 
-func NewBulkProcessor[T any](
+func NewBulkProcessor[T, R any](
     maxQueueSize, 
     maxBatchSize int, 
     maxWait time.Duration,
-    batchFn func([]T) error,
-) *BulkProcessor[T] {
-    b := &BulkProcessor[T]{
-        queue: make(chan task[T], maxQueueSize),
+    batchFn func([]T) ([]R, []error),
+) *BulkProcessor[T, R] {
+    b := &BulkProcessor[T, R]{
+        queue: make(chan task[T, R], maxQueueSize),
         maxBatchSize: maxBatchSize,
         maxWait: maxWait,
         fn: batchFn,
@@ -38,41 +51,55 @@ func NewBulkProcessor[T any](
     return b
 }
 
-func (b *BulkProcessor[T]) Add(item T) error {
-    err := make(chan error)
-    b.queue <- task[T]{item, err}
-    return <-err
+func (b *BulkProcessor[T, R]) Add(item T) (R, error) {
+    res := make(chan result[R], 1)
+    b.queue <- task[T, R]{item, res}
+    r := <-res
+    return r.value, r.err
 }
 
-func (b *BulkProcessor[T]) start() {
+func (b *BulkProcessor[T, R]) start() {
     for atomic.LoadInt32(&b.statusId) == 0 {
-        batch, errs := b.createBatch()
-        err := b.fn(batch)
-        for i := 0; i < len(errs); i++ {
-            errs[i] <- err
+        batch, res := b.createBatch()
+        if len(batch) == 0 {
+            continue
+        }
+
+        values, errs := b.fn(batch)
+        for i := 0; i < len(res); i++ {
+            var r result[R]
+            if i < len(values) {
+                r.value = values[i]
+            }
+            if i < len(errs) {
+                r.err = errs[i]
+            } else {
+                r.err = errors.New("batch function returned no result for item")
+            }
+            res[i] <- r
         }
     }
     b.done<-struct{}{}
 }
 
-func (b *BulkProcessor[T]) createBatch() ([]T, []chan error) {
+func (b *BulkProcessor[T, R]) createBatch() ([]T, []chan result[R]) {
     timeout := time.NewTimer(b.maxWait)
     defer timeout.Stop()
 
-    items := make([]T, b.maxBatchSize)
-    errs := make([]chan error, b.maxBatchSize)
-    for i := 0; i < b.maxBatchSize; i++ {
+    items := make([]T, 0, b.maxBatchSize)
+    res := make([]chan result[R], 0, b.maxBatchSize)
+    for len(items) < b.maxBatchSize {
         select {
         case it := <-b.queue:
-            items[i], errs[i] = it.item, it.err
+            items, res = append(items, it.item), append(res, it.res)
         case <-timeout.C:
-            return items, errs
+            return items, res
         }
     }
-    return items, errs
+    return items, res
 }
 
-func (b *BulkProcessor[T]) Shutdown() error {
+func (b *BulkProcessor[T, R]) Shutdown() error {
     for len(b.queue) > 0 {
         time.Sleep(time.Second)
     }
@@ -80,3 +107,142 @@ func (b *BulkProcessor[T]) Shutdown() error {
     <-b.done
     return nil
 }
+
+const (
+    statusInitial = 0
+    statusRunning = 1
+    statusDone = 2
+    statusCancelled = 3
+    // dead letters are kept apart from jobs, the status only marks them in logs
+    statusDead = 4
+)
+
+func statusName(status int) string {
+    switch status {
+    case statusRunning:
+        return srv.StatusRunning
+    case statusDone:
+        return srv.StatusDone
+    case statusCancelled:
+        return srv.StatusCancelled
+    default:
+        return srv.StatusInitial
+    }
+}
+
+// persistedStatus is status a backend without durable claims writes,
+// running requests are released on restart.
+func persistedStatus(status int) int {
+    if status == statusRunning {
+        return statusInitial
+    }
+    return status
+}
+
+// firstIds sorts ids and returns at most limit of them
+func firstIds(ids []uint64, limit int) []uint64 {
+    sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+    if limit > 0 && len(ids) > limit {
+        ids = ids[:limit]
+    }
+    return ids
+}
+
+// newDeadLetter is dead letter of req with its attempts
+func newDeadLetter(req srv.ScheduleRequest, attempts []srv.Attempt, reason string, deadAt time.Time) srv.DeadLetter {
+    dl := srv.DeadLetter{Request: req, Reason: reason, Attempts: len(attempts), DeadAt: deadAt.UTC()}
+    if len(attempts) > 0 {
+        last := attempts[len(attempts) - 1]
+        dl.LastError, dl.LastStatusCode = last.Error, last.StatusCode
+    }
+    return dl
+}
+
+type idempotencyKey struct {
+    id uint64
+    expiresAt uint64
+}
+
+// matches reports if job with tenant and status is selected by filter
+func matches(filter srv.ListFilter, tenant string, status int) bool {
+    return (filter.Tenant == "" || filter.Tenant == tenant) && (filter.Status == "" || statusName(status) == filter.Status)
+}
+
+// tenantOf is tenant saved with request, requests without one belong to
+// the default tenant
+func tenantOf(r srv.ScheduleRequest) string {
+    if r.Tenant == "" {
+        return srv.DefaultTenant
+    }
+    return r.Tenant
+}
+
+// keyOf is the map key of request idempotency key, keys are unique per tenant
+func keyOf(r srv.ScheduleRequest) string {
+    return tenantOf(r) + "\x00" + r.IdempotencyKey
+}
+
+func (k idempotencyKey) expired(now uint64) bool {
+    return k.expiresAt < now
+}
+
+// purgeable reports if entry is done or cancelled and finished before
+// the cutoff (unix ms)
+func (e *queueEntry) purgeable(before int64) bool {
+    return (e.status == statusDone || e.status == statusCancelled) && e.finishedAt < before
+}
+
+// queueEntry is what backends keep in the time index, embedded storage
+// reads the rest of the request (headers, payload, ...) from the log at offset.
+type queueEntry struct {
+    id uint64
+    sendAfter uint64
+    timeToLive uint64
+    offset int64
+    size uint32
+    status int
+    finishedAt int64
+    tenant string
+    host string
+    heapIdx int
+}
+
+// timeIndex is a min-heap of entries ordered by send after and id
+type timeIndex []*queueEntry
+
+func (t timeIndex) Len() int {
+    return len(t)
+}
+
+func (t timeIndex) Less(i, j int) bool {
+    if t[i].sendAfter == t[j].sendAfter {
+        return t[i].id < t[j].id
+    }
+    return t[i].sendAfter < t[j].sendAfter
+}
+
+func (t timeIndex) Swap(i, j int) {
+    t[i], t[j] = t[j], t[i]
+    t[i].heapIdx = i
+    t[j].heapIdx = j
+}
+
+func (t *timeIndex) Push(x any) {
+    e := x.(*queueEntry)
+    e.heapIdx = len(*t)
+    *t = append(*t, e)
+}
+
+func (t *timeIndex) Pop() any {
+    old := *t
+    n := len(old)
+    e := old[n-1]
+    old[n-1] = nil
+    e.heapIdx = -1
+    *t = old[:n-1]
+    return e
+}
+
+func sortTimeIndex(t timeIndex) {
+    sort.Slice(t, t.Less)
+}
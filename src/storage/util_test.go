@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBulkProcessorPerItemErrors(t *testing.T) {
+    var batches int32
+    bp := NewBulkProcessor(100, 10, 50 * time.Millisecond, func(items []int) ([]int, []error) {
+        atomic.AddInt32(&batches, 1)
+        doubled := make([]int, len(items))
+        errs := make([]error, len(items))
+        for i, it := range items {
+            doubled[i] = it * 2
+            if it % 2 == 1 {
+                errs[i] = errors.New("odd")
+            }
+        }
+        return doubled, errs
+    })
+
+    var wg sync.WaitGroup
+    values := make([]int, 10)
+    results := make([]error, 10)
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            values[i], results[i] = bp.Add(i)
+        }(i)
+    }
+    wg.Wait()
+
+    for i, err := range results {
+        if (i % 2 == 1) != (err != nil) {
+            t.Errorf("item %d got unexpected error %v", i, err)
+        }
+
+        if values[i] != i * 2 {
+            t.Errorf("item %d got unexpected value %d", i, values[i])
+        }
+    }
+
+    if n := atomic.LoadInt32(&batches); n > 2 {
+        t.Errorf("expected items to be batched got %d batches", n)
+    }
+
+    if err := bp.Shutdown(); err != nil {
+        t.Error(err)
+    }
+}
+
+func TestBulkProcessorFlushesPartialBatch(t *testing.T) {
+    var size int
+    bp := NewBulkProcessor(10, 100, 10 * time.Millisecond, func(items []string) ([]int, []error) {
+        size = len(items)
+        return make([]int, len(items)), make([]error, len(items))
+    })
+    defer bp.Shutdown()
+
+    if _, err := bp.Add("single"); err != nil {
+        t.Error(err)
+    }
+
+    if size != 1 {
+        t.Errorf("expected batch with only added item got %d items", size)
+    }
+}
+
+func BenchmarkBulkProcessor(b *testing.B) {
+    bp := NewBulkProcessor(10_000, 1_000, time.Millisecond, func(items []int) ([]int, []error) {
+        return items, make([]error, len(items))
+    })
+    defer bp.Shutdown()
+
+    b.SetParallelism(100)
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            if _, err := bp.Add(1); err != nil {
+                b.Error(err)
+            }
+        }
+    })
+}
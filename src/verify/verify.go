@@ -0,0 +1,139 @@
+// Package verify checks that a callback was sent by Boomerang.
+//
+// Every callback carries Webhook-Id, Webhook-Timestamp (unix seconds) and
+// Webhook-Signature headers. Signature header holds space separated
+// "v1,<base64 HMAC-SHA256>" entries, one per signing secret, of
+// "<timestamp>.<method>.<url>.<body>". A callback is valid when any entry
+// matches any of the receiver secrets, so secrets can be rotated by
+// configuring the new one next to the old one on both sides.
+package verify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+    HeaderId = "Webhook-Id"
+    HeaderTimestamp = "Webhook-Timestamp"
+    HeaderSignature = "Webhook-Signature"
+
+    // SecretPrefix marks base64 encoded secrets, others are used as is
+    SecretPrefix = "whsec_"
+    DefaultTolerance = 5 * time.Minute
+)
+
+var (
+    ErrMissingHeaders = errors.New("missing webhook headers")
+    ErrInvalidTimestamp = errors.New("invalid webhook timestamp")
+    ErrNoMatchingSignature = errors.New("no matching webhook signature")
+)
+
+// DecodeSecret returns key of secret, whsec_ prefixed secrets are base64
+func DecodeSecret(secret string) ([]byte, error) {
+    encoded, ok := strings.CutPrefix(secret, SecretPrefix)
+    if !ok {
+        return []byte(secret), nil
+    }
+
+    key, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+        return nil, fmt.Errorf("invalid secret %v", err)
+    }
+    return key, nil
+}
+
+// Sign returns signature entry of a callback signed with key
+func Sign(key []byte, timestamp int64, method, url string, body []byte) string {
+    mac := hmac.New(sha256.New, key)
+    fmt.Fprintf(mac, "%d.%s.%s.", timestamp, method, url)
+    mac.Write(body)
+    return "v1," + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verifier checks callbacks against Keys, callbacks with timestamp
+// further than Tolerance from Now are rejected.
+type Verifier struct {
+    Keys [][]byte
+    Tolerance time.Duration
+    Now func() time.Time
+}
+
+func NewVerifier(secrets ...string) (*Verifier, error) {
+    v := &Verifier{Tolerance: DefaultTolerance, Now: time.Now}
+    for _, s := range secrets {
+        key, err := DecodeSecret(s)
+        if err != nil {
+            return nil, err
+        }
+        v.Keys = append(v.Keys, key)
+    }
+    return v, nil
+}
+
+// Verify checks signature of a callback to url (scheme, host and request
+// uri as the sender saw them) with header and body
+func (v *Verifier) Verify(header http.Header, method, url string, body []byte) error {
+    ts, signatures := header.Get(HeaderTimestamp), header.Get(HeaderSignature)
+    if ts == "" || signatures == "" {
+        return ErrMissingHeaders
+    }
+
+    timestamp, err := strconv.ParseInt(ts, 10, 64)
+    if err != nil {
+        return ErrInvalidTimestamp
+    }
+
+    now := v.Now()
+    sent := time.Unix(timestamp, 0)
+    if sent.Before(now.Add(-v.Tolerance)) || sent.After(now.Add(v.Tolerance)) {
+        return ErrInvalidTimestamp
+    }
+
+    for _, key := range v.Keys {
+        expected := Sign(key, timestamp, method, url, body)
+        for _, s := range strings.Fields(signatures) {
+            if hmac.Equal([]byte(s), []byte(expected)) {
+                return nil
+            }
+        }
+    }
+    return ErrNoMatchingSignature
+}
+
+// VerifyRequest checks r as received by the server and returns its body,
+// r.Body can be read again afterwards. Url is taken from r.Host and
+// r.URL, behind a proxy which rewrites them use Verify with the
+// public url.
+func (v *Verifier) VerifyRequest(r *http.Request) ([]byte, error) {
+    var body []byte
+    if r.Body != nil {
+        var err error
+        if body, err = io.ReadAll(r.Body); err != nil {
+            return nil, err
+        }
+        r.Body.Close()
+        r.Body = io.NopCloser(bytes.NewReader(body))
+    }
+
+    scheme := "http"
+    if r.TLS != nil {
+        scheme = "https"
+    }
+    return body, v.Verify(r.Header, r.Method, Url(scheme, r.Host, r.URL.RequestURI()), body)
+}
+
+// Url is what sender signs of a callback url, fragment is not sent so it
+// is not signed.
+func Url(scheme, host, requestUri string) string {
+    return scheme + "://" + host + requestUri
+}
@@ -0,0 +1,80 @@
+package verify
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signedRequest(t *testing.T, key []byte, timestamp int64, body string) *http.Request {
+    r := httptest.NewRequest(http.MethodPost, "http://hooks.example.com/done?id=1", strings.NewReader(body))
+    r.Header.Set(HeaderId, "1")
+    r.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+    r.Header.Set(HeaderSignature, "v1,bm90LXRoaXMtb25l " + Sign(key, timestamp, http.MethodPost, "http://hooks.example.com/done?id=1", []byte(body)))
+    return r
+}
+
+func TestVerifyRequest(t *testing.T) {
+    now := time.Unix(1_700_000_000, 0)
+    v, err := NewVerifier("old-secret", "whsec_" + "bmV3LXNlY3JldA==")
+    if err != nil {
+        t.Fatal(err)
+    }
+    v.Now = func() time.Time { return now }
+
+    body, err := v.VerifyRequest(signedRequest(t, []byte("new-secret"), now.Unix(), `{"a":1}`))
+    if err != nil || string(body) != `{"a":1}` {
+        t.Errorf("expected request signed with rotated secret to verify got %q %v", body, err)
+    }
+
+    r := signedRequest(t, []byte("old-secret"), now.Unix() - 60, "payload")
+    if _, err := v.VerifyRequest(r); err != nil {
+        t.Errorf("expected request signed with old secret to verify got %v", err)
+    }
+    if rest, _ := io.ReadAll(r.Body); string(rest) != "payload" {
+        t.Errorf("expected body to be readable after verify got %q", rest)
+    }
+}
+
+func TestVerifyRejects(t *testing.T) {
+    now := time.Unix(1_700_000_000, 0)
+    v, _ := NewVerifier("secret")
+    v.Now = func() time.Time { return now }
+
+    r := signedRequest(t, []byte("other"), now.Unix(), "payload")
+    if _, err := v.VerifyRequest(r); !errors.Is(err, ErrNoMatchingSignature) {
+        t.Errorf("expected wrong secret to be rejected got %v", err)
+    }
+
+    r = signedRequest(t, []byte("secret"), now.Unix(), "payload")
+    r.Body = io.NopCloser(strings.NewReader("forged"))
+    if _, err := v.VerifyRequest(r); !errors.Is(err, ErrNoMatchingSignature) {
+        t.Errorf("expected changed body to be rejected got %v", err)
+    }
+
+    r = signedRequest(t, []byte("secret"), now.Unix(), "payload")
+    r.Method = http.MethodPut
+    if _, err := v.VerifyRequest(r); !errors.Is(err, ErrNoMatchingSignature) {
+        t.Errorf("expected changed method to be rejected got %v", err)
+    }
+
+    r = signedRequest(t, []byte("secret"), now.Unix() - 600, "payload")
+    if _, err := v.VerifyRequest(r); !errors.Is(err, ErrInvalidTimestamp) {
+        t.Errorf("expected old timestamp to be rejected got %v", err)
+    }
+
+    r = signedRequest(t, []byte("secret"), now.Unix(), "payload")
+    r.Header.Del(HeaderSignature)
+    if _, err := v.VerifyRequest(r); !errors.Is(err, ErrMissingHeaders) {
+        t.Errorf("expected unsigned request to be rejected got %v", err)
+    }
+
+    if _, err := NewVerifier("whsec_%%%"); err == nil {
+        t.Error("expected invalid base64 secret to fail")
+    }
+}